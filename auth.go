@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"bit4bit.in/wueco/digest"
+	"bit4bit.in/wueco/sipproto"
+)
+
+// authenticator answers the challenges of the SIP server with the
+// credentials of the web user so the SIP password never reaches the
+// browser. The retried request gets the next CSeq RFC 3261 section 22.2,
+// the CSeq of the browser is shifted by the retries of every Call-ID.
+type authenticator struct {
+	store   digest.Store
+	webUser string
+	client  *digest.Client
+
+	mu      sync.Mutex
+	offsets map[string]uint32
+}
+
+func newAuthenticator(store digest.Store, webUser string) *authenticator {
+	return &authenticator{
+		store:   store,
+		webUser: webUser,
+		client:  digest.NewClient(),
+		offsets: make(map[string]uint32),
+	}
+}
+
+func (a *authenticator) offset(callID string) uint32 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.offsets[callID]
+}
+
+// toSIP shifts the CSeq of a request of the browser.
+func (a *authenticator) toSIP(sipMsg *sipMessage) {
+	shiftCSeq(sipMsg.header, int64(a.offset(sipMsg.header.Get("call-id"))))
+}
+
+// toWS restores the CSeq of a response for the browser.
+func (a *authenticator) toWS(sipMsg *sipMessage) {
+	shiftCSeq(sipMsg.header, -int64(a.offset(sipMsg.header.Get("call-id"))))
+}
+
+func shiftCSeq(header sipproto.Header, offset int64) {
+	if offset == 0 {
+		return
+	}
+	cseq, err := sipproto.ParseCSeq(header.Get("cseq"))
+	if err != nil {
+		return
+	}
+	cseq.Seq = uint32(int64(cseq.Seq) + offset)
+	header.Set("CSeq", cseq.String())
+}
+
+// retry returns req with the credentials for the challenge of rsp,
+// it returns nil when the web user has no credentials for the realm.
+func (a *authenticator) retry(req, rsp *sipproto.Message) *sipproto.Message {
+	var challengeName, authName string
+	switch rsp.Response.StatusCode {
+	case 401:
+		challengeName, authName = "WWW-Authenticate", "Authorization"
+	case 407:
+		challengeName, authName = "Proxy-Authenticate", "Proxy-Authorization"
+	default:
+		return nil
+	}
+	switch req.Request.Method {
+	case "ACK", "CANCEL":
+		return nil
+	}
+
+	retry := req.Clone()
+	answered := false
+	for _, value := range rsp.Header.Values(challengeName) {
+		ch, err := digest.ParseChallenge(value)
+		if err != nil {
+			log.Printf("[ERR] %s: %s\n", challengeName, err)
+			continue
+		}
+		cred, ok := a.store.Lookup(a.webUser, ch.Realm)
+		if !ok {
+			continue
+		}
+		authorization, err := a.client.Authorize(ch, cred, req.Request.Method, req.Request.URIString())
+		if err != nil {
+			log.Printf("[ERR] %s: %s\n", challengeName, err)
+			continue
+		}
+		retry.Header.Add(authName, authorization)
+		answered = true
+	}
+	if !answered {
+		return nil
+	}
+
+	// the retry is a new transaction with the next CSeq
+	shiftCSeq(retry.Header, 1)
+	sipMsg, _ := newSIPMessage(retry)
+	via, err := sipMsg.header.TopVia()
+	if err != nil || !sipMsg.popVia() {
+		return nil
+	}
+	flow, _ := branchFlow(via.Branch())
+	sipMsg.pushVia(flow, via.Transport, via.SentBy())
+
+	a.mu.Lock()
+	a.offsets[retry.Header.Get("call-id")]++
+	a.mu.Unlock()
+	return sipMsg.message()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"bit4bit.in/wueco/digest"
+	"bit4bit.in/wueco/sipproto"
+)
+
+func TestAuthenticatorRetry(t *testing.T) {
+	store := digest.NewMemoryStore()
+	store.Add("alice", "atlanta.com", digest.Credentials{Username: "1001", Password: "secret"})
+	auth := newAuthenticator(store, "alice")
+
+	invite := readSIPMessage(t, `INVITE sip:bob@biloxi.com SIP/2.0
+Via: SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bKnashds7
+To: Bob <sip:bob@biloxi.com>
+From: Alice <sip:alice@atlanta.com>;tag=1928301774
+Call-ID: a84b4c76e66710
+CSeq: 1 INVITE
+Content-Length: 0
+
+`)
+	auth.toSIP(invite)
+	invite.pushVia("f00d", "TCP", "10.0.0.1:5060")
+	out := invite.message()
+
+	rsp := sipproto.NewResponse(out, 407, "Proxy Authentication Required")
+	rsp.Header.Add("Proxy-Authenticate", `Digest realm="atlanta.com", nonce="wf84f1ceczx41ae6cbe5aea9c8e88d359", qop="auth", algorithm=SHA-256`)
+	retry := auth.retry(out, rsp)
+	if retry == nil {
+		t.Fatalf("expected retry")
+	}
+	if !strings.Contains(retry.Header.Get("proxy-authorization"), `username="1001"`) {
+		t.Errorf("fails to authorize got %s", retry.Header.Get("proxy-authorization"))
+	}
+	if retry.Header.Get("cseq") != "2 INVITE" {
+		t.Errorf("expected next CSeq got %s", retry.Header.Get("cseq"))
+	}
+	outVia, _ := out.Header.TopVia()
+	retryVia, _ := retry.Header.TopVia()
+	if flow, _ := branchFlow(retryVia.Branch()); retryVia.Branch() == outVia.Branch() || flow != "f00d" {
+		t.Errorf("retry must be a new transaction of the flow got %s", retryVia.Branch())
+	}
+
+	ok := readSIPMessage(t, "SIP/2.0 200 OK\nCall-ID: a84b4c76e66710\nCSeq: 2 INVITE\nContent-Length: 0\n\n")
+	auth.toWS(ok)
+	if ok.header.Get("cseq") != "1 INVITE" {
+		t.Errorf("expected CSeq of the browser got %s", ok.header.Get("cseq"))
+	}
+	bye := readSIPMessage(t, "BYE sip:bob@biloxi.com SIP/2.0\nCall-ID: a84b4c76e66710\nCSeq: 2 BYE\nContent-Length: 0\n\n")
+	auth.toSIP(bye)
+	if bye.header.Get("cseq") != "3 BYE" {
+		t.Errorf("expected shifted CSeq got %s", bye.header.Get("cseq"))
+	}
+
+	rsp.Header.Set("Proxy-Authenticate", `Digest realm="biloxi.com", nonce="abc"`)
+	if auth.retry(out, rsp) != nil {
+		t.Errorf("must not answer a realm without credentials")
+	}
+}
+
+func TestAuthenticatorDigestURIAsSent(t *testing.T) {
+	store := digest.NewMemoryStore()
+	store.Add("alice", "*", digest.Credentials{Username: "1001", Password: "secret"})
+	auth := newAuthenticator(store, "alice")
+
+	register := readSIPMessage(t, `REGISTER SIP:Biloxi.com;transport=tcp;lr= SIP/2.0
+Via: SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bKnashds7
+To: Bob <sip:bob@biloxi.com>
+From: Bob <sip:bob@biloxi.com>;tag=456248
+Call-ID: 843817637684230@998sdasdh09
+CSeq: 1 REGISTER
+Content-Length: 0
+
+`)
+	register.pushVia("f00d", "TCP", "10.0.0.1:5060")
+	out := register.message()
+	rsp := sipproto.NewResponse(out, 401, "Unauthorized")
+	rsp.Header.Add("WWW-Authenticate", `Digest realm="biloxi.com", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093"`)
+	retry := auth.retry(out, rsp)
+	if retry == nil {
+		t.Fatalf("expected retry")
+	}
+	if !strings.HasPrefix(retry.StatusLine, "REGISTER SIP:Biloxi.com;transport=tcp;lr= ") {
+		t.Fatalf("the retry must keep the Request-URI got %s", retry.StatusLine)
+	}
+	if !strings.Contains(retry.Header.Get("authorization"), `uri="SIP:Biloxi.com;transport=tcp;lr="`) {
+		t.Errorf("the digest must name the Request-URI sent got %s", retry.Header.Get("authorization"))
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"bit4bit.in/wueco/rtpproxy"
+	"github.com/pion/webrtc/v3"
+)
+
+// dialogID identifies a dialog RFC 3261 section 12, the local tag is the
+// tag of the browser and the remote tag the tag of the SIP side.
+type dialogID struct {
+	CallID    string
+	LocalTag  string
+	RemoteTag string
+}
+
+func (d dialogID) String() string {
+	return fmt.Sprintf("%s;local=%s;remote=%s", d.CallID, d.LocalTag, d.RemoteTag)
+}
+
+// early returns the id used before the tag of the answering side is known.
+func (d dialogID) early(browserAnswers bool) dialogID {
+	if browserAnswers {
+		return dialogID{CallID: d.CallID, RemoteTag: d.RemoteTag}
+	}
+	return dialogID{CallID: d.CallID, LocalTag: d.LocalTag}
+}
+
+// call is the media of a dialog, every call has its own
+// PeerConnection with the browser and RTPProxy with the SIP side.
+type call struct {
+	id dialogID
+	// browserAnswers is true for calls from SIP to the browser
+	browserAnswers bool
+
+	peerConn *webrtc.PeerConnection
+	// track for the browser with the codec of the call
+	audioTrack *payloadTrack
+	sender     *webrtc.RTPSender
+	rtpengine  *rtpproxy.RTPProxy
+	// local description of the PeerConnection sent to the browser
+	offer  *webrtc.SessionDescription
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// done of the last function queued by serialize
+	last chan struct{}
+	// the 2xx of the SIP side can't be answered to the browser
+	refused bool
+	// CSeq of the request with the last offer of the browser
+	offerSeq uint32
+	// the SIP side sent an INVITE without offer, it answers the offer of
+	// wueco in the ACK or in the PRACK of the reliable 18x with offerRSeq
+	sipAnswerPending bool
+	offerRSeq        uint32
+	// the requests of wueco in the dialog shift the CSeq of the
+	// requests of the browser, lastSeq is the last CSeq sent
+	seqShift uint32
+	lastSeq  uint32
+	// builds the requests of wueco to the SIP side in the dialog
+	sipRequest func(method string, seq uint32) (*sipMessage, error)
+}
+
+// newCall starts the media of a call, onFailed is called when the
+// connectivity with the browser fails.
+func newCall(id dialogID, browserAnswers bool, onFailed func(c *call)) (*call, error) {
+	rtpengine, err := rtpproxy.NewRTPProxy(*host, rtpproxy.WithCodecs(sipRelayCodecs()))
+	if err != nil {
+		return nil, fmt.Errorf("newRTPEngine: %w", err)
+	}
+	log.Printf("RTPENGINE LISTENING AT %s FOR %s\n", rtpengine.Addr(), id)
+
+	config := webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		},
+	}
+	peerConn, err := webrtcAPI.NewPeerConnection(config)
+	if err != nil {
+		rtpengine.Close()
+		return nil, err
+	}
+
+	c := &call{
+		id:             id,
+		browserAnswers: browserAnswers,
+		peerConn:       peerConn,
+		rtpengine:      rtpengine,
+		offer:          &webrtc.SessionDescription{},
+	}
+
+	peerConn.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
+		switch p {
+		case webrtc.PeerConnectionStateFailed:
+			log.Printf("call %s: connection with the browser failed\n", id)
+			onFailed(c)
+		case webrtc.PeerConnectionStateClosed:
+			log.Println("PeerConnectionStateClosed")
+		}
+	})
+
+	// replaced by the codec of the offer/answer
+	c.audioTrack, err = newPayloadTrack(webrtcCodecs[0].RTPCodecCapability)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	if c.sender, err = proxyRTCP(ctx, rtpengine, peerConn, c.audioTrack); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	peerConn.OnTrack(func(track *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
+		log.Println("OnTrack")
+
+		go rtpengine.WriteRTCP(ctx, r)
+		go rtpengine.Read(ctx, c)
+		rtpengine.Write(ctx, track)
+	})
+
+	// the track of wueco is sent by the transceiver of AddTrack, a
+	// transceiver that sends would need a track with the codec of the call
+	recvonly := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}
+	if _, err = peerConn.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, recvonly); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// serialize runs fn after the functions queued before without blocking
+// the caller, the responses of the call keep their order while the
+// answer for the browser waits the ICE candidates.
+func (c *call) serialize(fn func()) {
+	c.mu.Lock()
+	prev, done := c.last, make(chan struct{})
+	c.last = done
+	c.mu.Unlock()
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		fn()
+	}()
+}
+
+// refuse marks the call as refused and returns true the first time.
+func (c *call) refuse() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	first := !c.refused
+	c.refused = true
+	return first
+}
+
+func (c *call) isRefused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refused
+}
+
+// offered records the request with an offer of the browser, its
+// responses from the SIP side carry the answer.
+func (c *call) offered(seq uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offerSeq = seq
+}
+
+// answers is true for the responses to the last offer of the browser.
+func (c *call) answers(seq uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offerSeq != 0 && c.offerSeq == seq
+}
+
+// awaitSIPAnswer records an INVITE without offer of the SIP side.
+func (c *call) awaitSIPAnswer() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sipAnswerPending = true
+	c.offerRSeq = 0
+}
+
+// waitsSIPAnswer is true while the SIP side owes the answer to the offer of wueco.
+func (c *call) waitsSIPAnswer() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sipAnswerPending
+}
+
+// reliableOffer records the RSeq of the reliable provisional response
+// with the offer of wueco RFC 3262 section 5.
+func (c *call) reliableOffer(rseq uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sipAnswerPending && c.offerRSeq == 0 {
+		c.offerRSeq = rseq
+	}
+}
+
+// answeredBySIP completes the offer of wueco with the answer of the SIP
+// side, rseq is the RAck of a PRACK or 0 for the ACK. It's false when
+// the PRACK doesn't acknowledge the response with the offer.
+func (c *call) answeredBySIP(rseq uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rseq != 0 && (!c.sipAnswerPending || rseq != c.offerRSeq) {
+		return false
+	}
+	c.sipAnswerPending = false
+	c.offerRSeq = 0
+	return true
+}
+
+// toSIPSeq shifts the CSeq of a request of the browser for the SIP side.
+func (c *call) toSIPSeq(sipMsg *sipMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	shiftCSeq(sipMsg.header, int64(c.seqShift))
+	if seq := cseqOf(sipMsg); seq > c.lastSeq {
+		c.lastSeq = seq
+	}
+}
+
+// toWSSeq restores the CSeq of a response of the SIP side for the browser.
+func (c *call) toWSSeq(sipMsg *sipMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	shiftCSeq(sipMsg.header, -int64(c.seqShift))
+}
+
+// setSIPDialog sets the builder of the requests of wueco in the dialog,
+// the route set is fixed by the first 2xx RFC 3261 section 12.2.1.2.
+func (c *call) setSIPDialog(request func(method string, seq uint32) (*sipMessage, error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sipRequest == nil {
+		c.sipRequest = request
+	}
+}
+
+// newSIPRequest returns a request of wueco to the SIP side in the
+// dialog with the next CSeq RFC 3261 section 12.2.1.1.
+func (c *call) newSIPRequest(method string) (*sipMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sipRequest == nil {
+		return nil, errNoDialog
+	}
+	req, err := c.sipRequest(method, c.lastSeq+1)
+	if err != nil {
+		return nil, err
+	}
+	c.lastSeq++
+	c.seqShift++
+	return req, nil
+}
+
+// close stops the media of the call, closing the PeerConnection and
+// the sockets ends every goroutine that relays the call.
+func (c *call) close() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if err := c.peerConn.Close(); err != nil {
+		log.Printf("[ERR] call %s close: %s\n", c.id, err)
+	}
+	if toSIP, toBrowser := c.rtpengine.Dropped(); toSIP+toBrowser > 0 {
+		log.Printf("call %s: dropped RTP with unknown payload type %d to SIP %d to the browser\n", c.id, toSIP, toBrowser)
+	}
+	c.rtpengine.Close()
+}
+
+// dialogs is the table of calls of a websocket, an early call is also
+// kept by its early id until the dialog is confirmed so every fork
+// of the INVITE finds it.
+type dialogs struct {
+	mu    sync.Mutex
+	calls map[dialogID]*call
+}
+
+func newDialogs() *dialogs {
+	return &dialogs{calls: make(map[dialogID]*call)}
+}
+
+func (d *dialogs) add(c *call) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls[c.id] = c
+}
+
+// get finds the call of id, while the dialog is early the call is
+// found by the early id.
+func (d *dialogs) get(id dialogID) (*call, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if c, ok := d.calls[id]; ok {
+		return c, true
+	}
+	for _, browserAnswers := range []bool{false, true} {
+		if c, ok := d.calls[id.early(browserAnswers)]; ok && c.browserAnswers == browserAnswers {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// confirm adds the full id of a fork of the call, when the
+// dialog is established the early id is removed.
+func (d *dialogs) confirm(c *call, id dialogID, established bool) {
+	if id.LocalTag == "" || id.RemoteTag == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls[id] = c
+	if established {
+		delete(d.calls, c.id.early(c.browserAnswers))
+		c.id = id
+	}
+}
+
+// established is true when both tags of the dialog are known.
+func (d *dialogs) established(c *call) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return c.id.LocalTag != "" && c.id.RemoteTag != ""
+}
+
+// remove deletes every id of the call and returns true
+// when the call was in the table.
+func (d *dialogs) remove(c *call) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	found := false
+	for id, existing := range d.calls {
+		if existing == c {
+			delete(d.calls, id)
+			found = true
+		}
+	}
+	return found
+}
+
+// closeAll tears down every call.
+func (d *dialogs) closeAll() {
+	d.mu.Lock()
+	closed := make(map[*call]bool)
+	for id, c := range d.calls {
+		delete(d.calls, id)
+		closed[c] = true
+	}
+	d.mu.Unlock()
+	for c := range closed {
+		c.close()
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestDialogID(t *testing.T) {
+	invite := readSIPMessage(t, `INVITE sip:bob@biloxi.com SIP/2.0
+Via: SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bKnashds7
+To: Bob <sip:bob@biloxi.com>
+From: Alice <sip:alice@atlanta.com>;tag=1928301774
+Call-ID: a84b4c76e66710
+CSeq: 1 INVITE
+Content-Length: 0
+
+`)
+	ringing := readSIPMessage(t, `SIP/2.0 180 Ringing
+Via: SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bKnashds7
+To: Bob <sip:bob@biloxi.com>;tag=a6c85cf
+From: Alice <sip:alice@atlanta.com>;tag=1928301774
+Call-ID: a84b4c76e66710
+CSeq: 1 INVITE
+Content-Length: 0
+
+`)
+	bye := readSIPMessage(t, `BYE sip:alice@df7jal23ls0d.invalid;transport=ws SIP/2.0
+Via: SIP/2.0/TCP pbx.biloxi.com;branch=z9hG4bK77
+To: Alice <sip:alice@atlanta.com>;tag=1928301774
+From: Bob <sip:bob@biloxi.com>;tag=a6c85cf
+Call-ID: a84b4c76e66710
+CSeq: 2 BYE
+Content-Length: 0
+
+`)
+	early := dialogID{CallID: "a84b4c76e66710", LocalTag: "1928301774"}
+	confirmed := dialogID{CallID: "a84b4c76e66710", LocalTag: "1928301774", RemoteTag: "a6c85cf"}
+	if id := invite.dialogID(true); id != early {
+		t.Errorf("expected %s got %s", early, id)
+	}
+	if id := ringing.dialogID(false); id != confirmed {
+		t.Errorf("expected %s got %s", confirmed, id)
+	}
+	if id := bye.dialogID(false); id != confirmed {
+		t.Errorf("expected %s got %s", confirmed, id)
+	}
+}
+
+func TestSIPRequestShiftsCSeq(t *testing.T) {
+	c := &call{}
+	if _, err := c.newSIPRequest("INFO"); !errors.Is(err, errNoDialog) {
+		t.Errorf("expected errNoDialog got %v", err)
+	}
+	ok := readSIPMessage(t, `SIP/2.0 200 OK
+Via: SIP/2.0/TCP 10.0.0.1:5060;branch=z9hG4bKwueco1
+Record-Route: <sip:p2.biloxi.com;lr>, <sip:wueco-abc@10.0.0.1:5060;transport=tcp;lr>
+To: <sip:bob@biloxi.com>;tag=pbx
+From: <sip:alice@atlanta.com>;tag=ws
+Call-ID: d7mf
+CSeq: 2 INVITE
+Contact: <sip:bob@192.0.2.4:5060>
+Content-Length: 0
+
+`)
+	c.setSIPDialog(ok.dialogRequest)
+	invite := readSIPMessage(t, `INVITE sip:bob@biloxi.com SIP/2.0
+To: <sip:bob@biloxi.com>
+From: <sip:alice@atlanta.com>;tag=ws
+Call-ID: d7mf
+CSeq: 2 INVITE
+Content-Length: 0
+
+`)
+	c.toSIPSeq(invite)
+
+	info, err := c.newSIPRequest("INFO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.startLine() != "INFO sip:bob@192.0.2.4:5060 SIP/2.0" || info.header.Get("cseq") != "3 INFO" || info.header.Get("route") != "<sip:p2.biloxi.com;lr>" {
+		t.Errorf("unexpected INFO %s", info.marshal())
+	}
+
+	// the next request of the browser follows the INFO
+	bye := readSIPMessage(t, `BYE sip:bob@192.0.2.4:5060 SIP/2.0
+To: <sip:bob@biloxi.com>;tag=pbx
+From: <sip:alice@atlanta.com>;tag=ws
+Call-ID: d7mf
+CSeq: 3 BYE
+Content-Length: 0
+
+`)
+	c.toSIPSeq(bye)
+	if bye.header.Get("cseq") != "4 BYE" {
+		t.Errorf("expected the BYE shifted got %s", bye.header.Get("cseq"))
+	}
+	byeOK := readSIPMessage(t, `SIP/2.0 200 OK
+To: <sip:bob@biloxi.com>;tag=pbx
+From: <sip:alice@atlanta.com>;tag=ws
+Call-ID: d7mf
+CSeq: 4 BYE
+Content-Length: 0
+
+`)
+	c.toWSSeq(byeOK)
+	if byeOK.header.Get("cseq") != "3 BYE" {
+		t.Errorf("expected the CSeq of the browser got %s", byeOK.header.Get("cseq"))
+	}
+}
+
+func TestCalleeRequest(t *testing.T) {
+	invite := readSIPMessage(t, `INVITE sip:alice@df7jal23ls0d.invalid;transport=ws SIP/2.0
+Record-Route: <sip:p1.biloxi.com;lr>, <sip:p2.biloxi.com;lr>
+To: <sip:alice@atlanta.com>
+From: <sip:bob@biloxi.com>;tag=pbx
+Call-ID: c4ll
+CSeq: 7 INVITE
+Contact: <sip:bob@192.0.2.4:5060>
+Content-Length: 0
+
+`)
+	info, err := invite.calleeRequest("INFO", 1, "<sip:alice@atlanta.com>;tag=ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"from": "<sip:alice@atlanta.com>;tag=ws",
+		"to":   "<sip:bob@biloxi.com>;tag=pbx",
+		"cseq": "1 INFO",
+	} {
+		if got := info.header.Get(name); got != expected {
+			t.Errorf("expected %s %q got %q", name, expected, got)
+		}
+	}
+	if info.startLine() != "INFO sip:bob@192.0.2.4:5060 SIP/2.0" {
+		t.Errorf("unexpected request line %s", info.startLine())
+	}
+	// the route set of the callee keeps the order of the Record-Route
+	if routes, err := info.header.Addresses("route"); err != nil || len(routes) != 2 || routes[0].URI.Host != "p1.biloxi.com" {
+		t.Errorf("unexpected routes %v %v", routes, err)
+	}
+}
+
+func TestDialogsForks(t *testing.T) {
+	d := newDialogs()
+	c := &call{id: dialogID{CallID: "a84b", LocalTag: "1"}}
+	d.add(c)
+
+	fork1 := dialogID{CallID: "a84b", LocalTag: "1", RemoteTag: "x"}
+	fork2 := dialogID{CallID: "a84b", LocalTag: "1", RemoteTag: "y"}
+	if found, ok := d.get(fork1); !ok || found != c {
+		t.Fatalf("early call must be found by the forks")
+	}
+	d.confirm(c, fork1, false)
+	if d.established(c) {
+		t.Errorf("provisional response must not establish the call")
+	}
+	d.confirm(c, fork2, true)
+	if !d.established(c) || c.id != fork2 {
+		t.Errorf("expected established call %s got %s", fork2, c.id)
+	}
+	if _, ok := d.get(dialogID{CallID: "a84b", LocalTag: "1", RemoteTag: "z"}); ok {
+		t.Errorf("confirmed call must not be found by a new fork")
+	}
+	if !d.remove(c) || d.remove(c) {
+		t.Errorf("remove must report the call once")
+	}
+	if _, ok := d.get(fork2); ok {
+		t.Errorf("removed call must not be found")
+	}
+
+	// calls from SIP are early by the tag of the SIP side
+	incoming := &call{id: dialogID{CallID: "b95c", RemoteTag: "9"}, browserAnswers: true}
+	d.add(incoming)
+	if found, ok := d.get(dialogID{CallID: "b95c", LocalTag: "2", RemoteTag: "9"}); !ok || found != incoming {
+		t.Errorf("fails to find the incoming call")
+	}
+}
+
+func TestHangupOnBye(t *testing.T) {
+	s := &session{dialogs: newDialogs()}
+	id := dialogID{CallID: "c06d", LocalTag: "1", RemoteTag: "2"}
+	c, err := newCall(id, false, s.hangup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.dialogs.add(c)
+
+	bye := readSIPMessage(t, `BYE sip:alice@10.0.0.1:5060;transport=tcp SIP/2.0
+Via: SIP/2.0/TCP pbx.biloxi.com;branch=z9hG4bK77
+To: Alice <sip:alice@atlanta.com>;tag=1
+From: Bob <sip:bob@biloxi.com>;tag=2
+Call-ID: c06d
+CSeq: 2 BYE
+Content-Length: 0
+
+`)
+	if found, ok := s.dialogs.get(bye.dialogID(false)); !ok || found != c {
+		t.Fatalf("BYE must find the call")
+	}
+	s.trackRequest(c, bye)
+	if _, ok := s.dialogs.get(id); ok {
+		t.Errorf("expected call removed")
+	}
+	if state := c.peerConn.ConnectionState(); state != webrtc.PeerConnectionStateClosed {
+		t.Errorf("expected PeerConnection closed got %s", state)
+	}
+	// the RTP and RTCP ports are released
+	for _, port := range []int{c.rtpengine.Port(), c.rtpengine.Port() + 1} {
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(*host, strconv.Itoa(port)))
+		if err != nil {
+			t.Errorf("expected port %d released: %s", port, err)
+			continue
+		}
+		conn.Close()
+	}
+}
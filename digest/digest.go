@@ -0,0 +1,187 @@
+// Package digest answers the digest challenges of a SIP server
+// RFC 3261 section 22.4, RFC 2617 and RFC 7616 (SHA-256).
+package digest
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInvalidChallenge     = errors.New("digest: invalid challenge")
+	ErrUnsupportedAlgorithm = errors.New("digest: unsupported algorithm")
+	ErrUnsupportedQOP       = errors.New("digest: unsupported qop")
+)
+
+// Challenge is a WWW-Authenticate or Proxy-Authenticate header.
+type Challenge struct {
+	Realm     string
+	Nonce     string
+	Opaque    string
+	Algorithm string
+	QOP       []string
+	Stale     bool
+}
+
+// ParseChallenge parses the value of a WWW-Authenticate or
+// Proxy-Authenticate header with the Digest scheme.
+func ParseChallenge(value string) (*Challenge, error) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(value), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, fmt.Errorf("%w: scheme %q", ErrInvalidChallenge, scheme)
+	}
+	ch := &Challenge{}
+	for _, param := range splitParams(rest) {
+		name, value, _ := strings.Cut(param, "=")
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "realm":
+			ch.Realm = value
+		case "nonce":
+			ch.Nonce = value
+		case "opaque":
+			ch.Opaque = value
+		case "algorithm":
+			ch.Algorithm = value
+		case "qop":
+			for _, qop := range strings.Split(value, ",") {
+				ch.QOP = append(ch.QOP, strings.TrimSpace(qop))
+			}
+		case "stale":
+			ch.Stale = strings.EqualFold(value, "true")
+		}
+	}
+	if ch.Nonce == "" {
+		return nil, fmt.Errorf("%w: missing nonce", ErrInvalidChallenge)
+	}
+	return ch, nil
+}
+
+// splitParams splits the parameters by commas outside of quotes.
+func splitParams(s string) []string {
+	var params []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				params = append(params, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if strings.TrimSpace(s[start:]) != "" {
+		params = append(params, s[start:])
+	}
+	return params
+}
+
+// Credentials are the SIP username and password of a realm.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+func newHash(algorithm string) (func() hash.Hash, bool, error) {
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5":
+		return md5.New, false, nil
+	case "MD5-SESS":
+		return md5.New, true, nil
+	case "SHA-256":
+		return sha256.New, false, nil
+	case "SHA-256-SESS":
+		return sha256.New, true, nil
+	}
+	return nil, false, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, algorithm)
+}
+
+// Authorize computes the value of the Authorization or
+// Proxy-Authorization header, cnonce and nc are only used with qop.
+func Authorize(ch *Challenge, cred Credentials, method, uri, cnonce string, nc uint32) (string, error) {
+	newH, sess, err := newHash(ch.Algorithm)
+	if err != nil {
+		return "", err
+	}
+	h := func(parts ...string) string {
+		hash := newH()
+		hash.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+
+	qop := ""
+	if len(ch.QOP) > 0 {
+		for _, offered := range ch.QOP {
+			if strings.EqualFold(offered, "auth") {
+				qop = "auth"
+			}
+		}
+		// auth-int needs the body of the request
+		if qop == "" {
+			return "", fmt.Errorf("%w: %s", ErrUnsupportedQOP, strings.Join(ch.QOP, ","))
+		}
+	}
+
+	ha1 := h(cred.Username, ch.Realm, cred.Password)
+	if sess {
+		ha1 = h(ha1, ch.Nonce, cnonce)
+	}
+	ha2 := h(method, uri)
+	count := fmt.Sprintf("%08x", nc)
+	var response string
+	if qop == "" {
+		response = h(ha1, ch.Nonce, ha2)
+	} else {
+		response = h(ha1, ch.Nonce, count, cnonce, qop, ha2)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`, cred.Username, ch.Realm, ch.Nonce, uri, response)
+	if ch.Algorithm != "" {
+		fmt.Fprintf(&b, ", algorithm=%s", ch.Algorithm)
+	}
+	if ch.Opaque != "" {
+		fmt.Fprintf(&b, `, opaque="%s"`, ch.Opaque)
+	}
+	if qop != "" {
+		fmt.Fprintf(&b, `, qop=%s, nc=%s, cnonce="%s"`, qop, count, cnonce)
+	}
+	return b.String(), nil
+}
+
+// Client answers challenges counting the uses of every nonce.
+type Client struct {
+	mu     sync.Mutex
+	counts map[string]uint32
+}
+
+func NewClient() *Client {
+	return &Client{counts: make(map[string]uint32)}
+}
+
+// Authorize answers ch with a new cnonce and the next nonce count.
+func (c *Client) Authorize(ch *Challenge, cred Credentials, method, uri string) (string, error) {
+	c.mu.Lock()
+	c.counts[ch.Nonce]++
+	nc := c.counts[ch.Nonce]
+	c.mu.Unlock()
+	return Authorize(ch, cred, method, uri, newCnonce(), nc)
+}
+
+func newCnonce() string {
+	cnonce := make([]byte, 8)
+	if _, err := rand.Read(cnonce); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(cnonce)
+}
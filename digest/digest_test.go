@@ -0,0 +1,122 @@
+package digest
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseChallenge(t *testing.T) {
+	ch, err := ParseChallenge(`Digest realm="atlanta.com", domain="sip:ss1.carrier.com", qop="auth,auth-int", nonce="f84f1cec41e6cbe5aea9c8e88d359", opaque="", stale=FALSE, algorithm=MD5`)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if ch.Realm != "atlanta.com" || ch.Nonce != "f84f1cec41e6cbe5aea9c8e88d359" || ch.Algorithm != "MD5" || ch.Stale {
+		t.Errorf("fails to parse challenge got %+v", ch)
+	}
+	if len(ch.QOP) != 2 || ch.QOP[0] != "auth" || ch.QOP[1] != "auth-int" {
+		t.Errorf("fails to parse qop got %v", ch.QOP)
+	}
+
+	if _, err := ParseChallenge(`Basic realm="atlanta.com"`); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("expected ErrInvalidChallenge got %v", err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	cases := []struct {
+		name      string
+		challenge Challenge
+		password  string
+		cnonce    string
+		response  string
+	}{
+		{
+			// RFC 2617 section 3.5
+			name:      "MD5",
+			challenge: Challenge{Realm: "testrealm@host.com", Nonce: "dcd98b7102dd2f0e8b11d0f600bfb0c093", Opaque: "5ccc069c403ebaf9f0171e9517f40e41", QOP: []string{"auth", "auth-int"}},
+			password:  "Circle Of Life",
+			cnonce:    "0a4f113b",
+			response:  "6629fae49393a05397450978507c4ef1",
+		},
+		{
+			// RFC 7616 section 3.9.1
+			name:      "SHA-256",
+			challenge: Challenge{Realm: "http-auth@example.org", Nonce: "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", Algorithm: "SHA-256", QOP: []string{"auth", "auth-int"}},
+			password:  "Circle of Life",
+			cnonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+			response:  "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+		},
+		{
+			name:      "MD5 RFC 7616",
+			challenge: Challenge{Realm: "http-auth@example.org", Nonce: "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", Algorithm: "MD5", QOP: []string{"auth"}},
+			password:  "Circle of Life",
+			cnonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+			response:  "8ca523f5e9506fed4657c9700eebdbec",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			value, err := Authorize(&c.challenge, Credentials{Username: "Mufasa", Password: c.password}, "GET", "/dir/index.html", c.cnonce, 1)
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+			if !strings.Contains(value, `response="`+c.response+`"`) || !strings.Contains(value, "qop=auth, nc=00000001") {
+				t.Errorf("unexpected authorization %s", value)
+			}
+		})
+	}
+}
+
+func TestAuthorizeWithoutQOP(t *testing.T) {
+	ch := &Challenge{Realm: "atlanta.com", Nonce: "ea9c8e88df84f1cec4341ae6cbe5a359"}
+	value, err := Authorize(ch, Credentials{Username: "bob", Password: "zanzibar"}, "INVITE", "sip:bob@biloxi.com", "", 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if strings.Contains(value, "qop") || strings.Contains(value, "cnonce") {
+		t.Errorf("RFC 2069 authorization must not have qop got %s", value)
+	}
+
+	ch.QOP = []string{"auth-int"}
+	if _, err := Authorize(ch, Credentials{}, "INVITE", "sip:bob@biloxi.com", "", 0); !errors.Is(err, ErrUnsupportedQOP) {
+		t.Errorf("expected ErrUnsupportedQOP got %v", err)
+	}
+	ch.Algorithm = "SHA-512-256"
+	if _, err := Authorize(ch, Credentials{}, "INVITE", "sip:bob@biloxi.com", "", 0); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("expected ErrUnsupportedAlgorithm got %v", err)
+	}
+}
+
+func TestClientCountsNonces(t *testing.T) {
+	client := NewClient()
+	ch := &Challenge{Realm: "atlanta.com", Nonce: "abc", QOP: []string{"auth"}}
+	first, _ := client.Authorize(ch, Credentials{Username: "bob"}, "REGISTER", "sip:atlanta.com")
+	second, _ := client.Authorize(ch, Credentials{Username: "bob"}, "REGISTER", "sip:atlanta.com")
+	if !strings.Contains(first, "nc=00000001") || !strings.Contains(second, "nc=00000002") {
+		t.Errorf("expected nonce count 1 and 2 got %s %s", first, second)
+	}
+}
+
+func TestReadStore(t *testing.T) {
+	store, err := ReadStore(strings.NewReader(`
+# webuser realm sipuser password
+alice atlanta.com 1001 secret
+alice * 1001 other
+`))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if cred, ok := store.Lookup("alice", "atlanta.com"); !ok || cred.Password != "secret" {
+		t.Errorf("fails to lookup realm got %+v", cred)
+	}
+	if cred, ok := store.Lookup("alice", "biloxi.com"); !ok || cred.Password != "other" {
+		t.Errorf("fails to lookup any realm got %+v", cred)
+	}
+	if _, ok := store.Lookup("bob", "atlanta.com"); ok {
+		t.Errorf("unexpected credentials")
+	}
+	if _, err := ReadStore(strings.NewReader("alice atlanta.com")); err == nil {
+		t.Errorf("expected error on invalid line")
+	}
+}
@@ -0,0 +1,85 @@
+package digest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Store finds the SIP credentials of an authenticated web user for a realm.
+type Store interface {
+	Lookup(webUser, realm string) (Credentials, bool)
+}
+
+// StoreFunc adapts a function to Store.
+type StoreFunc func(webUser, realm string) (Credentials, bool)
+
+func (f StoreFunc) Lookup(webUser, realm string) (Credentials, bool) {
+	return f(webUser, realm)
+}
+
+type storeKey struct {
+	webUser string
+	realm   string
+}
+
+// MemoryStore keeps the credentials in memory, the realm "*"
+// matches any realm.
+type MemoryStore struct {
+	credentials map[storeKey]Credentials
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{credentials: make(map[storeKey]Credentials)}
+}
+
+func (s *MemoryStore) Add(webUser, realm string, cred Credentials) {
+	s.credentials[storeKey{webUser, realm}] = cred
+}
+
+func (s *MemoryStore) Lookup(webUser, realm string) (Credentials, bool) {
+	if cred, ok := s.credentials[storeKey{webUser, realm}]; ok {
+		return cred, true
+	}
+	cred, ok := s.credentials[storeKey{webUser, "*"}]
+	return cred, ok
+}
+
+// ReadStore reads the credentials with a line per web user:
+//
+//	webuser realm sipuser password
+//
+// the empty lines and the lines starting with # are ignored.
+func ReadStore(r io.Reader) (*MemoryStore, error) {
+	store := NewMemoryStore()
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("digest: line %d: expected webuser realm sipuser password", line)
+		}
+		store.Add(fields[0], fields[1], Credentials{Username: fields[2], Password: fields[3]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// LoadStore reads the credentials file at path.
+func LoadStore(path string) (*MemoryStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("digest: %w", err)
+	}
+	defer f.Close()
+	return ReadStore(f)
+}
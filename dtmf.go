@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"bit4bit.in/wueco/sipproto"
+	"bit4bit.in/wueco/transaction"
+)
+
+// the signals of application/dtmf-relay in the order of
+// the events of RFC 4733 section 3.2
+const dtmfSignals = "0123456789*#ABCD"
+
+const dtmfRelayType = "application/dtmf-relay"
+
+// duration of an INFO without Duration
+const dtmfDefaultDuration = 250 * time.Millisecond
+
+var (
+	errNoDialog  = errors.New("dialog of the SIP side not established")
+	errDTMFRelay = errors.New("application/dtmf-relay without signal")
+)
+
+// parseDTMFRelay returns the event and the duration of a body of
+// application/dtmf-relay as Signal=5 and Duration=160 in ms.
+func parseDTMFRelay(body string) (uint8, time.Duration, error) {
+	code, duration, found := uint8(0), dtmfDefaultDuration, false
+	for _, line := range strings.Split(body, "\n") {
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "signal":
+			if i := strings.Index(dtmfSignals, strings.ToUpper(value)); len(value) == 1 && i >= 0 {
+				code, found = uint8(i), true
+			} else if n, err := strconv.ParseUint(value, 10, 8); err == nil && n < uint64(len(dtmfSignals)) {
+				code, found = uint8(n), true
+			} else {
+				return 0, 0, fmt.Errorf("%w: %q", errDTMFRelay, value)
+			}
+		case "duration":
+			if ms, err := strconv.Atoi(value); err == nil && ms > 0 {
+				duration = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	if !found {
+		return 0, 0, errDTMFRelay
+	}
+	return code, duration, nil
+}
+
+// dtmfRelay returns the body of application/dtmf-relay for the event
+// code, false for the events without signal as the flash.
+func dtmfRelay(code uint8, duration time.Duration) (string, bool) {
+	if int(code) >= len(dtmfSignals) {
+		return "", false
+	}
+	return fmt.Sprintf("Signal=%c\r\nDuration=%d\r\n", dtmfSignals[code], duration.Milliseconds()), true
+}
+
+// sendDTMF sends a telephone-event of the browser to the SIP side as
+// INFO in the dialog of the call.
+func (s *session) sendDTMF(c *call, code uint8, duration time.Duration) {
+	body, ok := dtmfRelay(code, duration)
+	if !ok {
+		return
+	}
+	sipConn, err := s.upstream.conn(s.flow)
+	if err != nil {
+		log.Printf("[ERR] call %s DTMF: %s\n", c.id, err)
+		return
+	}
+	info, err := c.newSIPRequest("INFO")
+	if err != nil {
+		log.Printf("[ERR] call %s DTMF: %s\n", c.id, err)
+		return
+	}
+	info.header.Set("Content-Type", dtmfRelayType)
+	info.content = body
+	info.form = headerForm(*sipHeaderForm)
+	info.pushVia(s.flow, sipConn.Transport(), sipConn.LocalAddr().String())
+	err = s.requestSIP(info.message(), sipConn.Reliable(), false, transaction.ClientHandler{
+		Response: func(rsp *sipproto.Message) {
+			if rsp.Response.StatusCode >= 300 {
+				log.Printf("[ERR] call %s DTMF: %s\n", c.id, rsp.StatusLine)
+			}
+		},
+		Timeout: func() {
+			log.Printf("[ERR] call %s DTMF: INFO without response\n", c.id)
+		},
+	})
+	if err != nil {
+		log.Printf("[ERR] call %s DTMF: %s\n", c.id, err)
+	}
+}
+
+// receiveDTMF answers an INFO with DTMF of the SIP side and sends the
+// event to the browser, it's false when msg is not DTMF of a call.
+func (s *session) receiveDTMF(msg *sipproto.Message, srv *transaction.Server) bool {
+	sipMsg, _ := newSIPMessage(msg)
+	contentType, _, _ := strings.Cut(sipMsg.header.Get("content-type"), ";")
+	if !sipMsg.IsMethod("INFO") || !strings.EqualFold(strings.TrimSpace(contentType), dtmfRelayType) {
+		return false
+	}
+	c, ok := s.dialogs.get(sipMsg.dialogID(false))
+	if !ok {
+		return false
+	}
+	code, duration, err := parseDTMFRelay(sipMsg.content)
+	if err != nil {
+		log.Printf("[ERR] call %s DTMF: %s\n", c.id, err)
+		replyTo(srv, 400, "Bad Request")
+		return true
+	}
+	replyTo(srv, 200, "OK")
+	go func() {
+		if err := c.rtpengine.SendEvent(code, duration); err != nil {
+			log.Printf("[ERR] call %s DTMF: %s\n", c.id, err)
+		}
+	}()
+	return true
+}
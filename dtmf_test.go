@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseDTMFRelay(t *testing.T) {
+	for body, expected := range map[string]struct {
+		code     uint8
+		duration time.Duration
+	}{
+		"Signal=5\r\nDuration=160\r\n": {5, 160 * time.Millisecond},
+		"signal= #\r\n":                {11, dtmfDefaultDuration},
+		"Signal=10\nDuration=100":      {10, 100 * time.Millisecond},
+		"Signal=d\r\nDuration=0\r\n":   {15, dtmfDefaultDuration},
+	} {
+		code, duration, err := parseDTMFRelay(body)
+		if err != nil || code != expected.code || duration != expected.duration {
+			t.Errorf("%q: expected %d %s got %d %s %v", body, expected.code, expected.duration, code, duration, err)
+		}
+	}
+	for _, body := range []string{"Duration=160\r\n", "Signal=X\r\n", "Signal=16\r\n"} {
+		if _, _, err := parseDTMFRelay(body); !errors.Is(err, errDTMFRelay) {
+			t.Errorf("%q: expected errDTMFRelay got %v", body, err)
+		}
+	}
+	if body, ok := dtmfRelay(11, 160*time.Millisecond); !ok || body != "Signal=#\r\nDuration=160\r\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+	if _, ok := dtmfRelay(16, time.Second); ok {
+		t.Errorf("expected no signal for the flash")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"bit4bit.in/wueco/sipproto"
+	"bit4bit.in/wueco/transaction"
+	"bit4bit.in/wueco/transport"
+)
+
+// fork proxies an initial request of the SIP server to every tab of
+// the user RFC 3261 section 16.7, the first 2xx wins and the other
+// branches of an INVITE are canceled.
+type fork struct {
+	srv *transaction.Server
+	// connection of the request for the 2xx after the first one
+	sipConn transport.Conn
+	// called when every branch has a final response
+	done func()
+
+	mu       sync.Mutex
+	branches []*forkBranch
+	pending  int
+	answered bool
+	canceled bool
+	// best final response of the failed branches
+	best *sipproto.Message
+}
+
+type forkBranch struct {
+	session *session
+	// request sent to the browser
+	request *sipproto.Message
+	final   bool
+}
+
+// forkRequest starts a fork of the request msg arrived by sipConn to targets.
+func (u *upstream) forkRequest(sipConn transport.Conn, msg *sipproto.Message, targets []target) error {
+	send := func(rsp *sipproto.Message) error {
+		return writeSIP(sipConn, rsp)
+	}
+	srv, isNew, err := u.layer.Receive(msg, send, sipConn.Reliable())
+	if err != nil || !isNew || srv == nil {
+		return err
+	}
+
+	key := srv.Key()
+	f := &fork{srv: srv, sipConn: sipConn}
+	f.done = func() { u.endFork(key, f) }
+	u.mu.Lock()
+	u.forks[key] = f
+	u.mu.Unlock()
+
+	f.mu.Lock()
+	for _, t := range targets {
+		branch := &forkBranch{session: t.session}
+		out, err := t.session.forwardSIPRequest(sipConn, msg, t.wsContact, transaction.ClientHandler{
+			Response: func(rsp *sipproto.Message) {
+				f.response(branch, rsp)
+			},
+			Timeout: func() {
+				req, _ := newSIPMessage(branch.request)
+				f.response(branch, newResponse(req, 408, "Request Timeout").message())
+			},
+		})
+		if err != nil {
+			log.Printf("[ERR] fork to %s: %s\n", t.session.flow, err)
+			continue
+		}
+		branch.request = out
+		f.branches = append(f.branches, branch)
+		f.pending++
+	}
+	empty := f.pending == 0
+	f.mu.Unlock()
+
+	if empty {
+		f.done()
+		replyTo(srv, 480, "Temporarily Unavailable")
+	}
+	return nil
+}
+
+// response handles the response of the browser of a branch.
+func (f *fork) response(branch *forkBranch, msg *sipproto.Message) {
+	if msg.Response.StatusCode == 100 {
+		return
+	}
+	sipMsg, _ := newSIPMessage(msg)
+	if err := branch.session.prepareWSResponse(sipMsg); err != nil {
+		log.Printf("[ERR] WS -> SIP: %s\n", err)
+		return
+	}
+	rsp := sipMsg.message()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case rsp.Response.IsProvisional():
+		if !f.answered && !f.canceled {
+			f.respond(rsp)
+		}
+		return
+	case rsp.Response.IsSuccess():
+		// every 2xx is forwarded RFC 3261 section 16.7 step 5, the first
+		// one ends the transaction and the others are sent statelessly
+		// RFC 3261 section 16.7 step 10
+		if f.answered {
+			f.forward(rsp)
+			break
+		}
+		f.answered = true
+		f.respond(rsp)
+		f.cancelOthers(branch)
+	default:
+		if f.best == nil || better(rsp, f.best) {
+			f.best = rsp
+		}
+	}
+	if !branch.final {
+		branch.final = true
+		f.pending--
+	}
+	if f.pending > 0 {
+		return
+	}
+	if !f.answered {
+		f.respond(f.best)
+	}
+	f.done()
+}
+
+// better chooses the final response forwarded when every branch
+// fails, 6xx first and then the lowest class RFC 3261 section 16.7 step 6.
+func better(rsp, best *sipproto.Message) bool {
+	code, bestCode := rsp.Response.StatusCode, best.Response.StatusCode
+	if code >= 600 || bestCode >= 600 {
+		return code >= 600 && bestCode < 600
+	}
+	return code/100 < bestCode/100
+}
+
+func (f *fork) respond(rsp *sipproto.Message) {
+	if err := f.srv.Respond(rsp); err != nil {
+		log.Printf("[ERR] fork respond: %s\n", err)
+	}
+}
+
+func (f *fork) forward(rsp *sipproto.Message) {
+	if err := writeSIP(f.sipConn, rsp); err != nil {
+		log.Printf("[ERR] fork forward: %s\n", err)
+	}
+}
+
+// cancelOthers cancels the branches other than winner without final response.
+func (f *fork) cancelOthers(winner *forkBranch) {
+	for _, branch := range f.branches {
+		if branch != winner && !branch.final {
+			branch.cancel()
+		}
+	}
+}
+
+// cancel cancels every branch of the fork without final response.
+func (f *fork) cancel() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.canceled = true
+	f.cancelOthers(nil)
+}
+
+func (b *forkBranch) cancel() {
+	if b.request.Request.Method != "INVITE" {
+		return
+	}
+	s := b.session
+	_, err := s.layer.Request(sipproto.NewCancel(b.request), s.sendWS, true, transaction.ClientHandler{})
+	if err != nil {
+		log.Printf("[ERR] fork cancel %s: %s\n", s.flow, err)
+	}
+}
+
+// cancelFork answers a CANCEL of the SIP server for a forked INVITE.
+func (u *upstream) cancelFork(sipConn transport.Conn, msg *sipproto.Message) (bool, error) {
+	key, err := transaction.ServerKey(msg)
+	if err != nil {
+		return false, nil
+	}
+	key.Method = "INVITE"
+	u.mu.RLock()
+	f, ok := u.forks[key]
+	u.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+
+	send := func(rsp *sipproto.Message) error {
+		return writeSIP(sipConn, rsp)
+	}
+	srv, isNew, err := u.layer.Receive(msg, send, sipConn.Reliable())
+	if err != nil || !isNew {
+		return true, err
+	}
+	replyTo(srv, 200, "OK")
+	f.cancel()
+	return true, nil
+}
+
+// endFork forgets the fork when its INVITE transaction terminates.
+func (u *upstream) endFork(key transaction.Key, f *fork) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.forks[key] == f {
+		delete(u.forks, key)
+	}
+}
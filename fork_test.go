@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"bit4bit.in/wueco/sipproto"
+	"bit4bit.in/wueco/transaction"
+	"bit4bit.in/wueco/transport"
+	"github.com/gorilla/websocket"
+)
+
+// wsPair returns the websocket of the gateway and the one of the browser.
+func wsPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	accepted := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{Subprotocols: []string{"sip"}}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(srv.Close)
+	browser, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), http.Header{"Sec-WebSocket-Protocol": {"sip"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { browser.Close() })
+	gateway := <-accepted
+	t.Cleanup(func() { gateway.Close() })
+	return gateway, browser
+}
+
+func TestForkForwardsEvery2xx(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	u := newUpstream(transport.Target{Transport: "tcp", Address: ln.Addr().String()}, 1)
+	u.probeInterval = time.Hour
+	u.start()
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(2 * time.Second))
+	pbx, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pbx.Close()
+	pbxReader := sipproto.NewReader(bufio.NewReader(pbx))
+
+	targets := make([]target, 0)
+	browsers := make([]*websocket.Conn, 0)
+	for _, flow := range []string{"tab1", "tab2"} {
+		gateway, browser := wsPair(t)
+		s := &session{
+			conn:           gateway,
+			upstream:       u,
+			layer:          transaction.NewLayer(),
+			wsViaTransport: "WS",
+			wsSentBy:       "df7jal23ls0d.invalid",
+			flow:           flow,
+			dialogs:        newDialogs(),
+			done:           make(chan struct{}),
+		}
+		s.registrations = newRegistrations(s.onBind)
+		u.attach(s)
+		go s.readWS()
+		defer s.close(0)
+		targets = append(targets, target{session: s})
+		browsers = append(browsers, browser)
+	}
+
+	sipConn, err := u.conn("tab1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite := withSDP(t, `INVITE sip:bob@biloxi.com SIP/2.0
+Via: SIP/2.0/TCP pbx.biloxi.com;branch=z9hG4bK74bf9
+Max-Forwards: 70
+To: <sip:bob@biloxi.com>
+From: <sip:alice@atlanta.com>;tag=pbx
+Call-ID: forked
+CSeq: 1 INVITE
+Contact: <sip:alice@pbx.biloxi.com>
+Content-Length: 0
+
+`, pbxSDP)
+	if err := u.forkRequest(sipConn, invite.message(), targets); err != nil {
+		t.Fatal(err)
+	}
+
+	// both tabs answer
+	for i, browser := range browsers {
+		browser.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, raw, err := browser.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		forked, err := sipproto.NewReader(bufio.NewReader(strings.NewReader(string(raw)))).ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok := sipproto.NewResponse(forked, 200, "OK")
+		ok.Header.Set("To", forked.Header.Get("to")+";tag=tab"+string(rune('1'+i)))
+		ok.Header.Set("Contact", "<sip:k2k@df7jal23ls0d.invalid;transport=ws>")
+		if err := browser.WriteMessage(websocket.TextMessage, ok.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tags := make(map[string]bool)
+	pbx.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(tags) < 2 {
+		rsp, err := pbxReader.ReadMessage()
+		if err != nil {
+			t.Fatalf("expected the 2xx of both tabs got %v: %s", tags, err)
+		}
+		if rsp.IsRequest() || rsp.Response.StatusCode != 200 {
+			continue
+		}
+		to, err := sipproto.ParseAddress(rsp.Header.Get("to"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag, _ := to.Params.Get("tag")
+		tags[tag] = true
+	}
+	if !tags["tab1"] || !tags["tab2"] {
+		t.Errorf("expected the 2xx of both tabs got %v", tags)
+	}
+}
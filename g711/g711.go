@@ -0,0 +1,111 @@
+// Package g711 converts between linear PCM of 16 bits and the
+// μ-law and A-law of ITU-T G.711, the payloads of PCMU and PCMA
+// RFC 3551 section 4.5.14.
+package g711
+
+const (
+	// bias of the magnitude of μ-law
+	ulawBias = 0x84
+	// largest magnitude of μ-law before the bias
+	ulawClip = 32635
+)
+
+// the ends of the segments of A-law for the 13 bits of magnitude
+var alawSegments = [8]int32{0x1f, 0x3f, 0x7f, 0xff, 0x1ff, 0x3ff, 0x7ff, 0xfff}
+
+var (
+	ulawToAlaw [256]byte
+	alawToUlaw [256]byte
+)
+
+func init() {
+	for i := 0; i < 256; i++ {
+		ulawToAlaw[i] = EncodeAlaw(DecodeUlaw(byte(i)))
+		alawToUlaw[i] = EncodeUlaw(DecodeAlaw(byte(i)))
+	}
+}
+
+// EncodeUlaw returns the μ-law of a sample.
+func EncodeUlaw(sample int16) byte {
+	magnitude, sign := int32(sample), byte(0)
+	if magnitude < 0 {
+		magnitude, sign = -magnitude, 0x80
+	}
+	if magnitude > ulawClip {
+		magnitude = ulawClip
+	}
+	magnitude += ulawBias
+	exponent := byte(7)
+	for mask := int32(0x4000); magnitude&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := byte(magnitude>>(exponent+3)) & 0x0f
+	return ^(sign | exponent<<4 | mantissa)
+}
+
+// DecodeUlaw returns the sample of a μ-law.
+func DecodeUlaw(ulaw byte) int16 {
+	ulaw = ^ulaw
+	magnitude := (int32(ulaw&0x0f)<<3 + ulawBias) << ((ulaw & 0x70) >> 4)
+	if ulaw&0x80 != 0 {
+		return int16(ulawBias - magnitude)
+	}
+	return int16(magnitude - ulawBias)
+}
+
+// EncodeAlaw returns the A-law of a sample.
+func EncodeAlaw(sample int16) byte {
+	// A-law has 13 bits
+	magnitude, mask := int32(sample)>>3, byte(0xd5)
+	if magnitude < 0 {
+		magnitude, mask = -magnitude-1, 0x55
+	}
+	segment := 0
+	for segment < len(alawSegments) && magnitude > alawSegments[segment] {
+		segment++
+	}
+	if segment == len(alawSegments) {
+		return 0x7f ^ mask
+	}
+	alaw := byte(segment << 4)
+	if segment < 2 {
+		alaw |= byte(magnitude>>1) & 0x0f
+	} else {
+		alaw |= byte(magnitude>>segment) & 0x0f
+	}
+	return alaw ^ mask
+}
+
+// DecodeAlaw returns the sample of an A-law.
+func DecodeAlaw(alaw byte) int16 {
+	alaw ^= 0x55
+	magnitude := int32(alaw&0x0f) << 4
+	switch segment := (alaw & 0x70) >> 4; segment {
+	case 0:
+		magnitude += 8
+	case 1:
+		magnitude += 0x108
+	default:
+		magnitude = (magnitude + 0x108) << (segment - 1)
+	}
+	if alaw&0x80 != 0 {
+		return int16(magnitude)
+	}
+	return int16(-magnitude)
+}
+
+// UlawToAlaw converts the μ-law of src to the A-law of dst, dst is
+// at least as long as src and may be src.
+func UlawToAlaw(dst, src []byte) {
+	for i := range src {
+		dst[i] = ulawToAlaw[src[i]]
+	}
+}
+
+// AlawToUlaw converts the A-law of src to the μ-law of dst, dst is
+// at least as long as src and may be src.
+func AlawToUlaw(dst, src []byte) {
+	for i := range src {
+		dst[i] = alawToUlaw[src[i]]
+	}
+}
@@ -0,0 +1,92 @@
+package g711
+
+import "testing"
+
+func TestUlaw(t *testing.T) {
+	// values of the reference g711.c of Sun Microsystems
+	for _, tt := range []struct {
+		sample int16
+		ulaw   byte
+	}{
+		{0, 0xff},
+		{-1, 0x7f},
+		{1000, 0xce},
+		{-1000, 0x4e},
+		{32767, 0x80},
+		{-32768, 0x00},
+	} {
+		if got := EncodeUlaw(tt.sample); got != tt.ulaw {
+			t.Errorf("expected μ-law of %d %#x got %#x", tt.sample, tt.ulaw, got)
+		}
+	}
+	for ulaw, sample := range map[byte]int16{0xff: 0, 0x7f: 0, 0x80: 32124, 0x00: -32124, 0xce: 988} {
+		if got := DecodeUlaw(ulaw); got != sample {
+			t.Errorf("expected sample of μ-law %#x %d got %d", ulaw, sample, got)
+		}
+	}
+}
+
+func TestAlaw(t *testing.T) {
+	for _, tt := range []struct {
+		sample int16
+		alaw   byte
+	}{
+		{0, 0xd5},
+		{-1, 0x55},
+		{1000, 0xfa},
+		{-1000, 0x7a},
+		{32767, 0xaa},
+		{-32768, 0x2a},
+	} {
+		if got := EncodeAlaw(tt.sample); got != tt.alaw {
+			t.Errorf("expected A-law of %d %#x got %#x", tt.sample, tt.alaw, got)
+		}
+	}
+	for alaw, sample := range map[byte]int16{0xd5: 8, 0x55: -8, 0xaa: 32256, 0x2a: -32256, 0xfa: 1008} {
+		if got := DecodeAlaw(alaw); got != sample {
+			t.Errorf("expected sample of A-law %#x %d got %d", alaw, sample, got)
+		}
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		if got := EncodeUlaw(DecodeUlaw(byte(i))); got != byte(i) && byte(i) != 0x7f {
+			t.Errorf("expected μ-law %#x back got %#x", i, got)
+		}
+		if got := EncodeAlaw(DecodeAlaw(byte(i))); got != byte(i) {
+			t.Errorf("expected A-law %#x back got %#x", i, got)
+		}
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	samples := []int16{0, 100, -100, 1000, -1000, 8000, -8000, 30000, -30000}
+	ulaw := make([]byte, len(samples))
+	for i, sample := range samples {
+		ulaw[i] = EncodeUlaw(sample)
+	}
+	alaw := make([]byte, len(ulaw))
+	UlawToAlaw(alaw, ulaw)
+	for i, sample := range samples {
+		// both laws quantize with steps below 1/16 of the magnitude
+		if got := DecodeAlaw(alaw[i]); abs(int32(got)-int32(sample)) > abs(int32(sample))/16+16 {
+			t.Errorf("expected about %d from PCMA got %d", sample, got)
+		}
+	}
+
+	// in place
+	AlawToUlaw(alaw, alaw)
+	for i, sample := range samples {
+		if got := DecodeUlaw(alaw[i]); abs(int32(got)-int32(sample)) > abs(int32(sample))/16+16 {
+			t.Errorf("expected about %d from PCMU got %d", sample, got)
+		}
+	}
+}
+
+func abs(n int32) int32 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
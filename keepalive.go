@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"bit4bit.in/wueco/sipproto"
+	"bit4bit.in/wueco/transaction"
+	"bit4bit.in/wueco/transport"
+	"github.com/gorilla/websocket"
+)
+
+// time for the pong of a CRLF keepalive RFC 5626 section 4.4.1
+const keepalivePongTimeout = 10 * time.Second
+
+// the vias of the OPTIONS of wueco carry this flow, no session has it
+const probeFlow = "probe"
+
+var (
+	errNoPong        = errors.New("keepalive without pong")
+	errProbeTimeout  = errors.New("OPTIONS without response")
+	errKeepaliveStop = errors.New("keepalive stopped")
+)
+
+// keepalive watches conn of the slot i until stop, a missing pong or an
+// OPTIONS without response marks the connection down by closing it so
+// the slot is dialed again.
+func (u *upstream) keepalive(i int, conn transport.Conn, stop <-chan struct{}) {
+	var pingC, probeC <-chan time.Time
+	pinger, ok := conn.(transport.Pinger)
+	if ok && u.pingInterval > 0 {
+		ticker := time.NewTicker(u.pingInterval)
+		defer ticker.Stop()
+		pingC = ticker.C
+	}
+	if u.probeInterval > 0 {
+		ticker := time.NewTicker(u.probeInterval)
+		defer ticker.Stop()
+		probeC = ticker.C
+	}
+
+	for {
+		var err error
+		select {
+		case <-stop:
+			return
+		case <-pingC:
+			err = ping(pinger, stop)
+		case <-probeC:
+			err = u.probe(conn, stop)
+		}
+		if errors.Is(err, errKeepaliveStop) {
+			return
+		}
+		if err != nil {
+			log.Printf("[ERR] upstream %d down: %s\n", i, err)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// ping sends a CRLF keepalive and waits its pong.
+func ping(pinger transport.Pinger, stop <-chan struct{}) error {
+	// a late pong of the previous ping
+	select {
+	case <-pinger.Pong():
+	default:
+	}
+	if err := pinger.Ping(); err != nil {
+		return err
+	}
+	select {
+	case <-pinger.Pong():
+		return nil
+	case <-time.After(keepalivePongTimeout):
+		return errNoPong
+	case <-stop:
+		return errKeepaliveStop
+	}
+}
+
+// probe sends an OPTIONS to the SIP server, any response
+// proves the server alive.
+func (u *upstream) probe(conn transport.Conn, stop <-chan struct{}) error {
+	result := make(chan error, 1)
+	_, err := u.layer.Request(u.newProbe(conn), func(msg *sipproto.Message) error {
+		return writeSIP(conn, msg)
+	}, conn.Reliable(), transaction.ClientHandler{
+		Response: func(*sipproto.Message) {
+			select {
+			case result <- nil:
+			default:
+			}
+		},
+		Timeout: func() {
+			select {
+			case result <- errProbeTimeout:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-stop:
+		return errKeepaliveStop
+	}
+}
+
+// newProbe builds the OPTIONS to the SIP server RFC 3261 section 11.
+func (u *upstream) newProbe(conn transport.Conn) *sipproto.Message {
+	uri := &sipproto.URI{Scheme: "sip", Host: u.target.Address}
+	if host, port, err := net.SplitHostPort(u.target.Address); err == nil {
+		uri.Host = host
+		uri.Port, _ = strconv.Atoi(port)
+	}
+	sentBy := conn.LocalAddr().String()
+	req := &sipMessage{
+		request: &sipproto.Request{Method: "OPTIONS", RequestURI: uri, Version: sipproto.Version},
+	}
+	req.header.Add("Max-Forwards", "70")
+	req.header.Add("From", "<sip:wueco@"+sentBy+">;tag="+newTag())
+	req.header.Add("To", "<"+uri.String()+">")
+	req.header.Add("Call-ID", randomHex(12))
+	req.header.Add("CSeq", sipproto.CSeq{Seq: 1, Method: "OPTIONS"}.String())
+	req.pushVia(probeFlow, conn.Transport(), sentBy)
+	return req.message()
+}
+
+// keepaliveWS pings the browser every interval until the session ends,
+// the websocket is closed when no pong arrives before two intervals.
+func (s *session) keepaliveWS(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	deadline := func() error {
+		return s.conn.SetReadDeadline(time.Now().Add(2 * interval))
+	}
+	deadline()
+	s.conn.SetPongHandler(func(string) error {
+		return deadline()
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+					log.Printf("[ERR] websocket ping: %s\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// pongWS answers the CRLF keepalive of the browser.
+func (s *session) pongWS(ping bool) {
+	if !ping {
+		return
+	}
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+	if err := s.conn.WriteMessage(websocket.TextMessage, []byte("\r\n")); err != nil {
+		log.Printf("[ERR] websocket pong: %s\n", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"bit4bit.in/wueco/sipproto"
+	"bit4bit.in/wueco/transaction"
+	"bit4bit.in/wueco/transport"
+)
+
+func TestProbeReconnects(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	u := newUpstream(transport.Target{Transport: "tcp", Address: ln.Addr().String()}, 1)
+	u.layer = transaction.NewLayer(transaction.WithTimers(5*time.Millisecond, 20*time.Millisecond, 20*time.Millisecond))
+	u.probeInterval = 20 * time.Millisecond
+	u.start()
+
+	accept := func() (net.Conn, *bufio.Reader) {
+		ln.(*net.TCPListener).SetDeadline(time.Now().Add(2 * time.Second))
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+	server, buf := accept()
+	defer server.Close()
+
+	options, err := sipproto.NewReader(buf).ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !options.IsRequest() || options.Request.Method != "OPTIONS" {
+		t.Fatalf("expected OPTIONS got %s", options.StatusLine)
+	}
+	if via, err := options.Header.TopVia(); err != nil || via.Transport != "TCP" {
+		t.Errorf("unexpected via of the probe %v", err)
+	}
+	if _, err := server.Write(sipproto.NewResponse(options, 200, "OK").Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sipproto.NewReader(buf).ReadMessage(); err != nil {
+		t.Fatalf("expected the next probe on the same connection: %s", err)
+	}
+
+	// the server stops answering, the connection is closed and dialed again
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.Copy(io.Discard, buf); err != nil {
+		t.Fatalf("expected the connection closed by the gateway: %s", err)
+	}
+	again, _ := accept()
+	again.Close()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	"bit4bit.in/wueco/sipproto"
+)
+
+// target is a session reached by a contact of wueco, wsContact
+// is the contact of the browser.
+type target struct {
+	session   *session
+	wsContact string
+}
+
+// location is the gateway-wide location service, it maps the contacts
+// of wueco and the AORs registered by the browsers to the live sessions.
+// The tabs of a user with the same contact of wueco share the binding
+// on the SIP server and they are forked by wueco.
+type location struct {
+	mu sync.RWMutex
+	// contact of wueco -> session -> contact of the browser
+	contacts map[string]map[*session]string
+	// AOR -> registered contacts of wueco -> sessions
+	aors map[string]map[string]map[*session]bool
+}
+
+func newLocation() *location {
+	return &location{
+		contacts: make(map[string]map[*session]string),
+		aors:     make(map[string]map[string]map[*session]bool),
+	}
+}
+
+// uriKey identifies an URI by user, host and port, the
+// parameters are ignored.
+func uriKey(uri string) string {
+	parsed, err := sipproto.ParseURI(uri)
+	if err != nil {
+		return uri
+	}
+	key := parsed.User + "@" + parsed.Host
+	if parsed.Port != 0 {
+		key += ":" + strconv.Itoa(parsed.Port)
+	}
+	return key
+}
+
+// addContact maps the contact of wueco given to the browser of s.
+func (l *location) addContact(contact string, s *session, wsContact string) {
+	key := uriKey(contact)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sessions, ok := l.contacts[key]
+	if !ok {
+		sessions = make(map[*session]string)
+		l.contacts[key] = sessions
+	}
+	sessions[s] = wsContact
+}
+
+// wsContact returns the contact of the browser of s for a contact of wueco.
+func (l *location) wsContact(contact string, s *session) (string, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	wsContact, ok := l.contacts[uriKey(contact)][s]
+	return wsContact, ok
+}
+
+// bind registers the contact of wueco of s for aor.
+func (l *location) bind(aor, contact string, s *session) {
+	key, contactKey := uriKey(aor), uriKey(contact)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	contacts, ok := l.aors[key]
+	if !ok {
+		contacts = make(map[string]map[*session]bool)
+		l.aors[key] = contacts
+	}
+	sessions, ok := contacts[contactKey]
+	if !ok {
+		sessions = make(map[*session]bool)
+		contacts[contactKey] = sessions
+	}
+	sessions[s] = true
+}
+
+// unbind removes the registration of the contact of s for aor.
+func (l *location) unbind(aor, contact string, s *session) {
+	key, contactKey := uriKey(aor), uriKey(contact)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.unbindLocked(key, contactKey, s)
+}
+
+func (l *location) unbindLocked(key, contactKey string, s *session) {
+	delete(l.aors[key][contactKey], s)
+	if len(l.aors[key][contactKey]) == 0 {
+		delete(l.aors[key], contactKey)
+	}
+	if len(l.aors[key]) == 0 {
+		delete(l.aors, key)
+	}
+}
+
+// shared is true when other session than s has registered the contact for aor.
+func (l *location) shared(aor, contact string, s *session) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for other := range l.aors[uriKey(aor)][uriKey(contact)] {
+		if other != s {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the sessions for a Request-URI, it's a contact of wueco
+// shared by the tabs of a user or an AOR with the tabs of every contact.
+func (l *location) lookup(uri string) []target {
+	key := uriKey(uri)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if _, ok := l.contacts[key]; ok {
+		return l.targets(key)
+	}
+	var targets []target
+	for contact := range l.aors[key] {
+		targets = append(targets, l.targets(contact)...)
+	}
+	return targets
+}
+
+func (l *location) targets(contact string) []target {
+	var targets []target
+	for s, wsContact := range l.contacts[contact] {
+		targets = append(targets, target{session: s, wsContact: wsContact})
+	}
+	return targets
+}
+
+// remove deletes the contacts and registrations of a closed session.
+func (l *location) remove(s *session) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, sessions := range l.contacts {
+		delete(sessions, s)
+		if len(sessions) == 0 {
+			delete(l.contacts, key)
+		}
+	}
+	for aor, contacts := range l.aors {
+		for contact := range contacts {
+			l.unbindLocked(aor, contact, s)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sort"
+	"testing"
+
+	"bit4bit.in/wueco/sipproto"
+)
+
+func TestLocationLookup(t *testing.T) {
+	l := newLocation()
+	tab1, tab2, other := &session{flow: "tab1"}, &session{flow: "tab2"}, &session{flow: "other"}
+	contact := "sip:bob@10.0.0.1:5060;transport=tcp"
+	l.addContact(contact, tab1, "<sip:k2k@df7jal23ls0d.invalid;transport=ws>")
+	l.addContact(contact, tab2, "<sip:j8s@a8sdnq71.invalid;transport=ws>")
+	l.addContact("sip:alice@10.0.0.1:5060;transport=tcp", other, "<sip:a7c@q9sdj3.invalid;transport=ws>")
+	l.bind("sip:bob@biloxi.com", contact, tab1)
+	l.bind("sip:bob@biloxi.com", contact, tab2)
+
+	flows := func(targets []target) []string {
+		var flows []string
+		for _, t := range targets {
+			flows = append(flows, t.session.flow)
+		}
+		sort.Strings(flows)
+		return flows
+	}
+	if got := flows(l.lookup("sip:bob@10.0.0.1:5060")); len(got) != 2 || got[0] != "tab1" || got[1] != "tab2" {
+		t.Errorf("lookup by contact got %v", got)
+	}
+	if got := flows(l.lookup("sip:bob@biloxi.com")); len(got) != 2 {
+		t.Errorf("lookup by AOR got %v", got)
+	}
+	if got := l.lookup("sip:carol@biloxi.com"); len(got) != 0 {
+		t.Errorf("unexpected targets %v", got)
+	}
+	if wsContact, ok := l.wsContact(contact, tab2); !ok || wsContact != "<sip:j8s@a8sdnq71.invalid;transport=ws>" {
+		t.Errorf("unexpected contact of the browser %q", wsContact)
+	}
+
+	if !l.shared("sip:bob@biloxi.com", contact, tab1) {
+		t.Errorf("expected binding shared with tab2")
+	}
+	l.remove(tab2)
+	if l.shared("sip:bob@biloxi.com", contact, tab1) {
+		t.Errorf("expected binding not shared after remove")
+	}
+	if got := flows(l.lookup("sip:bob@biloxi.com")); len(got) != 1 || got[0] != "tab1" {
+		t.Errorf("lookup after remove got %v", got)
+	}
+}
+
+func TestForkBetter(t *testing.T) {
+	response := func(code int) *sipproto.Message {
+		return &sipproto.Message{Response: &sipproto.Response{StatusCode: code}}
+	}
+	tests := []struct {
+		rsp, best int
+		better    bool
+	}{
+		{486, 503, true},
+		{503, 486, false},
+		{603, 486, true},
+		{486, 603, false},
+		{480, 486, false},
+	}
+	for _, test := range tests {
+		if got := better(response(test.rsp), response(test.best)); got != test.better {
+			t.Errorf("better(%d, %d) expected %v", test.rsp, test.best, test.better)
+		}
+	}
+}
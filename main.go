@@ -1,26 +1,46 @@
 package main
 
 import (
-	"io"
-	"bufio"
-	"errors"
 	"context"
+	"errors"
 	"flag"
-	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"bit4bit.in/wueco/digest"
 	"bit4bit.in/wueco/rtpproxy"
 	"bit4bit.in/wueco/sipproto"
+	"bit4bit.in/wueco/transaction"
+	"bit4bit.in/wueco/transport"
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
 )
 
 var (
-	host       = flag.String("host", "", "Host that websocket is available on")
-	sipAddress = flag.String("sip", "", "SIP Server Host example: 1.2.3.5:5060")
+	host             = flag.String("host", "", "Host that websocket is available on")
+	sipAddress       = flag.String("sip", "", "SIP Server Host example: 1.2.3.5:5060, udp:1.2.3.5:5060, tls:1.2.3.5:5061 (default tcp)")
+	sipTLSCA         = flag.String("sip-tls-ca", "", "PEM CA bundle to verify the SIP Server (default system pool)")
+	sipTLSCert       = flag.String("sip-tls-cert", "", "PEM client certificate for the SIP Server")
+	sipTLSKey        = flag.String("sip-tls-key", "", "PEM key of the client certificate")
+	sipTLSServerName = flag.String("sip-tls-servername", "", "Server name for SNI and verification (default host of -sip)")
+	sipHeaderForm    = flag.String("sip-header-form", "", "Header names sent to SIP Server: long, compact (default as received)")
+	sipConnections   = flag.Int("sip-connections", 2, "Connections to the SIP Server shared by every websocket")
+	sipCredentials   = flag.String("sip-credentials", "", "File of SIP credentials per web user, the gateway answers the challenges of the SIP Server")
+	webUserHeader    = flag.String("web-user-header", "X-Forwarded-User", "Header with the web user set by the authenticating reverse proxy")
+	registerGrace    = flag.Duration("register-grace", 0, "Time the gateway refreshes the registrations of a closed websocket before the unREGISTER, requires -sip-credentials")
+	sipKeepalive     = flag.Duration("sip-keepalive", 30*time.Second, "Interval of the CRLF keepalives over TCP and TLS to the SIP Server, 0 disables")
+	sipOptions       = flag.Duration("sip-options-interval", time.Minute, "Interval of the OPTIONS probing the SIP Server, 0 disables")
+	wsKeepalive      = flag.Duration("ws-keepalive", 30*time.Second, "Interval of the pings to the websocket, 0 disables")
+	sipAdvertise     = flag.String("sip-advertise", "", "host:port announced to the SIP Server in Record-Route and Contact, required")
+	dtmfInfo         = flag.Bool("dtmf-info", false, "Send the DTMF of the browser to the SIP Server as INFO application/dtmf-relay and back instead of RFC 4733")
+)
+
+var (
+	sipUpstream        *upstream
+	sipCredentialStore digest.Store
 )
 
 func main() {
@@ -28,6 +48,46 @@ func main() {
 	if *host == "" || *sipAddress == "" {
 		log.Fatal("-host, -sip are required")
 	}
+	target, err := transport.ParseTarget(*sipAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var sipDialOptions []transport.DialOption
+	if target.Transport == "tls" {
+		config, err := transport.TLSOptions{
+			CAFile:     *sipTLSCA,
+			CertFile:   *sipTLSCert,
+			KeyFile:    *sipTLSKey,
+			ServerName: *sipTLSServerName,
+		}.Config()
+		if err != nil {
+			log.Fatal(err)
+		}
+		sipDialOptions = append(sipDialOptions, transport.WithTLSConfig(config))
+	}
+	switch *sipHeaderForm {
+	case "", "long", "compact":
+	default:
+		log.Fatal("-sip-header-form must be long or compact")
+	}
+	if *sipAdvertise == "" {
+		log.Fatal("-sip-advertise is required, the local address of the SIP connections changes with the reconnections")
+	}
+	if *registerGrace > 0 && *sipCredentials == "" {
+		log.Fatal("-register-grace requires -sip-credentials, the SIP Server challenges the refreshes")
+	}
+	if *sipCredentials != "" {
+		store, err := digest.LoadStore(*sipCredentials)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sipCredentialStore = store
+	}
+	sipUpstream = newUpstream(target, *sipConnections, sipDialOptions...)
+	sipUpstream.pingInterval = *sipKeepalive
+	sipUpstream.probeInterval = *sipOptions
+	sipUpstream.advertise = *sipAdvertise
+	sipUpstream.start()
 
 	http.HandleFunc("/ws", websocketHandler)
 	log.Fatal(http.ListenAndServe("localhost:8088", nil))
@@ -35,16 +95,6 @@ func main() {
 
 func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("New websocket connection")
-	contactWSToSIP := make(map[string]string)
-	contactSIPToWS := make(map[string]string)
-
-	rtpengine, err := rtpproxy.NewRTPProxy(*host)
-	defer rtpengine.Close()
-
-	if err != nil {
-		log.Printf("[ERR] newRTPEngine: %s\n", err)
-	}
-	log.Printf("RTPENGINE LISTENING AT %s\n", rtpengine.Addr())
 
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true },
@@ -56,212 +106,283 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+	s := &session{
+		conn:           conn,
+		upstream:       sipUpstream,
+		layer:          transaction.NewLayer(),
+		remoteAddr:     r.RemoteAddr,
+		wsViaTransport: "WS",
+		wsSentBy:       r.Host,
+		flow:           newFlowToken(),
+		dialogs:        newDialogs(),
+		done:           make(chan struct{}),
 	}
-	peerConn, err := webrtc.NewPeerConnection(config)
-	if err != nil {
-		log.Fatal(err)
-		return
+	s.registrations = newRegistrations(s.onBind)
+	if r.TLS != nil {
+		s.wsViaTransport = "WSS"
 	}
-
-	defer peerConn.Close()
-
-	peerConn.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
-		switch p {
-		case webrtc.PeerConnectionStateFailed:
-			if err := peerConn.Close(); err != nil {
-				log.Println(err)
-			}
-		case webrtc.PeerConnectionStateClosed:
-			log.Println("PeerConnectionStateClosed")
+	// the web user is set by the authenticating reverse proxy in front of
+	// wueco, without credentials the browser answers the challenges
+	if sipCredentialStore != nil {
+		if webUser := r.Header.Get(*webUserHeader); webUser != "" {
+			s.auth = newAuthenticator(sipCredentialStore, webUser)
 		}
-
-	})
-
-	// TODO: construir desde fmtp
-	audioTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "wueco")
-	if err != nil {
-		panic(err)
 	}
-	ctxRTCP, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	proxyRTCP(ctxRTCP, rtpengine, peerConn, audioTrack)
 
-	peerConn.OnTrack(func(track *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
-		log.Println("OnTrack")
+	// SIP -> WS by the upstream connections
+	sipUpstream.attach(s)
+	defer s.close(*registerGrace)
 
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-
-		go rtpengine.WriteRTCP(ctx, r)
-		go rtpengine.Read(ctx, audioTrack)
-		rtpengine.Write(ctx, track)
-	})
-
-	if _, err = peerConn.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
-		log.Fatal(err)
-	}
+	// WS -> SIP
+	s.keepaliveWS(*wsKeepalive)
+	s.readWS()
+}
 
-	offer := &webrtc.SessionDescription{}
+// the answer for the browser carries every ICE candidate, SIP has no trickle ICE
+const iceGatheringTimeout = 3 * time.Second
 
-	sipConnRaw, err := net.Dial("tcp", *sipAddress)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	defer sipConnRaw.Close()
+var (
+	errNoAnswer = errors.New("2xx without answer for the browser")
+	// an offer arrived while other offer of the call is pending RFC 3261 section 14.2
+	errGlare = errors.New("offer while other offer is pending")
+	// only the answer to a reliable provisional response is relayed in PRACK
+	errPRACKOffer = errors.New("offer in PRACK")
+)
 
+func hasSDP(sipMsg *sipMessage) bool {
+	return sipMsg.header.Get("content-type") == "application/sdp" && strings.TrimSpace(sipMsg.content) != ""
+}
 
-	sipReader := sipproto.NewReader(bufio.NewReader(sipConnRaw))
+func isOfferMethod(method string) bool {
+	return method == "INVITE" || method == "UPDATE"
+}
 
+func cseqOf(sipMsg *sipMessage) uint32 {
+	cseq, _ := sipproto.ParseCSeq(sipMsg.header.Get("cseq"))
+	return cseq.Seq
+}
 
-	// SIP -> WS
-	go func() {
-		for {
-			protoMsg, err := sipReader.ReadMessage()
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					continue
+func proxyRTPWSToSIP(c *call, sipMsg *sipMessage) error {
+	content := string(sipMsg.content)
+	if sipMsg.request != nil && isOfferMethod(sipMsg.request.Method) && hasSDP(sipMsg) {
+		if c.peerConn.SignalingState() != webrtc.SignalingStateStable {
+			return errGlare
+		}
+		// the browser gets the answer when the SIP side answers
+		if err := c.peerConn.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: content}); err != nil {
+			return err
+		}
+		c.offered(cseqOf(sipMsg))
+		localSDP, err := c.rtpengine.LocalSDP(content)
+		if err != nil {
+			return err
+		}
+		sipMsg.content = localSDP
+	} else if sipMsg.response != nil && isOfferMethod(sipMsg.CSeqMethod()) {
+		// the browser answers the offer of the SIP side, the answer of a
+		// 18x is repeated in the 2xx without renegotiating
+		code := sipMsg.response.StatusCode
+		pending := c.peerConn.SignalingState() == webrtc.SignalingStateHaveLocalOffer
+		switch {
+		case code >= 300:
+			if pending {
+				return rollbackOffer(c.peerConn)
+			}
+		case code > 100 && hasSDP(sipMsg):
+			if pending {
+				// the track gets the codec before pion starts sending
+				if err := c.answerCodec(content); err != nil {
+					return err
+				}
+				if err := c.peerConn.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: content}); err != nil {
+					return err
 				}
-				fmt.Printf("[ERR] SIP -> WS newSIPMessage: %s\n", err)
-				return
 			}
-			sipMsg, _ := newSIPMessage(protoMsg)
-			if wsContact, ok := contactSIPToWS[sipMsg.Contact()]; ok {
-				sipMsg.header.Set("contact", wsContact)
+			wuecoSDP, err := c.rtpengine.LocalSDP(content)
+			if err != nil {
+				return err
 			}
-
-			if err := proxyRTPSIPToWS(peerConn, sipMsg, rtpengine, offer); err != nil {
-				log.Printf("[ERR] proxyRTPSIPToWS: %s\n", err)
-				return
+			sipMsg.content = wuecoSDP
+			if rseq, ok := sipMsg.rseq(); ok {
+				c.reliableOffer(rseq)
 			}
-
-			sipMsg.WriteMessage(conn)
 		}
-	}()
+	}
 
+	return nil
+}
 
-	
-	// WS -> SIP
-	wsR := sipproto.NewReaderWS(conn)
-	go wsR.Run()
-	wsReader := sipproto.NewReader(bufio.NewReader(wsR))
-	for {
-		protoMsg, err := wsReader.ReadMessage()
-		if err != nil {
-			if errors.Is(err, errNeedMoreData) {
-				continue
+func proxyRTPSIPToWS(c *call, sipMsg *sipMessage) error {
+	switch {
+	case sipMsg.request != nil && isOfferMethod(sipMsg.request.Method):
+		// an UPDATE without SDP only refreshes the session
+		if sipMsg.IsMethod("UPDATE") && !hasSDP(sipMsg) {
+			return nil
+		}
+		if c.peerConn.SignalingState() != webrtc.SignalingStateStable {
+			return errGlare
+		}
+		// an INVITE without SDP gets the offer of wueco in the reliable
+		// 18x or the 2xx and the answer in the PRACK or the ACK
+		if hasSDP(sipMsg) {
+			if err := c.rtpengine.SetSIPSDP(string(sipMsg.content)); err != nil {
+				return err
 			}
-			if errors.Is(err, io.EOF) {
-				continue
+			if err := c.preferCodecs(c.rtpengine.SIPCodecs(), nil); err != nil {
+				return err
 			}
-			log.Printf("[ERR] WS - SIP newSipMessage: %s\n", err)
-			return
-		}
-		sipMsg, _ := newSIPMessage(protoMsg)
-		wsContact := sipMsg.header.Get("contact")
-		sipAddr, sipContact := sipMsg.ContactFromTo(wsContact, sipConnRaw.LocalAddr().String())
-		contactSIPToWS[sipAddr] = wsContact
-		contactWSToSIP[wsContact] = sipContact
-		
-		if sipContact, ok := contactWSToSIP[wsContact]; ok {
-			// enviamos el contact de wueco
-			sipMsg.header.Set("contact", sipContact)
+		} else {
+			c.awaitSIPAnswer()
 		}
-		
-		
-		if err := proxyRTPWSToSIP(peerConn, sipMsg, rtpengine, offer); err != nil {
-			log.Printf("[ERR] proxyRTPWSToSIP: %s", err)
-			return
+		loffer, err := c.peerConn.CreateOffer(nil)
+		if err != nil {
+			return err
 		}
-		
-		if _, err := sipMsg.Write(sipConnRaw); err != nil {
-			log.Printf("[ERR] sipConn.Write: %w", err)
-			return
+		if err := c.peerConn.SetLocalDescription(loffer); err != nil {
+			return err
 		}
+		*c.offer = loffer
 
-	}
-}
-
-
-func proxyRTPWSToSIP(peerConn *webrtc.PeerConnection, sipMsg *sipMessage, rtpengine *rtpproxy.RTPProxy, offer *webrtc.SessionDescription) error {
-	content := string(sipMsg.content)
-	if sipMsg.IsMethod("INVITE") && sipMsg.header.Get("content-type") == "application/sdp" {
-		if sipMsg.header.Get("proxy-authorization") == "" {
-			if err := peerConn.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: content}); err != nil {
-				panic(err)
-				return err
-			}
-			
-			loffer, err := peerConn.CreateAnswer(nil)
-			if err != nil {
-				panic(err)
+		//ofrecemos al navegador el sdp de wueco
+		sipMsg.header.Set("content-type", "application/sdp")
+		sipMsg.content = rtpproxy.WithDirection(c.offer.SDP, c.rtpengine.SIPDirection())
+	case sipMsg.IsMethod("ACK"):
+		if hasSDP(sipMsg) {
+			if err := c.rtpengine.SetSIPSDP(string(sipMsg.content)); err != nil {
 				return err
 			}
-			if err := peerConn.SetLocalDescription(loffer); err != nil {
-				panic(err)
+			c.answeredBySIP(0)
+			if err := c.negotiate(c.peerConn.RemoteDescription().SDP, true); err != nil {
 				return err
 			}
-			*offer = loffer
-		} else {
-			content = string(sipMsg.content)
+			// the browser answered in the 2xx
+			sipMsg.header.Del("content-type")
+			sipMsg.content = ""
 		}
-
-
-		sipMsg.content = rtpengine.LocalSDP(content)
-	} else if sipMsg.IsStatus("200") && sipMsg.header.Get("content-type") == "application/sdp" {
-		content := string(sipMsg.content)
-		
-		if err := peerConn.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: content}); err != nil {
+	case sipMsg.IsMethod("PRACK") && hasSDP(sipMsg):
+		rack, err := sipproto.ParseRAck(sipMsg.header.Get("rack"))
+		if err != nil {
+			return err
+		}
+		if !c.answeredBySIP(rack.RSeq) {
+			return errPRACKOffer
+		}
+		if err := c.rtpengine.SetSIPSDP(string(sipMsg.content)); err != nil {
+			return err
+		}
+		if err := c.negotiate(c.peerConn.RemoteDescription().SDP, true); err != nil {
 			return err
 		}
-		wuecoSDP := rtpengine.LocalSDP(content)
-		sipMsg.content =wuecoSDP
+		// the browser answered in the reliable 18x
+		sipMsg.header.Del("content-type")
+		sipMsg.content = ""
+	case sipMsg.response != nil && isOfferMethod(sipMsg.CSeqMethod()) && c.answers(cseqOf(sipMsg)):
+		code := sipMsg.response.StatusCode
+		pending := c.peerConn.SignalingState() == webrtc.SignalingStateHaveRemoteOffer
+		switch {
+		case code == 100:
+			return nil
+		case code >= 300:
+			if pending {
+				return rollbackOffer(c.peerConn)
+			}
+			return nil
+		}
+		// the SDP of a 2xx after the early media of a 183 is the same
+		// answer or the answer of other fork
+		if hasSDP(sipMsg) {
+			if err := c.rtpengine.SetSIPSDP(string(sipMsg.content)); err != nil {
+				return err
+			}
+			if pending {
+				browserSDP := c.peerConn.RemoteDescription().SDP
+				if err := c.negotiate(browserSDP, true); err != nil {
+					return err
+				}
+				browserCodecs, err := rtpproxy.ParseCodecs(browserSDP)
+				if err != nil {
+					return err
+				}
+				if err := c.preferCodecs(c.rtpengine.SIPCodecs(), browserCodecs); err != nil {
+					return err
+				}
+			}
+			if err := answerBrowser(c); err != nil {
+				return err
+			}
+			sipMsg.header.Set("content-type", "application/sdp")
+			sipMsg.content = c.offer.SDP
+		} else if pending && sipMsg.response.IsSuccess() {
+			return errNoAnswer
+		}
 	}
 
 	return nil
 }
 
-func proxyRTPSIPToWS(peerConn *webrtc.PeerConnection, sipMsg *sipMessage, rtpengine *rtpproxy.RTPProxy, offer *webrtc.SessionDescription) error {
-	if sipMsg.IsMethod("INVITE") && sipMsg.header.Get("content-disposition") == "session" {
-		loffer, err := peerConn.CreateOffer(nil)
-		if err != nil {
-			return err
+// rollbackOffer returns to stable when the other side rejects the
+// pending offer, pion has no rollback so the offer is completed by the
+// current description of the browser or by an answer never sent.
+func rollbackOffer(pc *webrtc.PeerConnection) error {
+	switch pc.SignalingState() {
+	case webrtc.SignalingStateHaveLocalOffer:
+		current := pc.CurrentRemoteDescription()
+		if current == nil {
+			// the call ends with the rejected initial offer
+			return nil
 		}
-		if err := peerConn.SetLocalDescription(loffer); err != nil {
+		return pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: current.SDP})
+	case webrtc.SignalingStateHaveRemoteOffer:
+		answer, err := pc.CreateAnswer(nil)
+		if err != nil {
 			return err
 		}
-		*offer = loffer
-
-		rtpengine.SetSIPSDP(string(sipMsg.content))
-		
-		//ofrecemos al navegador el sdp de wueco
-		sipMsg.content = (*offer).SDP
-	} else if sipMsg.IsStatus("200") && sipMsg.header.Get("content-type") == "application/sdp" {
-		rtpengine.SetSIPSDP(string(sipMsg.content))
-		sipMsg.content = (*offer).SDP
+		return pc.SetLocalDescription(answer)
 	}
-
 	return nil
-
 }
 
-func proxyRTCP(ctx context.Context, rtpengine *rtpproxy.RTPProxy, pc *webrtc.PeerConnection, track *webrtc.TrackLocalStaticRTP) {
-	if track == nil {
-		panic("expected track")
-		return
+// answerBrowser answers the offer of the browser once the SIP side has
+// answered, a 2xx after a 183 with SDP reuses the answer.
+func answerBrowser(c *call) error {
+	if c.peerConn.SignalingState() != webrtc.SignalingStateHaveRemoteOffer {
+		return nil
+	}
+	answer, err := c.peerConn.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(c.peerConn)
+	if err := c.peerConn.SetLocalDescription(answer); err != nil {
+		return err
 	}
-	_, err := pc.AddTrack(track)
+	select {
+	case <-gathered:
+	case <-time.After(iceGatheringTimeout):
+		log.Printf("[ERR] call %s: ICE gathering timeout\n", c.id)
+	}
+	*c.offer = *c.peerConn.LocalDescription()
+	return nil
+}
+
+func proxyRTCP(ctx context.Context, rtpengine *rtpproxy.RTPProxy, pc *webrtc.PeerConnection, track webrtc.TrackLocal) (*webrtc.RTPSender, error) {
+	sender, err := pc.AddTrack(track)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	go rtpengine.ReadRTCP(ctx, pc)
+	return sender, nil
+}
+
+func headerForm(name string) sipproto.HeaderForm {
+	switch name {
+	case "long":
+		return sipproto.FormLong
+	case "compact":
+		return sipproto.FormCompact
+	}
+	return sipproto.FormAsRead
 }
 
 func itoa(s int) string {
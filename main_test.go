@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const pbxSDP = "v=0\r\no=- 1 1 IN IP4 192.0.2.4\r\ns=-\r\nc=IN IP4 192.0.2.4\r\nt=0 0\r\nm=audio 49170 RTP/AVP 0\r\na=rtpmap:0 PCMU/8000\r\n"
+
+func withSDP(t *testing.T, pdu, sdp string) *sipMessage {
+	sipMsg := readSIPMessage(t, pdu)
+	sipMsg.header.Set("Content-Type", "application/sdp")
+	sipMsg.content = sdp
+	return sipMsg
+}
+
+func browserAnswer(t *testing.T, browser *webrtc.PeerConnection, offer string) string {
+	if err := browser.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := browser.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(browser)
+	if err := browser.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return browser.LocalDescription().SDP
+}
+
+func TestReInviteOfferAnswer(t *testing.T) {
+	c, err := newCall(dialogID{CallID: "d17e", RemoteTag: "pbx"}, true, func(*call) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	browser, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer browser.Close()
+
+	invite := withSDP(t, `INVITE sip:alice@df7jal23ls0d.invalid;transport=ws SIP/2.0
+To: <sip:alice@atlanta.com>
+From: <sip:bob@biloxi.com>;tag=pbx
+Call-ID: d17e
+CSeq: 1 INVITE
+Content-Length: 0
+
+`, pbxSDP)
+	if err := proxyRTPSIPToWS(c, invite); err != nil {
+		t.Fatal(err)
+	}
+	ok := withSDP(t, `SIP/2.0 200 OK
+To: <sip:alice@atlanta.com>;tag=ws
+From: <sip:bob@biloxi.com>;tag=pbx
+Call-ID: d17e
+CSeq: 1 INVITE
+Content-Length: 0
+
+`, browserAnswer(t, browser, invite.content))
+	if err := proxyRTPWSToSIP(c, ok); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ok.content, " RTP/AVP ") {
+		t.Errorf("expected RTP/AVP answer for SIP got %s", ok.content)
+	}
+
+	// hold of the SIP side
+	hold := withSDP(t, `INVITE sip:alice@df7jal23ls0d.invalid;transport=ws SIP/2.0
+To: <sip:alice@atlanta.com>;tag=ws
+From: <sip:bob@biloxi.com>;tag=pbx
+Call-ID: d17e
+CSeq: 2 INVITE
+Content-Length: 0
+
+`, strings.Replace(pbxSDP, "49170", "49180", 1)+"a=sendonly\r\n")
+	if err := proxyRTPSIPToWS(c, hold); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(hold.content, "a=sendonly\r\n") || strings.Contains(hold.content, "a=sendrecv") {
+		t.Errorf("expected hold offer for the browser got %s", hold.content)
+	}
+	if c.rtpengine.SIPDirection() != "sendonly" {
+		t.Errorf("expected SIP direction sendonly got %s", c.rtpengine.SIPDirection())
+	}
+
+	// glare with the offer of the browser
+	reinvite := withSDP(t, `INVITE sip:bob@192.0.2.4 SIP/2.0
+To: <sip:bob@biloxi.com>;tag=pbx
+From: <sip:alice@atlanta.com>;tag=ws
+Call-ID: d17e
+CSeq: 10 INVITE
+Content-Length: 0
+
+`, invite.content)
+	if err := proxyRTPWSToSIP(c, reinvite); !errors.Is(err, errGlare) {
+		t.Fatalf("expected glare got %v", err)
+	}
+	if status := offerStatus(errGlare); status.code != 491 {
+		t.Errorf("expected 491 got %d", status.code)
+	}
+	pending := readSIPMessage(t, `SIP/2.0 491 Request Pending
+To: <sip:alice@atlanta.com>;tag=ws
+From: <sip:bob@biloxi.com>;tag=pbx
+Call-ID: d17e
+CSeq: 2 INVITE
+Content-Length: 0
+
+`)
+	if err := proxyRTPWSToSIP(c, pending); err != nil {
+		t.Fatal(err)
+	}
+	if state := c.peerConn.SignalingState(); state != webrtc.SignalingStateStable {
+		t.Fatalf("expected offer rolled back got %s", state)
+	}
+
+	// offer of the browser answered by the SIP side
+	offer, err := browser.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := browser.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	reinvite.content = offer.SDP
+	if err := proxyRTPWSToSIP(c, reinvite); err != nil {
+		t.Fatal(err)
+	}
+	answered := withSDP(t, `SIP/2.0 200 OK
+To: <sip:bob@biloxi.com>;tag=pbx
+From: <sip:alice@atlanta.com>;tag=ws
+Call-ID: d17e
+CSeq: 10 INVITE
+Content-Length: 0
+
+`, pbxSDP)
+	if err := proxyRTPSIPToWS(c, answered); err != nil {
+		t.Fatal(err)
+	}
+	if err := browser.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answered.content}); err != nil {
+		t.Errorf("browser rejects the answer: %s", err)
+	}
+	if c.rtpengine.SIPDirection() != "sendrecv" {
+		t.Errorf("expected SIP direction sendrecv got %s", c.rtpengine.SIPDirection())
+	}
+}
+
+func TestEarlyMedia(t *testing.T) {
+	c, err := newCall(dialogID{CallID: "e18x", LocalTag: "ws"}, false, func(*call) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	browser, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer browser.Close()
+	if _, err := browser.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := browser.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := browser.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+
+	invite := withSDP(t, `INVITE sip:bob@biloxi.com SIP/2.0
+To: <sip:bob@biloxi.com>
+From: <sip:alice@atlanta.com>;tag=ws
+Call-ID: e18x
+CSeq: 1 INVITE
+Supported: 100rel
+Content-Length: 0
+
+`, offer.SDP)
+	if err := proxyRTPWSToSIP(c, invite); err != nil {
+		t.Fatal(err)
+	}
+
+	progress := withSDP(t, `SIP/2.0 183 Session Progress
+To: <sip:bob@biloxi.com>;tag=pbx
+From: <sip:alice@atlanta.com>;tag=ws
+Call-ID: e18x
+CSeq: 1 INVITE
+Require: 100rel
+RSeq: 1
+Content-Length: 0
+
+`, pbxSDP)
+	if err := proxyRTPSIPToWS(c, progress); err != nil {
+		t.Fatal(err)
+	}
+	if err := browser.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: progress.content}); err != nil {
+		t.Fatalf("browser rejects the early answer: %s", err)
+	}
+
+	// the 2xx repeats the answer of the 183
+	ok := withSDP(t, `SIP/2.0 200 OK
+To: <sip:bob@biloxi.com>;tag=pbx
+From: <sip:alice@atlanta.com>;tag=ws
+Call-ID: e18x
+CSeq: 1 INVITE
+Content-Length: 0
+
+`, pbxSDP)
+	if err := proxyRTPSIPToWS(c, ok); err != nil {
+		t.Fatal(err)
+	}
+	if ok.content != progress.content {
+		t.Errorf("expected the answer of the 183 in the 200 got %s", ok.content)
+	}
+	if state := c.peerConn.SignalingState(); state != webrtc.SignalingStateStable {
+		t.Errorf("expected stable got %s", state)
+	}
+}
+
+func TestEarlyMediaTrackOfSIPCodec(t *testing.T) {
+	c, err := newCall(dialogID{CallID: "e18xpcmu", LocalTag: "ws"}, false, func(*call) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	browser, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer browser.Close()
+	// a browser that sends already in the codec of the SIP side
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, "audio", "browser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := browser.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := browser.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := browser.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+
+	invite := withSDP(t, `INVITE sip:bob@biloxi.com SIP/2.0
+To: <sip:bob@biloxi.com>
+From: <sip:alice@atlanta.com>;tag=ws
+Call-ID: e18xpcmu
+CSeq: 1 INVITE
+Content-Length: 0
+
+`, offer.SDP)
+	if err := proxyRTPWSToSIP(c, invite); err != nil {
+		t.Fatal(err)
+	}
+	progress := withSDP(t, `SIP/2.0 183 Session Progress
+To: <sip:bob@biloxi.com>;tag=pbx
+From: <sip:alice@atlanta.com>;tag=ws
+Call-ID: e18xpcmu
+CSeq: 1 INVITE
+Content-Length: 0
+
+`, pbxSDP)
+	if err := proxyRTPSIPToWS(c, progress); err != nil {
+		t.Fatal(err)
+	}
+	// the codec of the SIP side is the first one of the answer
+	if !strings.Contains(progress.content, "m=audio 9 UDP/TLS/RTP/SAVPF 0 ") {
+		t.Errorf("expected PCMU first in the answer for the browser got %s", progress.content)
+	}
+	if err := browser.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: progress.content}); err != nil {
+		t.Fatalf("browser rejects the early answer: %s", err)
+	}
+	if c.audioTrack.Codec().MimeType != webrtc.MimeTypePCMU {
+		t.Errorf("expected the track for the browser in PCMU got %s", c.audioTrack.Codec().MimeType)
+	}
+}
+
+func TestReliableOfferAnsweredInPRACK(t *testing.T) {
+	c, err := newCall(dialogID{CallID: "p262", RemoteTag: "pbx"}, true, func(*call) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	browser, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer browser.Close()
+
+	// INVITE without offer of the SIP side
+	invite := readSIPMessage(t, `INVITE sip:alice@df7jal23ls0d.invalid;transport=ws SIP/2.0
+To: <sip:alice@atlanta.com>
+From: <sip:bob@biloxi.com>;tag=pbx
+Call-ID: p262
+CSeq: 1 INVITE
+Supported: 100rel
+Content-Length: 0
+
+`)
+	if err := proxyRTPSIPToWS(c, invite); err != nil {
+		t.Fatal(err)
+	}
+	progress := withSDP(t, `SIP/2.0 183 Session Progress
+To: <sip:alice@atlanta.com>;tag=ws
+From: <sip:bob@biloxi.com>;tag=pbx
+Call-ID: p262
+CSeq: 1 INVITE
+Require: 100rel
+RSeq: 7
+Content-Length: 0
+
+`, browserAnswer(t, browser, invite.content))
+	if err := proxyRTPWSToSIP(c, progress); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(progress.content, " RTP/AVP ") {
+		t.Errorf("expected RTP/AVP offer for SIP got %s", progress.content)
+	}
+
+	prackHeader := `PRACK sip:alice@df7jal23ls0d.invalid;transport=ws SIP/2.0
+To: <sip:alice@atlanta.com>;tag=ws
+From: <sip:bob@biloxi.com>;tag=pbx
+Call-ID: p262
+CSeq: 2 PRACK
+RAck: %s
+Content-Length: 0
+
+`
+	other := withSDP(t, strings.Replace(prackHeader, "%s", "8 1 INVITE", 1), pbxSDP)
+	if err := proxyRTPSIPToWS(c, other); !errors.Is(err, errPRACKOffer) {
+		t.Errorf("expected errPRACKOffer got %v", err)
+	}
+	prack := withSDP(t, strings.Replace(prackHeader, "%s", "7 1 INVITE", 1), pbxSDP)
+	if err := proxyRTPSIPToWS(c, prack); err != nil {
+		t.Fatal(err)
+	}
+	if prack.content != "" || prack.header.Has("content-type") {
+		t.Errorf("expected the answer of the PRACK kept by wueco got %q", prack.content)
+	}
+	if c.rtpengine.SIPDirection() != "sendrecv" {
+		t.Errorf("expected SIP direction sendrecv got %s", c.rtpengine.SIPDirection())
+	}
+}
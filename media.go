@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"bit4bit.in/wueco/rtpproxy"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// the audio codecs relayed between the browser and the SIP side without
+// transcoding, the first one is the codec of the calls before the
+// offer/answer
+var webrtcCodecs = []webrtc.RTPCodecParameters{
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+		PayloadType:        111,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000},
+		PayloadType:        0,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000},
+		PayloadType:        8,
+	},
+	{
+		// G.722 samples at 16000 but its RTP clock is 8000 RFC 3551 section 4.5.2
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeG722, ClockRate: 8000},
+		PayloadType:        9,
+	},
+	// DTMF RFC 4733 with the clock of the codecs of the call
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeTelephoneEvent, ClockRate: 48000},
+		PayloadType:        110,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeTelephoneEvent, ClockRate: 8000},
+		PayloadType:        101,
+	},
+}
+
+const mimeTypeTelephoneEvent = "audio/telephone-event"
+
+var errNoCommonCodec = errors.New("no common codec between the browser and the SIP side")
+
+var webrtcAPI = func() *webrtc.API {
+	api, err := newAPI()
+	if err != nil {
+		panic(err)
+	}
+	return api
+}()
+
+// newAPI builds the API of the PeerConnections with the audio codecs
+// of webrtcCodecs and the default interceptors of pion.
+func newAPI() (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	for _, codec := range webrtcCodecs {
+		if err := mediaEngine.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, err
+		}
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry)), nil
+}
+
+// supportedCodecs returns the codecs of codecs that WebRTC relays.
+func supportedCodecs(codecs []rtpproxy.Codec) []rtpproxy.Codec {
+	return rtpproxy.Intersect(codecs, relayCodecs())
+}
+
+// webrtcCodec returns the parameters of WebRTC for codec.
+func webrtcCodec(codec rtpproxy.Codec) (webrtc.RTPCodecParameters, bool) {
+	for _, candidate := range webrtcCodecs {
+		if codec.Is(rtpproxy.NewCodec(uint8(candidate.PayloadType), candidate.RTPCodecCapability)) {
+			return candidate, true
+		}
+	}
+	return webrtc.RTPCodecParameters{}, false
+}
+
+// preferCodecs restricts the codecs of the offers for the browser to the
+// codecs of the SIP side and the G.711 transcoded to them, with -dtmf-info
+// the browser always gets the telephone-events. An answer lists them first
+// and then the other codecs relayed of the offer of the browser, nil for
+// an offer, the browser may have started its track with one of them and
+// it rejects an answer without that codec.
+func (c *call) preferCodecs(sipCodecs, browserCodecs []rtpproxy.Codec) error {
+	codecs := supportedCodecs(sipCodecs)
+	if len(audioCodecs(codecs)) == 0 {
+		return errNoCommonCodec
+	}
+	codecs = append(audioCodecs(codecs), append(rtpproxy.Transcoded(codecs), eventCodecs(codecs)...)...)
+	if *dtmfInfo {
+		codecs = append(audioCodecs(codecs), eventCodecs(relayCodecs())...)
+	}
+	for _, codec := range supportedCodecs(browserCodecs) {
+		if len(rtpproxy.Intersect([]rtpproxy.Codec{codec}, codecs)) == 0 {
+			codecs = append(codecs, codec)
+		}
+	}
+	preferences := make([]webrtc.RTPCodecParameters, 0)
+	for _, codec := range codecs {
+		if parameters, ok := webrtcCodec(codec); ok {
+			preferences = append(preferences, parameters)
+		}
+	}
+	for _, transceiver := range c.peerConn.GetTransceivers() {
+		if transceiver.Kind() != webrtc.RTPCodecTypeAudio {
+			continue
+		}
+		if err := transceiver.SetCodecPreferences(preferences); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// negotiate selects the codec of the call from the SDP of the browser
+// and the last SDP of the SIP side, the choice of the side that answered
+// wins. Without a common codec the G.711 of each side are transcoded.
+// The RTP of each side gets the payload types of the other side and the
+// track for the browser is built for the codec of the browser.
+func (c *call) negotiate(browserSDP string, sipAnswered bool) error {
+	announced, err := rtpproxy.ParseCodecs(browserSDP)
+	if err != nil {
+		return err
+	}
+	c.negotiated(announced)
+	browserCodecs := audioCodecs(supportedCodecs(announced))
+	sipCodecs := c.rtpengine.SIPCodecs()
+
+	chosen := rtpproxy.Intersect(browserCodecs, sipCodecs)
+	if sipAnswered {
+		chosen = rtpproxy.Intersect(sipCodecs, browserCodecs)
+	}
+	sipCodec := rtpproxy.Codec{}
+	if len(chosen) > 0 {
+		sipCodec = rtpproxy.Intersect(sipCodecs, chosen[:1])[0]
+	} else if transcoded := rtpproxy.Transcodable(sipCodecs, browserCodecs); len(transcoded) > 0 {
+		sipCodec = transcoded[0]
+	} else {
+		return errNoCommonCodec
+	}
+	c.rtpengine.SetCodec(sipCodec)
+	browserCodec, err := c.rtpengine.SelectBrowserCodec(browserCodecs)
+	if err != nil {
+		return err
+	}
+	event := rtpproxy.NewCodec(0, webrtc.RTPCodecCapability{MimeType: mimeTypeTelephoneEvent, ClockRate: sipCodec.ClockRate})
+	if events := rtpproxy.Intersect(announced, []rtpproxy.Codec{event}); len(events) > 0 {
+		c.rtpengine.SetEventCodec(events[0])
+	}
+	return c.setTrackCodec(browserCodec)
+}
+
+// answerCodec selects the codec of the answer of the browser, when the
+// SIP side has not offered yet the codec of the browser is used until
+// the SIP side answers.
+func (c *call) answerCodec(browserSDP string) error {
+	if !c.waitsSIPAnswer() {
+		return c.negotiate(browserSDP, false)
+	}
+	codecs, err := rtpproxy.ParseCodecs(browserSDP)
+	if err != nil {
+		return err
+	}
+	if codecs = audioCodecs(supportedCodecs(codecs)); len(codecs) == 0 {
+		return errNoCommonCodec
+	}
+	return c.setTrackCodec(codecs[0])
+}
+
+// relayCodecs are the codecs of webrtcCodecs for the RTPProxy.
+func relayCodecs() []rtpproxy.Codec {
+	codecs := make([]rtpproxy.Codec, 0, len(webrtcCodecs))
+	for _, codec := range webrtcCodecs {
+		codecs = append(codecs, rtpproxy.NewCodec(uint8(codec.PayloadType), codec.RTPCodecCapability))
+	}
+	return codecs
+}
+
+// sipRelayCodecs are the codecs announced to the SIP side, with
+// -dtmf-info the SIP side gets no telephone-event.
+func sipRelayCodecs() []rtpproxy.Codec {
+	if !*dtmfInfo {
+		return relayCodecs()
+	}
+	return audioCodecs(relayCodecs())
+}
+
+// audioCodecs returns the codecs without the telephone-events.
+func audioCodecs(codecs []rtpproxy.Codec) []rtpproxy.Codec {
+	out := make([]rtpproxy.Codec, 0, len(codecs))
+	for _, codec := range codecs {
+		if !codec.IsTelephoneEvent() {
+			out = append(out, codec)
+		}
+	}
+	return out
+}
+
+// eventCodecs returns the telephone-events of codecs.
+func eventCodecs(codecs []rtpproxy.Codec) []rtpproxy.Codec {
+	out := make([]rtpproxy.Codec, 0)
+	for _, codec := range codecs {
+		if codec.IsTelephoneEvent() {
+			out = append(out, codec)
+		}
+	}
+	return out
+}
+
+// setTrackCodec replaces the track for the browser when the codec changes.
+func (c *call) setTrackCodec(codec rtpproxy.Codec) error {
+	parameters, ok := webrtcCodec(codec)
+	if !ok {
+		return errNoCommonCodec
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if strings.EqualFold(c.audioTrack.Codec().MimeType, parameters.MimeType) {
+		return nil
+	}
+	track, err := newPayloadTrack(parameters.RTPCodecCapability)
+	if err != nil {
+		return err
+	}
+	if err := c.sender.ReplaceTrack(track); err != nil {
+		return err
+	}
+	c.audioTrack = track
+	return nil
+}
+
+// negotiated sets the payload types of both sides for the RTPProxy.
+func (c *call) negotiated(browserCodecs []rtpproxy.Codec) {
+	toSIP, toBrowser := rtpproxy.MapPayloadTypes(browserCodecs, c.rtpengine.SIPCodecs())
+	c.rtpengine.SetPayloadTypes(toSIP, toBrowser)
+}
+
+// Write sends the RTP of the SIP side to the current track for the browser.
+func (c *call) Write(rtp []byte) (int, error) {
+	c.mu.Lock()
+	track := c.audioTrack
+	c.mu.Unlock()
+	return track.Write(rtp)
+}
+
+// payloadTrack is a TrackLocalStaticRTP that keeps the payload type of
+// the packets, the RTPProxy maps them to the payload types of the browser.
+type payloadTrack struct {
+	*webrtc.TrackLocalStaticRTP
+
+	mu       sync.RWMutex
+	bindings map[string]payloadBinding
+}
+
+type payloadBinding struct {
+	ssrc   webrtc.SSRC
+	stream webrtc.TrackLocalWriter
+}
+
+func newPayloadTrack(capability webrtc.RTPCodecCapability) (*payloadTrack, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(capability, "audio", "wueco")
+	if err != nil {
+		return nil, err
+	}
+	return &payloadTrack{TrackLocalStaticRTP: track, bindings: make(map[string]payloadBinding)}, nil
+}
+
+func (t *payloadTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := t.TrackLocalStaticRTP.Bind(ctx)
+	if err != nil {
+		return codec, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bindings[ctx.ID()] = payloadBinding{ssrc: ctx.SSRC(), stream: ctx.WriteStream()}
+	return codec, nil
+}
+
+func (t *payloadTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.mu.Lock()
+	delete(t.bindings, ctx.ID())
+	t.mu.Unlock()
+	return t.TrackLocalStaticRTP.Unbind(ctx)
+}
+
+// Write sends a RTP packet with its payload type.
+func (t *payloadTrack) Write(b []byte) (int, error) {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, binding := range t.bindings {
+		packet.SSRC = uint32(binding.ssrc)
+		if _, err := binding.stream.WriteRTP(&packet.Header, packet.Payload); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestNegotiateG711(t *testing.T) {
+	c, err := newCall(dialogID{CallID: "g711", RemoteTag: "pbx"}, true, func(*call) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	browser, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer browser.Close()
+
+	// a G.711 trunk that prefers PCMA
+	trunkSDP := strings.Replace(pbxSDP, "RTP/AVP 0\r\na=rtpmap:0 PCMU/8000", "RTP/AVP 8 0 18\r\na=rtpmap:8 PCMA/8000\r\na=rtpmap:0 PCMU/8000\r\na=rtpmap:18 G729/8000", 1)
+	invite := withSDP(t, `INVITE sip:alice@df7jal23ls0d.invalid;transport=ws SIP/2.0
+To: <sip:alice@atlanta.com>
+From: <sip:bob@biloxi.com>;tag=pbx
+Call-ID: g711
+CSeq: 1 INVITE
+Content-Length: 0
+
+`, trunkSDP)
+	if err := proxyRTPSIPToWS(c, invite); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(invite.content, "opus") || !strings.Contains(invite.content, "PCMA/8000") {
+		t.Errorf("expected the offer for the browser restricted to G.711 got %s", invite.content)
+	}
+
+	ok := withSDP(t, `SIP/2.0 200 OK
+To: <sip:alice@atlanta.com>;tag=ws
+From: <sip:bob@biloxi.com>;tag=pbx
+Call-ID: g711
+CSeq: 1 INVITE
+Content-Length: 0
+
+`, browserAnswer(t, browser, invite.content))
+	if err := proxyRTPWSToSIP(c, ok); err != nil {
+		t.Fatal(err)
+	}
+	codec, negotiated := c.rtpengine.Codec()
+	if !negotiated || codec.Name != "PCMA" || codec.PayloadType != 8 {
+		t.Errorf("expected PCMA negotiated got %v", codec)
+	}
+	if c.audioTrack.Codec().MimeType != webrtc.MimeTypePCMA {
+		t.Errorf("expected the track for the browser in PCMA got %s", c.audioTrack.Codec().MimeType)
+	}
+	if !strings.Contains(ok.content, " RTP/AVP 8\r\n") {
+		t.Errorf("expected only PCMA in the answer for SIP got %s", ok.content)
+	}
+}
+
+func TestNegotiateTranscodesG711(t *testing.T) {
+	c, err := newCall(dialogID{CallID: "transcode", RemoteTag: "pbx"}, true, func(*call) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	// a browser with only PCMU
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000},
+		PayloadType:        0,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+	browser, err := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer browser.Close()
+
+	// a trunk with only PCMA
+	trunkSDP := strings.Replace(pbxSDP, "RTP/AVP 0\r\na=rtpmap:0 PCMU/8000", "RTP/AVP 8\r\na=rtpmap:8 PCMA/8000", 1)
+	invite := withSDP(t, `INVITE sip:alice@df7jal23ls0d.invalid;transport=ws SIP/2.0
+To: <sip:alice@atlanta.com>
+From: <sip:bob@biloxi.com>;tag=pbx
+Call-ID: transcode
+CSeq: 1 INVITE
+Content-Length: 0
+
+`, trunkSDP)
+	if err := proxyRTPSIPToWS(c, invite); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(invite.content, "PCMU/8000") {
+		t.Errorf("expected PCMU transcoded in the offer for the browser got %s", invite.content)
+	}
+
+	ok := withSDP(t, `SIP/2.0 200 OK
+To: <sip:alice@atlanta.com>;tag=ws
+From: <sip:bob@biloxi.com>;tag=pbx
+Call-ID: transcode
+CSeq: 1 INVITE
+Content-Length: 0
+
+`, browserAnswer(t, browser, invite.content))
+	if err := proxyRTPWSToSIP(c, ok); err != nil {
+		t.Fatal(err)
+	}
+	if codec, negotiated := c.rtpengine.Codec(); !negotiated || codec.Name != "PCMA" {
+		t.Errorf("expected PCMA negotiated with the SIP side got %v", codec)
+	}
+	if codec, transcoding := c.rtpengine.Transcoding(); !transcoding || codec.Name != "PCMU" {
+		t.Errorf("expected PCMU of the browser transcoded got %v", codec)
+	}
+	if c.audioTrack.Codec().MimeType != webrtc.MimeTypePCMU {
+		t.Errorf("expected the track for the browser in PCMU got %s", c.audioTrack.Codec().MimeType)
+	}
+	if !strings.Contains(ok.content, " RTP/AVP 8\r\n") || !strings.Contains(ok.content, "a=rtpmap:8 PCMA/8000\r\n") || strings.Contains(ok.content, "PCMU") {
+		t.Errorf("expected only PCMA in the answer for SIP got %s", ok.content)
+	}
+}
+
+// readRTP returns the packets of a capture with one RTP packet in hex per line.
+func readRTP(t *testing.T, name string) []*rtp.Packet {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := make([]*rtp.Packet, 0)
+	for _, line := range strings.Fields(string(data)) {
+		raw, err := hex.DecodeString(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(raw); err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+func TestG722EndToEnd(t *testing.T) {
+	// 200ms of a tone of 1kHz in G.722 from a SIP phone
+	recorded := readRTP(t, "testdata/g722.rtp")
+
+	pbx, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pbx.Close()
+	c, err := newCall(dialogID{CallID: "g722", RemoteTag: "pbx"}, true, func(*call) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	browser, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer browser.Close()
+	browserTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeG722, ClockRate: 8000}, "audio", "browser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := browser.AddTrack(browserTrack); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *rtp.Packet, 100)
+	browser.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if track.Codec().MimeType != webrtc.MimeTypeG722 {
+			t.Errorf("expected G.722 for the browser got %s", track.Codec().MimeType)
+		}
+		for {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			received <- packet
+		}
+	})
+	connected := make(chan struct{})
+	browser.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+
+	// the phone announces the sampling rate of G.722
+	pbxPort := pbx.LocalAddr().(*net.UDPAddr).Port
+	phoneSDP := fmt.Sprintf("v=0\r\no=- 1 1 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\nm=audio %d RTP/AVP 9\r\na=rtpmap:9 G722/16000\r\n", pbxPort)
+	invite := withSDP(t, `INVITE sip:alice@df7jal23ls0d.invalid;transport=ws SIP/2.0
+To: <sip:alice@atlanta.com>
+From: <sip:bob@biloxi.com>;tag=pbx
+Call-ID: g722
+CSeq: 1 INVITE
+Content-Length: 0
+
+`, phoneSDP)
+	if err := proxyRTPSIPToWS(c, invite); err != nil {
+		t.Fatal(err)
+	}
+	ok := withSDP(t, `SIP/2.0 200 OK
+To: <sip:alice@atlanta.com>;tag=ws
+From: <sip:bob@biloxi.com>;tag=pbx
+Call-ID: g722
+CSeq: 1 INVITE
+Content-Length: 0
+
+`, browserAnswer(t, browser, invite.content))
+	if err := proxyRTPWSToSIP(c, ok); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{" RTP/AVP 9\r\n", "a=rtpmap:9 G722/8000\r\n"} {
+		if !strings.Contains(ok.content, expected) {
+			t.Errorf("expected %q in the answer for SIP got %s", expected, ok.content)
+		}
+	}
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the browser connected")
+	}
+
+	// WEBRTC -> SIP keeps the payload and gets the payload type of the
+	// phone, the first packets are lost until DTLS completes and the
+	// relay from SIP starts with the track of the browser
+	buf := make([]byte, 1500)
+	for i := 0; ; i++ {
+		if err := browserTrack.WriteRTP(recorded[i%len(recorded)]); err != nil {
+			t.Fatal(err)
+		}
+		pbx.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := pbx.ReadFrom(buf)
+		if err != nil {
+			if i > 50 {
+				t.Fatal("expected the G.722 of the browser in the phone")
+			}
+			continue
+		}
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if packet.PayloadType != 9 || !containsPayload(recorded, packet.Payload) {
+			t.Errorf("unexpected RTP for the phone pt=%d payload=%x", packet.PayloadType, packet.Payload)
+		}
+		break
+	}
+
+	// SIP -> WEBRTC
+	wueco := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.rtpengine.Port()}
+	var first *rtp.Packet
+	timeout := time.After(10 * time.Second)
+	for i := 0; first == nil; i++ {
+		raw, err := recorded[i%len(recorded)].Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pbx.WriteTo(raw, wueco); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case first = <-received:
+		case <-time.After(20 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("expected the G.722 of the phone in the browser")
+		}
+	}
+	if !containsPayload(recorded, first.Payload) {
+		t.Errorf("expected a recorded payload in the browser got %x", first.Payload)
+	}
+}
+
+func containsPayload(packets []*rtp.Packet, payload []byte) bool {
+	for _, packet := range packets {
+		if bytes.Equal(packet.Payload, payload) {
+			return true
+		}
+	}
+	return false
+}
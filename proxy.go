@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+
+	"bit4bit.in/wueco/sipproto"
+)
+
+// the vias of wueco are recognised by the branch prefix
+const branchPrefix = sipproto.BranchMagicCookie + "wueco"
+
+var branchSecret = func() []byte {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}()
+
+// proxyBranch computes the branch for a forwarded request, the
+// retransmissions, the CANCEL and the ACK of a non-2xx get the same
+// branch as the request RFC 3261 section 16.11. The branch carries
+// the flow token for routing the responses to the websocket.
+func (c sipMessage) proxyBranch(flow string) string {
+	hash := sha1.New()
+	hash.Write(branchSecret)
+	if via, err := c.header.TopVia(); err == nil && strings.HasPrefix(via.Branch(), sipproto.BranchMagicCookie) {
+		hash.Write([]byte(via.Branch()))
+		hash.Write([]byte(via.SentBy()))
+		// a request retried with credentials is a new transaction
+		if cseq, err := sipproto.ParseCSeq(c.header.Get("cseq")); err == nil {
+			hash.Write([]byte(strconv.FormatUint(uint64(cseq.Seq), 10)))
+		}
+	} else {
+		// RFC 2543 requests
+		for _, name := range []string{"call-id", "to", "from", "cseq"} {
+			hash.Write([]byte(c.header.Get(name)))
+		}
+		if c.request != nil {
+			hash.Write([]byte(c.request.RequestURI.String()))
+		}
+	}
+	return branchPrefix + flow + "." + hex.EncodeToString(hash.Sum(nil)[:10])
+}
+
+// branchFlow returns the flow token of a branch of wueco.
+func branchFlow(branch string) (string, bool) {
+	if !strings.HasPrefix(branch, branchPrefix) {
+		return "", false
+	}
+	flow, _, ok := strings.Cut(strings.TrimPrefix(branch, branchPrefix), ".")
+	return flow, ok && flow != ""
+}
+
+// pushVia adds the via of wueco for a request of flow forwarded over transport.
+func (c *sipMessage) pushVia(flow, transport, sentBy string) {
+	via := &sipproto.Via{
+		Protocol:  "SIP/2.0",
+		Transport: transport,
+		Params: sipproto.Params{
+			{Name: "branch", Value: c.proxyBranch(flow)},
+			{Name: "rport"},
+		},
+	}
+	host, port, err := net.SplitHostPort(sentBy)
+	if err != nil {
+		via.Host = sentBy
+	} else {
+		via.Host = host
+		via.Port, _ = strconv.Atoi(port)
+	}
+	c.header.PushVia(via)
+}
+
+// popVia removes the top via of a response when it's a via
+// of wueco, other responses must not be forwarded.
+func (c *sipMessage) popVia() bool {
+	via, err := c.header.TopVia()
+	if err != nil || !strings.HasPrefix(via.Branch(), branchPrefix) {
+		return false
+	}
+	_, err = c.header.PopVia()
+	return err == nil
+}
+
+// stampVia adds received and rport to the top via of a request
+// arrived from source RFC 3261 section 18.2.1 and RFC 3581.
+func (c *sipMessage) stampVia(source string) {
+	via, err := c.header.TopVia()
+	if err != nil {
+		return
+	}
+	host, port, err := net.SplitHostPort(source)
+	if err != nil {
+		return
+	}
+	rport, hasRport := via.Params.Get("rport")
+	if via.Host != host || hasRport {
+		via.Params.Set("received", host)
+	}
+	if hasRport && rport == "" {
+		via.Params.Set("rport", port)
+	}
+	c.header.SetTopVia(via)
+}
+
+// the routes of wueco carry the flow token of the websocket
+// in the user part RFC 7118 section 5 and RFC 5626.
+const flowPrefix = "wueco-"
+
+func newFlowToken() string {
+	return randomHex(8)
+}
+
+func randomHex(n int) string {
+	token := make([]byte, n)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
+// flowToken returns the token when uri is a route of wueco.
+func flowToken(uri *sipproto.URI) (string, bool) {
+	if uri == nil || !strings.HasPrefix(uri.User, flowPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(uri.User, flowPrefix), true
+}
+
+// isDialogCreating is true for the initial requests that can
+// establish a dialog.
+func (c sipMessage) isDialogCreating() bool {
+	if c.request == nil {
+		return false
+	}
+	switch c.request.Method {
+	case "INVITE", "SUBSCRIBE", "REFER":
+	default:
+		return false
+	}
+	to, err := c.address("to")
+	return err == nil && to.Tag() == ""
+}
+
+// recordRoute adds wueco to the route set of the dialog, sentBy
+// is the address where the SIP server reaches wueco.
+func (c *sipMessage) recordRoute(token, transport, sentBy string) {
+	if !c.isDialogCreating() {
+		return
+	}
+	uri := &sipproto.URI{
+		Scheme: "sip",
+		User:   flowPrefix + token,
+		Params: sipproto.Params{
+			{Name: "transport", Value: strings.ToLower(transport)},
+			{Name: "lr"},
+		},
+	}
+	host, port, err := net.SplitHostPort(sentBy)
+	if err != nil {
+		uri.Host = sentBy
+	} else {
+		uri.Host = host
+		uri.Port, _ = strconv.Atoi(port)
+	}
+	c.header.Insert("Record-Route", (&sipproto.Address{URI: uri}).String())
+}
+
+// flow returns the flow token of the Request-URI or of the
+// top route without removing them.
+func (c sipMessage) flow() (string, bool) {
+	if c.request == nil {
+		return "", false
+	}
+	if token, ok := flowToken(c.request.RequestURI); ok {
+		return token, true
+	}
+	routes, err := c.header.Addresses("route")
+	if err != nil || len(routes) == 0 {
+		return "", false
+	}
+	return flowToken(routes[0].URI)
+}
+
+// popRoutes removes the routes of wueco at the top of Route and
+// returns the flow token, a Request-URI of wueco comes from a
+// strict router and it's replaced by the last route RFC 3261 section 16.4.
+func (c *sipMessage) popRoutes() (string, bool) {
+	if c.request == nil {
+		return "", false
+	}
+	routes, err := c.header.Addresses("route")
+	if err != nil {
+		return "", false
+	}
+
+	token, found := flowToken(c.request.RequestURI)
+	if found && len(routes) > 0 {
+		c.request.RequestURI = routes[len(routes)-1].URI
+		routes = routes[:len(routes)-1]
+	}
+	for len(routes) > 0 {
+		routeToken, ok := flowToken(routes[0].URI)
+		if !ok {
+			break
+		}
+		if !found {
+			token, found = routeToken, true
+		}
+		routes = routes[1:]
+	}
+	c.header.SetAddresses("route", routes)
+	return token, found
+}
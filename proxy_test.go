@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"bit4bit.in/wueco/sipproto"
+)
+
+func readSIPMessage(t *testing.T, pdu string) *sipMessage {
+	msg, err := sipproto.NewReader(bufio.NewReader(bytes.NewBufferString(pdu))).ReadMessage()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	sipMsg, _ := newSIPMessage(msg)
+	return sipMsg
+}
+
+func TestProxyVia(t *testing.T) {
+	invite := readSIPMessage(t, `INVITE sip:bob@biloxi.com SIP/2.0
+Via: SIP/2.0/WSS df7jal23ls0d.invalid;rport;branch=z9hG4bKnashds7
+To: Bob <sip:bob@biloxi.com>
+From: Alice <sip:alice@atlanta.com>;tag=1928301774
+Call-ID: a84b4c76e66710
+CSeq: 1 INVITE
+Content-Length: 0
+
+`)
+	invite.stampVia("192.0.2.4:53421")
+	invite.pushVia("f00d", "UDP", "10.0.0.1:5060")
+
+	vias, err := invite.header.Vias()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(vias) != 2 || vias[0].Transport != "UDP" || !strings.HasPrefix(vias[0].Branch(), branchPrefix) {
+		t.Fatalf("fails to push via got %v\n", invite.header)
+	}
+	if vias[1].String() != "SIP/2.0/WSS df7jal23ls0d.invalid;rport=53421;branch=z9hG4bKnashds7;received=192.0.2.4" {
+		t.Errorf("fails to stamp via got %s\n", vias[1])
+	}
+
+	cancel := readSIPMessage(t, `CANCEL sip:bob@biloxi.com SIP/2.0
+Via: SIP/2.0/WSS df7jal23ls0d.invalid;rport;branch=z9hG4bKnashds7
+Call-ID: a84b4c76e66710
+CSeq: 1 CANCEL
+Content-Length: 0
+
+`)
+	if cancel.proxyBranch("f00d") != vias[0].Branch() {
+		t.Errorf("CANCEL must reuse the branch of the INVITE")
+	}
+	if flow, ok := branchFlow(vias[0].Branch()); !ok || flow != "f00d" {
+		t.Errorf("fails to get flow of branch got %s", flow)
+	}
+
+	response := readSIPMessage(t, "SIP/2.0 180 Ringing\nVia: "+vias[0].String()+"\nVia: "+vias[1].String()+"\nCSeq: 1 INVITE\nContent-Length: 0\n\n")
+	if !response.popVia() {
+		t.Fatalf("fails to pop via of wueco")
+	}
+	if response.header.Get("via") != vias[1].String() {
+		t.Errorf("via of the browser must be kept got %v\n", response.header)
+	}
+	if response.popVia() {
+		t.Errorf("must not pop a via of other")
+	}
+}
+
+func TestRecordRouteAndRoute(t *testing.T) {
+	invite := readSIPMessage(t, `INVITE sip:bob@biloxi.com SIP/2.0
+Via: SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bKnashds7
+Record-Route: <sip:pbx.biloxi.com;lr>
+To: Bob <sip:bob@biloxi.com>
+From: Alice <sip:alice@atlanta.com>;tag=1928301774
+Call-ID: a84b4c76e66710
+CSeq: 1 INVITE
+Content-Length: 0
+
+`)
+	invite.recordRoute("abc", "TCP", "10.0.0.1:5060")
+	if rr := invite.header.Values("record-route"); len(rr) != 2 || rr[0] != "<sip:wueco-abc@10.0.0.1:5060;transport=tcp;lr>" {
+		t.Errorf("fails to record route got %v\n", rr)
+	}
+
+	bye := readSIPMessage(t, `BYE sip:alice@10.0.0.1:5060;transport=tcp SIP/2.0
+Via: SIP/2.0/TCP pbx.biloxi.com;branch=z9hG4bK77
+Route: <sip:wueco-abc@10.0.0.1:5060;transport=tcp;lr>
+To: Alice <sip:alice@atlanta.com>;tag=1928301774
+From: Bob <sip:bob@biloxi.com>;tag=a6c85cf
+Call-ID: a84b4c76e66710
+CSeq: 2 BYE
+Content-Length: 0
+
+`)
+	bye.recordRoute("abc", "TCP", "10.0.0.1:5060")
+	if bye.header.Has("record-route") {
+		t.Errorf("in-dialog requests must not be record routed")
+	}
+	token, ok := bye.popRoutes()
+	if !ok || token != "abc" {
+		t.Errorf("fails to get flow token got %s\n", token)
+	}
+	if bye.header.Has("route") {
+		t.Errorf("fails to pop route got %v\n", bye.header)
+	}
+
+	strict := readSIPMessage(t, `BYE sip:wueco-abc@10.0.0.1:5060;transport=tcp SIP/2.0
+Via: SIP/2.0/TCP pbx.biloxi.com;branch=z9hG4bK78
+Route: <sip:alice@df7jal23ls0d.invalid;transport=ws>
+CSeq: 3 BYE
+Content-Length: 0
+
+`)
+	token, ok = strict.popRoutes()
+	if !ok || token != "abc" || strict.request.RequestURI.String() != "sip:alice@df7jal23ls0d.invalid;transport=ws" {
+		t.Errorf("fails to handle strict router got %s %s\n", token, strict.request.RequestURI)
+	}
+}
+
+func TestDialogRequest(t *testing.T) {
+	ok := readSIPMessage(t, `SIP/2.0 200 OK
+Via: SIP/2.0/TCP 10.0.0.1:5060;branch=z9hG4bKwuecoabc.f00d;rport
+Record-Route: <sip:pbx2.biloxi.com;lr>
+Record-Route: <sip:pbx1.biloxi.com;lr>
+Record-Route: <sip:wueco-abc@10.0.0.1:5060;transport=tcp;lr>
+To: Bob <sip:bob@biloxi.com>;tag=a6c85cf
+From: Alice <sip:alice@atlanta.com>;tag=1928301774
+Call-ID: a84b4c76e66710
+CSeq: 314159 INVITE
+Contact: <sip:bob@192.0.2.4>
+Content-Length: 0
+
+`)
+	bye, err := ok.dialogRequest("BYE", 314160)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bye.request.String() != "BYE sip:bob@192.0.2.4 SIP/2.0" {
+		t.Errorf("unexpected request line %s", bye.request)
+	}
+	if routes := bye.header.Values("route"); len(routes) != 2 || routes[0] != "<sip:pbx1.biloxi.com;lr>" || routes[1] != "<sip:pbx2.biloxi.com;lr>" {
+		t.Errorf("unexpected route set %v", routes)
+	}
+	if bye.header.Get("cseq") != "314160 BYE" || bye.header.Get("to") != "Bob <sip:bob@biloxi.com>;tag=a6c85cf" || bye.header.Has("via") {
+		t.Errorf("unexpected header %v", bye.header)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"bit4bit.in/wueco/sipproto"
+	"bit4bit.in/wueco/transaction"
+)
+
+// the expiration when neither the SIP server nor the browser gives one
+const defaultExpires = 3600
+
+// binding is a registration of the browser on the SIP server RFC 3261
+// section 10, contact is the contact of wueco sent to the SIP server.
+type binding struct {
+	aor       string
+	contact   *sipproto.Address
+	callID    string
+	cseq      uint32
+	expires   int
+	expiresAt time.Time
+	// last REGISTER sent, the gateway builds the refreshes from it
+	request *sipproto.Message
+}
+
+func (b *binding) key() string {
+	return b.aor + " " + b.contact.URI.String()
+}
+
+// register builds a REGISTER of the binding with the next CSeq.
+func (b *binding) register(expires int) *sipMessage {
+	sipMsg, _ := newSIPMessage(b.request)
+	sipMsg.header.Del("via")
+	sipMsg.header.Del("authorization")
+	sipMsg.header.Del("proxy-authorization")
+	sipMsg.header.Set("Max-Forwards", "70")
+	sipMsg.header.Set("CSeq", sipproto.CSeq{Seq: b.cseq + 1, Method: "REGISTER"}.String())
+
+	contact := b.contact.Clone()
+	contact.Params.Set("expires", strconv.Itoa(expires))
+	sipMsg.header.Set("Contact", contact.String())
+	sipMsg.header.Set("Expires", strconv.Itoa(expires))
+	sipMsg.content = ""
+	return sipMsg
+}
+
+// registrations are the bindings of a websocket, onBind follows
+// the bindings added and removed.
+type registrations struct {
+	mu       sync.Mutex
+	bindings map[string]*binding
+	onBind   func(b *binding, bound bool)
+}
+
+func newRegistrations(onBind func(b *binding, bound bool)) *registrations {
+	return &registrations{bindings: make(map[string]*binding), onBind: onBind}
+}
+
+// update follows the bindings with the 2xx to a REGISTER sent to the SIP server.
+func (r *registrations) update(req, rsp *sipproto.Message) {
+	to, err := sipproto.ParseAddress(req.Header.Get("to"))
+	if err != nil || to.Wildcard {
+		return
+	}
+	aor := to.URI.String()
+	cseq, err := sipproto.ParseCSeq(rsp.Header.Get("cseq"))
+	if err != nil {
+		return
+	}
+	contacts, err := req.Header.Addresses("contact")
+	if err != nil {
+		return
+	}
+	granted, _ := rsp.Header.Addresses("contact")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, contact := range contacts {
+		if contact.Wildcard {
+			for key, b := range r.bindings {
+				if b.aor == aor {
+					delete(r.bindings, key)
+					r.bind(b, false)
+				}
+			}
+			continue
+		}
+		b := &binding{
+			aor:     aor,
+			contact: contact.Clone(),
+			callID:  req.Header.Get("call-id"),
+			cseq:    cseq.Seq,
+			request: req,
+		}
+		b.contact.Params.Del("expires")
+		b.expires = expiresOf(contact, granted, req.Header, rsp.Header)
+		if b.expires == 0 {
+			if _, ok := r.bindings[b.key()]; ok {
+				delete(r.bindings, b.key())
+				r.bind(b, false)
+			}
+			continue
+		}
+		b.expiresAt = time.Now().Add(time.Duration(b.expires) * time.Second)
+		r.bindings[b.key()] = b
+		r.bind(b, true)
+	}
+}
+
+// onBind follows the bindings of s in the location service, a refresh
+// in flight when the websocket closes doesn't bind the session again.
+func (s *session) onBind(b *binding, bound bool) {
+	if !bound {
+		s.upstream.location.unbind(b.aor, b.contact.URI.String(), s)
+		return
+	}
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	s.upstream.location.bind(b.aor, b.contact.URI.String(), s)
+}
+
+func (r *registrations) bind(b *binding, bound bool) {
+	if r.onBind != nil {
+		r.onBind(b, bound)
+	}
+}
+
+// expiresOf returns the expiration granted by the SIP server to contact
+// RFC 3261 section 10.2.4, else the one requested by the browser.
+func expiresOf(contact *sipproto.Address, granted []*sipproto.Address, req, rsp sipproto.Header) int {
+	for _, addr := range granted {
+		if addr.URI != nil && addr.URI.String() == contact.URI.String() {
+			if expires, ok := addr.Params.Get("expires"); ok {
+				if n, err := strconv.Atoi(expires); err == nil {
+					return n
+				}
+			}
+		}
+	}
+	for _, value := range []string{rsp.Get("expires"), contactExpires(contact), req.Get("expires")} {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return defaultExpires
+}
+
+func contactExpires(contact *sipproto.Address) string {
+	expires, _ := contact.Params.Get("expires")
+	return expires
+}
+
+func (r *registrations) list() []*binding {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bindings := make([]*binding, 0, len(r.bindings))
+	for _, b := range r.bindings {
+		bindings = append(bindings, b)
+	}
+	return bindings
+}
+
+func (r *registrations) get(key string) (*binding, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.bindings[key]
+	return b, ok
+}
+
+// release keeps the bindings of a closed websocket alive with
+// refreshes of the gateway until grace ends and then sends the
+// unREGISTER (Expires: 0) of every binding. The SIP server challenges
+// the REGISTER so the gateway needs the credentials of the web user,
+// without them the bindings expire on the SIP server.
+func (s *session) release(grace time.Duration) {
+	if s.auth == nil {
+		if len(s.registrations.list()) > 0 {
+			log.Printf("[ERR] flow %s without credentials, the bindings are kept until they expire\n", s.flow)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for _, b := range s.registrations.list() {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			s.keepBinding(key, time.Now().Add(grace))
+		}(b.key())
+	}
+	wg.Wait()
+}
+
+func (s *session) keepBinding(key string, until time.Time) {
+	for {
+		b, ok := s.registrations.get(key)
+		if !ok {
+			return
+		}
+		// refresh at the half of the expiration
+		refreshAt := b.expiresAt.Add(-time.Duration(b.expires) * time.Second / 2)
+		if !until.After(time.Now()) || !refreshAt.Before(until) {
+			break
+		}
+		time.Sleep(time.Until(refreshAt))
+		if !s.registerSIP(b, b.expires) {
+			log.Printf("[ERR] fails to refresh %s\n", key)
+			break
+		}
+	}
+	time.Sleep(time.Until(until))
+
+	b, ok := s.registrations.get(key)
+	if !ok {
+		return
+	}
+	// the binding is shared with other tab
+	if s.upstream.location.shared(b.aor, b.contact.URI.String(), s) {
+		return
+	}
+	if !s.registerSIP(b, 0) {
+		log.Printf("[ERR] fails to unregister %s\n", key)
+	}
+}
+
+// unregisterShared answers locally the unREGISTER of the browser
+// when other tab shares every binding, the SIP server keeps them.
+func (s *session) unregisterShared(sipMsg *sipMessage, srv *transaction.Server) bool {
+	if !sipMsg.IsMethod("REGISTER") {
+		return false
+	}
+	req := sipMsg.message()
+	to, err := sipproto.ParseAddress(req.Header.Get("to"))
+	if err != nil || to.Wildcard {
+		return false
+	}
+	contacts, err := req.Header.Addresses("contact")
+	if err != nil || len(contacts) == 0 {
+		return false
+	}
+	for _, contact := range contacts {
+		if contact.Wildcard || expiresOf(contact, nil, req.Header, sipproto.Header{}) != 0 ||
+			!s.upstream.location.shared(to.URI.String(), contact.URI.String(), s) {
+			return false
+		}
+	}
+
+	ok := sipproto.NewResponse(req, 200, "OK")
+	s.registrations.update(req, ok)
+	replyTo(srv, 200, "OK")
+	return true
+}
+
+// registerSIP sends a REGISTER of the gateway for the binding and
+// waits the final response.
+func (s *session) registerSIP(b *binding, expires int) bool {
+	sipConn, err := s.upstream.conn(s.flow)
+	if err != nil {
+		return false
+	}
+	sipMsg := b.register(expires)
+	sipMsg.form = headerForm(*sipHeaderForm)
+	sipMsg.pushVia(s.flow, sipConn.Transport(), sipConn.LocalAddr().String())
+
+	final := make(chan bool, 1)
+	err = s.requestSIP(sipMsg.message(), sipConn.Reliable(), false, transaction.ClientHandler{
+		Response: func(rsp *sipproto.Message) {
+			if rsp.Response.IsFinal() {
+				final <- rsp.Response.IsSuccess()
+			}
+		},
+		Timeout: func() {
+			final <- false
+		},
+	})
+	if err != nil {
+		return false
+	}
+	return <-final
+}
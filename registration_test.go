@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"bit4bit.in/wueco/digest"
+	"bit4bit.in/wueco/sipproto"
+	"bit4bit.in/wueco/transaction"
+	"bit4bit.in/wueco/transport"
+)
+
+func TestRegistrationsBindings(t *testing.T) {
+	register := readSIPMessage(t, `REGISTER sip:biloxi.com SIP/2.0
+Via: SIP/2.0/TCP 10.0.0.1:5060;branch=z9hG4bKwuecof00d.1;rport
+Via: SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bKnashds7
+To: Bob <sip:bob@biloxi.com>
+From: Bob <sip:bob@biloxi.com>;tag=456248
+Call-ID: 843817637684230@998sdasdh09
+CSeq: 1826 REGISTER
+Contact: <sip:bob@10.0.0.1:5060;transport=tcp>;expires=7200
+Authorization: Digest username="bob"
+Content-Length: 0
+
+`).message()
+	ok := sipproto.NewResponse(register, 200, "OK")
+	ok.Header.Add("Contact", "<sip:bob@10.0.0.1:5060;transport=tcp>;expires=3600")
+
+	bound := map[string]bool{}
+	r := newRegistrations(func(b *binding, ok bool) { bound[b.key()] = ok })
+	r.update(register, ok)
+	bindings := r.list()
+	if len(bindings) != 1 {
+		t.Fatalf("expected 1 binding got %d", len(bindings))
+	}
+	b := bindings[0]
+	if b.aor != "sip:bob@biloxi.com" || b.callID != "843817637684230@998sdasdh09" || b.cseq != 1826 || b.expires != 3600 {
+		t.Errorf("unexpected binding %+v", b)
+	}
+	if !bound["sip:bob@biloxi.com sip:bob@10.0.0.1:5060;transport=tcp"] {
+		t.Errorf("fails to bind got %v", bound)
+	}
+
+	unregister := b.register(0)
+	if unregister.header.Has("via") || unregister.header.Has("authorization") {
+		t.Errorf("unREGISTER must not keep via and credentials got %v", unregister.header)
+	}
+	if unregister.header.Get("cseq") != "1827 REGISTER" || unregister.header.Get("expires") != "0" ||
+		unregister.header.Get("contact") != "<sip:bob@10.0.0.1:5060;transport=tcp>;expires=0" {
+		t.Errorf("unexpected unREGISTER %v", unregister.header)
+	}
+	if unregister.header.Get("call-id") != b.callID || unregister.header.Get("from") != "Bob <sip:bob@biloxi.com>;tag=456248" {
+		t.Errorf("unREGISTER must keep the Call-ID and From got %v", unregister.header)
+	}
+
+	removed := unregister.message()
+	removed.Header.Add("Via", "SIP/2.0/TCP 10.0.0.1:5060;branch=z9hG4bKwuecof00d.2")
+	r.update(removed, sipproto.NewResponse(removed, 200, "OK"))
+	if len(r.list()) != 0 || bound[b.key()] {
+		t.Errorf("expected binding removed")
+	}
+}
+
+func TestCloseDuringRefresh(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	u := newUpstream(transport.Target{Transport: "tcp", Address: ln.Addr().String()}, 1)
+	u.probeInterval = time.Hour
+	u.start()
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(2 * time.Second))
+	pbx, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pbx.Close()
+	pbxReader := sipproto.NewReader(bufio.NewReader(pbx))
+
+	s := &session{
+		upstream: u,
+		layer:    transaction.NewLayer(transaction.WithTimers(5*time.Millisecond, 20*time.Millisecond, 20*time.Millisecond)),
+		flow:     "f00d",
+		dialogs:  newDialogs(),
+		done:     make(chan struct{}),
+		auth:     newAuthenticator(digest.NewMemoryStore(), "bob"),
+	}
+	s.registrations = newRegistrations(s.onBind)
+	u.attach(s)
+	register := readSIPMessage(t, `REGISTER sip:biloxi.com SIP/2.0
+To: <sip:bob@biloxi.com>
+From: <sip:bob@biloxi.com>;tag=456248
+Call-ID: 843817637684230@998sdasdh09
+CSeq: 1 REGISTER
+Contact: <sip:bob@10.0.0.1:5060;transport=tcp>
+Content-Length: 0
+
+`).message()
+	s.registrations.update(register, sipproto.NewResponse(register, 200, "OK"))
+	pbx.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// bound for any other session
+	bound := func() bool {
+		return u.location.shared("sip:bob@biloxi.com", "sip:bob@10.0.0.1:5060", &session{})
+	}
+	if !bound() {
+		t.Fatal("expected the session bound")
+	}
+
+	// the refresh of the browser is answered after the websocket closes
+	refreshWS := readSIPMessage(t, `REGISTER sip:biloxi.com SIP/2.0
+Via: SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bKnashds7
+To: <sip:bob@biloxi.com>
+From: <sip:bob@biloxi.com>;tag=456248
+Call-ID: 843817637684230@998sdasdh09
+CSeq: 2 REGISTER
+Contact: <sip:bob@10.0.0.1:5060;transport=tcp>
+Content-Length: 0
+
+`)
+	refreshWS.pushVia(s.flow, "TCP", "127.0.0.1:5060")
+	if err := s.requestSIP(refreshWS.message(), true, false, transaction.ClientHandler{}); err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := pbxReader.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.close(0)
+	unregister, err := pbxReader.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unregister.Header.Get("expires") != "0" {
+		t.Fatalf("expected the unREGISTER got %s", unregister.Header.Get("expires"))
+	}
+	if _, err := pbx.Write(sipproto.NewResponse(refresh, 200, "OK").Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the unREGISTER times out
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := u.session(s.flow); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the session detached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if bound() {
+		t.Errorf("expected the closed session out of the location")
+	}
+}
+
+func TestCloseAnswersChallengedUnregister(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	u := newUpstream(transport.Target{Transport: "tcp", Address: ln.Addr().String()}, 1)
+	u.probeInterval = time.Hour
+	u.start()
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(2 * time.Second))
+	pbx, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pbx.Close()
+	pbx.SetReadDeadline(time.Now().Add(2 * time.Second))
+	pbxReader := sipproto.NewReader(bufio.NewReader(pbx))
+
+	store := digest.NewMemoryStore()
+	store.Add("bob", "biloxi.com", digest.Credentials{Username: "1002", Password: "secret"})
+	s := &session{
+		upstream: u,
+		layer:    transaction.NewLayer(),
+		flow:     "f00d",
+		dialogs:  newDialogs(),
+		done:     make(chan struct{}),
+		auth:     newAuthenticator(store, "bob"),
+	}
+	s.registrations = newRegistrations(s.onBind)
+	u.attach(s)
+	register := readSIPMessage(t, `REGISTER sip:biloxi.com SIP/2.0
+To: <sip:bob@biloxi.com>
+From: <sip:bob@biloxi.com>;tag=456248
+Call-ID: 843817637684230@998sdasdh09
+CSeq: 1 REGISTER
+Contact: <sip:bob@10.0.0.1:5060;transport=tcp>
+Expires: 3600
+Content-Length: 0
+
+`).message()
+	s.registrations.update(register, sipproto.NewResponse(register, 200, "OK"))
+	// past the half of its expiration, without grace it's not refreshed
+	b := s.registrations.list()[0]
+	b.expiresAt = time.Now().Add(time.Second)
+
+	s.close(0)
+	unregister, err := pbxReader.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unregister.Header.Get("expires") != "0" {
+		t.Fatalf("expected the unREGISTER got Expires %s", unregister.Header.Get("expires"))
+	}
+	challenge := sipproto.NewResponse(unregister, 401, "Unauthorized")
+	challenge.Header.Add("WWW-Authenticate", `Digest realm="biloxi.com", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", qop="auth"`)
+	if _, err := pbx.Write(challenge.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	retry, err := pbxReader.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry.Header.Get("expires") != "0" || !strings.Contains(retry.Header.Get("authorization"), `username="1002"`) {
+		t.Fatalf("expected the unREGISTER with credentials got %s", retry.Bytes())
+	}
+	if _, err := pbx.Write(sipproto.NewResponse(retry, 200, "OK").Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := u.session(s.flow); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the session detached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(s.registrations.list()) != 0 {
+		t.Errorf("expected the binding removed by the 200 to the unREGISTER")
+	}
+}
@@ -0,0 +1,169 @@
+package rtpproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// Codec is an audio codec of a SDP, the payload type is
+// the number used by the side that announced it.
+type Codec struct {
+	PayloadType uint8
+	// encoding name of the rtpmap ex: PCMU, opus
+	Name      string
+	ClockRate uint32
+	Channels  uint16
+	Fmtp      string
+}
+
+// the audio codecs of the static payload types RFC 3551 section 6
+var staticCodecs = map[uint8]Codec{
+	0: {PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+	8: {PayloadType: 8, Name: "PCMA", ClockRate: 8000, Channels: 1},
+	9: {PayloadType: 9, Name: "G722", ClockRate: 8000, Channels: 1},
+}
+
+// encoding name of the DTMF of RFC 4733
+const telephoneEvent = "telephone-event"
+
+// NewCodec returns the codec of a capability of WebRTC.
+func NewCodec(payloadType uint8, capability webrtc.RTPCodecCapability) Codec {
+	_, name, _ := strings.Cut(capability.MimeType, "/")
+	return Codec{
+		PayloadType: payloadType,
+		Name:        name,
+		ClockRate:   capability.ClockRate,
+		Channels:    capability.Channels,
+		Fmtp:        capability.SDPFmtpLine,
+	}
+}
+
+// Is is true when both are the same encoding, maybe with
+// different payload types.
+func (c Codec) Is(other Codec) bool {
+	return strings.EqualFold(c.Name, other.Name) &&
+		c.ClockRate == other.ClockRate &&
+		channels(c.Channels) == channels(other.Channels)
+}
+
+// IsTelephoneEvent is true for the DTMF of RFC 4733.
+func (c Codec) IsTelephoneEvent() bool {
+	return strings.EqualFold(c.Name, telephoneEvent)
+}
+
+// channels is 1 when the rtpmap has no channels RFC 4566 section 6.
+func channels(n uint16) uint16 {
+	if n == 0 {
+		return 1
+	}
+	return n
+}
+
+func (c Codec) String() string {
+	return fmt.Sprintf("%d %s/%d", c.PayloadType, c.Name, c.ClockRate)
+}
+
+// rtpmap is the value of the attribute rtpmap of the codec RFC 4566 section 6.
+func (c Codec) rtpmap() string {
+	if c.Channels > 1 {
+		return fmt.Sprintf("%d %s/%d/%d", c.PayloadType, c.Name, c.ClockRate, c.Channels)
+	}
+	return fmt.Sprintf("%d %s/%d", c.PayloadType, c.Name, c.ClockRate)
+}
+
+// ParseCodecs returns the codecs of the first audio of sdpBody
+// in order of preference.
+func ParseCodecs(sdpBody string) ([]Codec, error) {
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(sdpBody)); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: fails to parse SDP", err)
+	}
+	audio := firstAudio(parsed)
+	if audio == nil {
+		return nil, errors.New("SDP without audio")
+	}
+	return mediaCodecs(audio), nil
+}
+
+// mediaCodecs returns the codecs of the formats of media, the dynamic
+// payload types without rtpmap are skipped.
+func mediaCodecs(media *sdp.MediaDescription) []Codec {
+	codecs := make(map[uint8]Codec)
+	for _, attribute := range media.Attributes {
+		switch attribute.Key {
+		case "rtpmap":
+			format, encoding, _ := strings.Cut(attribute.Value, " ")
+			pt, err := strconv.ParseUint(format, 10, 7)
+			if err != nil {
+				continue
+			}
+			parts := strings.Split(encoding, "/")
+			codec := codecs[uint8(pt)]
+			codec.PayloadType = uint8(pt)
+			codec.Name = parts[0]
+			if len(parts) > 1 {
+				rate, _ := strconv.ParseUint(parts[1], 10, 32)
+				codec.ClockRate = uint32(rate)
+			}
+			// some phones announce the sampling rate of G.722
+			// instead of its RTP clock RFC 3551 section 4.5.2
+			if strings.EqualFold(codec.Name, "G722") {
+				codec.ClockRate = 8000
+			}
+			if len(parts) > 2 {
+				n, _ := strconv.ParseUint(parts[2], 10, 16)
+				codec.Channels = uint16(n)
+			}
+			codecs[uint8(pt)] = codec
+		case "fmtp":
+			format, params, _ := strings.Cut(attribute.Value, " ")
+			pt, err := strconv.ParseUint(format, 10, 7)
+			if err != nil {
+				continue
+			}
+			codec := codecs[uint8(pt)]
+			codec.Fmtp = params
+			codecs[uint8(pt)] = codec
+		}
+	}
+
+	out := make([]Codec, 0, len(media.MediaName.Formats))
+	for _, format := range media.MediaName.Formats {
+		pt, err := strconv.ParseUint(format, 10, 7)
+		if err != nil {
+			continue
+		}
+		codec, ok := codecs[uint8(pt)]
+		if !ok || codec.Name == "" {
+			static, ok := staticCodecs[uint8(pt)]
+			if !ok {
+				continue
+			}
+			static.Fmtp = codec.Fmtp
+			codec = static
+		}
+		out = append(out, codec)
+	}
+	return out
+}
+
+// Intersect returns the codecs of preferred in its order and with its
+// payload types that are also in other.
+func Intersect(preferred, other []Codec) []Codec {
+	out := make([]Codec, 0)
+	for _, codec := range preferred {
+		for _, candidate := range other {
+			if codec.Is(candidate) {
+				out = append(out, codec)
+				break
+			}
+		}
+	}
+	return out
+}
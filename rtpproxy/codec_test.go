@@ -0,0 +1,119 @@
+package rtpproxy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseCodecs(t *testing.T) {
+	codecs, err := ParseCodecs(browserOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codecs) != 7 {
+		t.Fatalf("expected 7 codecs got %v", codecs)
+	}
+	opus := codecs[0]
+	if opus.PayloadType != 111 || opus.Name != "opus" || opus.ClockRate != 48000 || opus.Channels != 2 || opus.Fmtp != "minptime=10;useinbandfec=1" {
+		t.Errorf("unexpected opus %+v", opus)
+	}
+
+	// static payload types without rtpmap RFC 3551
+	codecs, err = ParseCodecs("v=0\r\no=- 1 1 IN IP4 192.0.2.4\r\ns=-\r\nt=0 0\r\nm=audio 49170 RTP/AVP 8 0 97\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codecs) != 2 || codecs[0].Name != "PCMA" || codecs[1].Name != "PCMU" {
+		t.Errorf("expected PCMA and PCMU got %v", codecs)
+	}
+
+	// the RTP clock of G.722 is 8000 RFC 3551 section 4.5.2
+	codecs, err = ParseCodecs("v=0\r\no=- 1 1 IN IP4 192.0.2.4\r\ns=-\r\nt=0 0\r\nm=audio 49170 RTP/AVP 9\r\na=rtpmap:9 G722/16000\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codecs) != 1 || !codecs[0].Is(staticCodecs[9]) {
+		t.Errorf("expected G722/8000 got %v", codecs)
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	sip := []Codec{
+		{PayloadType: 8, Name: "PCMA", ClockRate: 8000},
+		{PayloadType: 96, Name: "opus", ClockRate: 48000, Channels: 2},
+		{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+	}
+	browser := []Codec{
+		{PayloadType: 111, Name: "OPUS", ClockRate: 48000, Channels: 2},
+		{PayloadType: 0, Name: "PCMU", ClockRate: 8000},
+	}
+	if got := fmt.Sprint(Intersect(sip, browser)); got != "[96 opus/48000 0 PCMU/8000]" {
+		t.Errorf("unexpected intersection %s", got)
+	}
+	if got := fmt.Sprint(Intersect(browser, sip)); got != "[111 OPUS/48000 0 PCMU/8000]" {
+		t.Errorf("unexpected intersection %s", got)
+	}
+}
+
+func TestLocalSDPCodecs(t *testing.T) {
+	proxy, err := NewRTPProxy("127.0.0.1", WithCodecs([]Codec{
+		{PayloadType: 0, Name: "PCMU", ClockRate: 8000},
+		{PayloadType: 8, Name: "PCMA", ClockRate: 8000},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	local, err := proxy.LocalSDP(browserOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(local, fmt.Sprintf("m=audio %d RTP/AVP 0 8\r\n", proxy.Port())) {
+		t.Errorf("expected only the relayed codecs in\n%s", local)
+	}
+
+	// the SIP side uses a dynamic payload type for PCMA
+	proxy.SetCodec(Codec{PayloadType: 101, Name: "PCMA", ClockRate: 8000})
+	local, err = proxy.LocalSDP(browserOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		fmt.Sprintf("m=audio %d RTP/AVP 101\r\n", proxy.Port()),
+		"a=rtpmap:101 PCMA/8000\r\n",
+	} {
+		if !strings.Contains(local, expected) {
+			t.Errorf("expected %q in\n%s", expected, local)
+		}
+	}
+	if strings.Contains(local, "PCMU") {
+		t.Errorf("unexpected PCMU in\n%s", local)
+	}
+
+	// the telephone-event of the clock of the codec
+	proxy.codecs = append(proxy.codecs, Codec{PayloadType: 101, Name: "telephone-event", ClockRate: 8000})
+	if err := proxy.SetSIPSDP("v=0\r\no=- 1 1 IN IP4 192.0.2.4\r\ns=-\r\nt=0 0\r\nm=audio 49170 RTP/AVP 101 96\r\nc=IN IP4 192.0.2.4\r\na=rtpmap:101 PCMA/8000\r\na=rtpmap:96 telephone-event/8000\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	local, err = proxy.LocalSDP(browserOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		fmt.Sprintf("m=audio %d RTP/AVP 101 96\r\n", proxy.Port()),
+		"a=rtpmap:96 telephone-event/8000\r\n",
+	} {
+		if !strings.Contains(local, expected) {
+			t.Errorf("expected %q in\n%s", expected, local)
+		}
+	}
+	if strings.Contains(local, "telephone-event/48000") {
+		t.Errorf("unexpected telephone-event of other clock in\n%s", local)
+	}
+
+	proxy.SetCodec(Codec{PayloadType: 18, Name: "G729", ClockRate: 8000})
+	if _, err := proxy.LocalSDP(browserOffer); err == nil {
+		t.Errorf("expected error for SDP without the codec of the call")
+	}
+}
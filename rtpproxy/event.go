@@ -0,0 +1,170 @@
+package rtpproxy
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Event is the payload of a telephone-event RFC 4733 section 2.3.
+type Event struct {
+	// 0-9, * is 10, # is 11 and A-D are 12-15
+	Code   uint8
+	End    bool
+	Volume uint8
+	// in units of the RTP clock since the start of the event
+	Duration uint16
+}
+
+var (
+	errShortEvent = errors.New("telephone-event shorter than 4 bytes")
+	errNoEvents   = errors.New("telephone-event not negotiated with the browser")
+)
+
+// the updates of a long event and the retransmissions of
+// its end RFC 4733 section 2.5.1
+const (
+	eventInterval = 50 * time.Millisecond
+	eventEnds     = 3
+	eventVolume   = 10
+)
+
+func (e *Event) Unmarshal(payload []byte) error {
+	if len(payload) < 4 {
+		return errShortEvent
+	}
+	e.Code = payload[0]
+	e.End = payload[1]&0x80 != 0
+	e.Volume = payload[1] & 0x3f
+	e.Duration = uint16(payload[2])<<8 | uint16(payload[3])
+	return nil
+}
+
+func (e Event) Marshal() []byte {
+	flags := e.Volume & 0x3f
+	if e.End {
+		flags |= 0x80
+	}
+	return []byte{e.Code, flags, byte(e.Duration >> 8), byte(e.Duration)}
+}
+
+// OnEvent sets fn to receive the telephone-events of the browser when
+// they end, they are no longer relayed to the SIP side.
+func (c *RTPProxy) OnEvent(fn func(code uint8, duration time.Duration)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onEvent = fn
+}
+
+// SetEventCodec sets the telephone-event of the browser for SendEvent.
+func (c *RTPProxy) SetEventCodec(codec Codec) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.eventCodec = &codec
+}
+
+// SendEvent sends the telephone-event code to the browser between the
+// RTP of the SIP side, it returns after duration.
+func (c *RTPProxy) SendEvent(code uint8, duration time.Duration) error {
+	c.mu.RLock()
+	codec := c.eventCodec
+	c.mu.RUnlock()
+	if codec == nil {
+		return errNoEvents
+	}
+	units := func(d time.Duration) uint16 {
+		n := int64(d) * int64(codec.ClockRate) / int64(time.Second)
+		if n > 0xffff {
+			return 0xffff
+		}
+		return uint16(n)
+	}
+
+	// every packet of the event has the timestamp of its start
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: codec.PayloadType, Marker: true}}
+	start := true
+	for elapsed := eventInterval; elapsed < duration; elapsed += eventInterval {
+		packet.Payload = Event{Code: code, Volume: eventVolume, Duration: units(elapsed)}.Marshal()
+		if err := c.injectToBrowser(packet, start); err != nil {
+			return err
+		}
+		packet.Marker, start = false, false
+		time.Sleep(eventInterval)
+	}
+	packet.Payload = Event{Code: code, End: true, Volume: eventVolume, Duration: units(duration)}.Marshal()
+	for i := 0; i < eventEnds; i++ {
+		if err := c.injectToBrowser(packet, start); err != nil {
+			return err
+		}
+		packet.Marker, start = false, false
+	}
+	return nil
+}
+
+// injectToBrowser sends a packet of wueco in the stream for the browser,
+// the later packets of the SIP side are shifted to keep the sequence.
+func (c *RTPProxy) injectToBrowser(packet *rtp.Packet, start bool) error {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+	if c.browserOut == nil {
+		return errNoEvents
+	}
+	c.lastSeq++
+	c.seqShift++
+	packet.SequenceNumber = c.lastSeq
+	if start {
+		c.eventTimestamp = c.lastTimestamp
+	}
+	packet.Timestamp = c.eventTimestamp
+	raw, err := packet.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = c.browserOut.Write(raw)
+	return err
+}
+
+// relayToBrowser shifts the sequence of a packet of the SIP side by the
+// packets of wueco and writes it to out.
+func (c *RTPProxy) relayToBrowser(out io.Writer, packet *rtp.Packet, buf []byte) error {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+	c.browserOut = out
+	packet.SequenceNumber += c.seqShift
+	c.lastSeq = packet.SequenceNumber
+	c.lastTimestamp = packet.Timestamp
+	n, err := packet.MarshalTo(buf)
+	if err != nil {
+		// the packet is skipped
+		return nil
+	}
+	_, err = out.Write(buf[:n])
+	return err
+}
+
+// browserEvent passes a telephone-event of the browser to the handler of
+// OnEvent once, it returns false when the events are relayed.
+func (c *RTPProxy) browserEvent(packet *rtp.Packet, clockRate uint32) bool {
+	c.mu.RLock()
+	onEvent := c.onEvent
+	c.mu.RUnlock()
+	if onEvent == nil {
+		return false
+	}
+	event := Event{}
+	if err := event.Unmarshal(packet.Payload); err != nil || !event.End {
+		return true
+	}
+	// the end is sent three times
+	if c.eventEnded && c.eventEnd == packet.Timestamp {
+		return true
+	}
+	c.eventEnded, c.eventEnd = true, packet.Timestamp
+	if clockRate == 0 {
+		clockRate = 8000
+	}
+	onEvent(event.Code, time.Duration(event.Duration)*time.Second/time.Duration(clockRate))
+	return true
+}
@@ -0,0 +1,125 @@
+package rtpproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestEventMarshal(t *testing.T) {
+	event := Event{Code: 11, End: true, Volume: 10, Duration: 1600}
+	raw := event.Marshal()
+	if fmt.Sprintf("%x", raw) != "0b8a0640" {
+		t.Errorf("unexpected payload %x", raw)
+	}
+	parsed := Event{}
+	if err := parsed.Unmarshal(raw); err != nil || parsed != event {
+		t.Errorf("expected %+v got %+v %v", event, parsed, err)
+	}
+	if err := parsed.Unmarshal(raw[:3]); err == nil {
+		t.Errorf("expected error for a short payload")
+	}
+}
+
+func TestSendEvent(t *testing.T) {
+	proxy, err := NewRTPProxy("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	if err := proxy.SendEvent(5, 100*time.Millisecond); err == nil {
+		t.Errorf("expected error without telephone-event")
+	}
+	proxy.SetEventCodec(Codec{PayloadType: 101, Name: "telephone-event", ClockRate: 8000})
+	proxy.SetPayloadTypes(PayloadTypes{0: 0}, PayloadTypes{0: 0})
+	out := &packetWriter{packets: make(chan []byte, 10)}
+	go proxy.Read(context.Background(), out)
+
+	sip, err := net.Dial("udp", proxy.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sip.Close()
+	send := func(seq uint16, ts uint32) {
+		raw, err := (&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: ts}, Payload: []byte{0xff}}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sip.Write(raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func() *rtp.Packet {
+		select {
+		case raw := <-out.packets:
+			packet := &rtp.Packet{}
+			if err := packet.Unmarshal(raw); err != nil {
+				t.Fatal(err)
+			}
+			return packet
+		case <-time.After(time.Second):
+			t.Fatal("expected a packet for the browser")
+		}
+		return nil
+	}
+
+	send(100, 16000)
+	receive()
+	if err := proxy.SendEvent(5, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// an update at 50ms and the end three times
+	for i, expected := range []Event{
+		{Code: 5, Volume: 10, Duration: 400},
+		{Code: 5, End: true, Volume: 10, Duration: 800},
+		{Code: 5, End: true, Volume: 10, Duration: 800},
+		{Code: 5, End: true, Volume: 10, Duration: 800},
+	} {
+		packet := receive()
+		event := Event{}
+		if err := event.Unmarshal(packet.Payload); err != nil {
+			t.Fatal(err)
+		}
+		if event != expected || packet.PayloadType != 101 || packet.Timestamp != 16000 || packet.SequenceNumber != uint16(101+i) || packet.Marker != (i == 0) {
+			t.Errorf("unexpected event %d %+v %+v", i, packet.Header, event)
+		}
+	}
+	// the RTP of the SIP side continues the sequence
+	send(101, 16160)
+	if packet := receive(); packet.SequenceNumber != 105 {
+		t.Errorf("expected the sequence shifted got %d", packet.SequenceNumber)
+	}
+}
+
+func TestBrowserEvent(t *testing.T) {
+	proxy, err := NewRTPProxy("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	packet := func(event Event) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{PayloadType: 126, Timestamp: 3200}, Payload: event.Marshal()}
+	}
+	if proxy.browserEvent(packet(Event{Code: 1, End: true}), 8000) {
+		t.Errorf("expected the events relayed without OnEvent")
+	}
+
+	var got []string
+	proxy.OnEvent(func(code uint8, duration time.Duration) {
+		got = append(got, fmt.Sprintf("%d %s", code, duration))
+	})
+	if !proxy.browserEvent(packet(Event{Code: 1, Duration: 400}), 8000) {
+		t.Errorf("expected the update of the event consumed")
+	}
+	for i := 0; i < 3; i++ {
+		proxy.browserEvent(packet(Event{Code: 1, End: true, Duration: 1280}), 8000)
+	}
+	if strings.Join(got, ",") != "1 160ms" {
+		t.Errorf("expected the event once got %v", got)
+	}
+}
@@ -0,0 +1,72 @@
+package rtpproxy
+
+import "sync/atomic"
+
+// PayloadTypes maps the payload types of a side to the payload
+// types of the other side for the same codec.
+type PayloadTypes map[uint8]uint8
+
+// MapPayloadTypes returns the maps of both directions for the codecs
+// announced by both sides, each side may use its own dynamic numbers
+// RFC 3264 section 6.1.
+func MapPayloadTypes(browser, sip []Codec) (toSIP, toBrowser PayloadTypes) {
+	toSIP, toBrowser = make(PayloadTypes), make(PayloadTypes)
+	for _, browserCodec := range browser {
+		for _, sipCodec := range sip {
+			if !browserCodec.Is(sipCodec) {
+				continue
+			}
+			if _, ok := toSIP[browserCodec.PayloadType]; !ok {
+				toSIP[browserCodec.PayloadType] = sipCodec.PayloadType
+			}
+			if _, ok := toBrowser[sipCodec.PayloadType]; !ok {
+				toBrowser[sipCodec.PayloadType] = browserCodec.PayloadType
+			}
+		}
+	}
+	return toSIP, toBrowser
+}
+
+// SetPayloadTypes sets the maps used by Write and Read, the packets
+// with a payload type out of the map are dropped, every packet is
+// dropped until the offer/answer sets them.
+func (c *RTPProxy) SetPayloadTypes(toSIP, toBrowser PayloadTypes) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.toSIP = toSIP
+	c.toBrowser = toBrowser
+}
+
+// Dropped returns the packets dropped by direction because of
+// an unknown payload type.
+func (c *RTPProxy) Dropped() (toSIP, toBrowser uint64) {
+	return atomic.LoadUint64(&c.droppedToSIP), atomic.LoadUint64(&c.droppedToBrowser)
+}
+
+// mapToSIP returns the payload type for the SIP side of pt.
+func (c *RTPProxy) mapToSIP(pt uint8) (uint8, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return mapPayloadType(c.toSIP, pt, &c.droppedToSIP)
+}
+
+// mapToBrowser returns the payload type for the browser of pt.
+func (c *RTPProxy) mapToBrowser(pt uint8) (uint8, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return mapPayloadType(c.toBrowser, pt, &c.droppedToBrowser)
+}
+
+// dropToSIP counts a packet of the browser dropped before the map,
+// as the payload types that WebRTC doesn't know.
+func (c *RTPProxy) dropToSIP() {
+	atomic.AddUint64(&c.droppedToSIP, 1)
+}
+
+func mapPayloadType(payloadTypes PayloadTypes, pt uint8, dropped *uint64) (uint8, bool) {
+	mapped, ok := payloadTypes[pt]
+	if !ok {
+		atomic.AddUint64(dropped, 1)
+	}
+	return mapped, ok
+}
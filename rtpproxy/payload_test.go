@@ -0,0 +1,104 @@
+package rtpproxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestMapPayloadTypes(t *testing.T) {
+	browser, err := ParseCodecs(browserOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// FreeSWITCH with dynamic payload types of its own
+	sip, err := ParseCodecs("v=0\r\no=- 1 1 IN IP4 192.0.2.4\r\ns=-\r\nt=0 0\r\nm=audio 49170 RTP/AVP 96 0 101\r\na=rtpmap:96 opus/48000/2\r\na=rtpmap:101 telephone-event/8000\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	toSIP, toBrowser := MapPayloadTypes(browser, sip)
+	for browserPT, sipPT := range map[uint8]uint8{111: 96, 0: 0, 126: 101} {
+		if pt, ok := toSIP[browserPT]; !ok || pt != sipPT {
+			t.Errorf("expected %d to SIP as %d got %d", browserPT, sipPT, pt)
+		}
+		if pt, ok := toBrowser[sipPT]; !ok || pt != browserPT {
+			t.Errorf("expected %d to the browser as %d got %d", sipPT, browserPT, pt)
+		}
+	}
+	if len(toSIP) != 3 || len(toBrowser) != 3 {
+		t.Errorf("unexpected maps %v %v", toSIP, toBrowser)
+	}
+}
+
+type packetWriter struct {
+	packets chan []byte
+}
+
+func (w *packetWriter) Write(b []byte) (int, error) {
+	w.packets <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestReadMapsPayloadTypes(t *testing.T) {
+	proxy, err := NewRTPProxy("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	out := &packetWriter{packets: make(chan []byte, 2)}
+	go proxy.Read(context.Background(), out)
+
+	sip, err := net.Dial("udp", proxy.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sip.Close()
+	send := func(pt uint8) {
+		raw, err := (&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: pt, SequenceNumber: uint16(pt)}, Payload: []byte{pt}}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sip.Write(raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the packets before the offer/answer are dropped
+	send(96)
+	deadline := time.Now().Add(time.Second)
+	for _, toBrowser := proxy.Dropped(); toBrowser != 1; _, toBrowser = proxy.Dropped() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the packet before the maps dropped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	proxy.SetPayloadTypes(PayloadTypes{111: 96}, PayloadTypes{96: 111})
+	// comfort noise is not in the map
+	send(13)
+	send(96)
+	select {
+	case raw := <-out.packets:
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(raw); err != nil {
+			t.Fatal(err)
+		}
+		if packet.PayloadType != 111 || !bytes.Equal(packet.Payload, []byte{96}) {
+			t.Errorf("expected the opus of the SIP side as 111 got %d %x", packet.PayloadType, packet.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the packet for the browser")
+	}
+	if toSIP, toBrowser := proxy.Dropped(); toSIP != 0 || toBrowser != 2 {
+		t.Errorf("expected two packets dropped to the browser got %d %d", toSIP, toBrowser)
+	}
+	if _, ok := proxy.mapToSIP(0); ok {
+		t.Errorf("expected PCMU unknown to SIP")
+	}
+	if toSIP, _ := proxy.Dropped(); toSIP != 1 {
+		t.Errorf("expected one packet dropped to SIP got %d", toSIP)
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"log"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pion/rtp"
 	"github.com/pion/rtcp"
@@ -16,15 +19,64 @@ import (
 )
 
 type RTPProxy struct {
+	// packets with an unknown payload type, first for the
+	// alignment of atomic on 32 bits
+	droppedToSIP     uint64
+	droppedToBrowser uint64
+
 	server  net.PacketConn
 	serverRTCP net.PacketConn
-	sipAddr net.Addr
-	sipRTCPAddr net.Addr
 	port    int
 	host    string
+	// codecs relayed, every codec of the browser when empty
+	codecs []Codec
+
+	// the SIP side is re-pointed by re-INVITE and UPDATE
+	mu sync.RWMutex
+	sipAddr net.Addr
+	sipRTCPAddr net.Addr
+	sipDirection string
+	// last SDP of the SIP side and its codecs
+	sipSDP    string
+	sipCodecs []Codec
+	// codec of the call with the payload type of the SIP side,
+	// nil until the offer/answer completes
+	codec *Codec
+	// payload types of a side for the other one
+	toSIP     PayloadTypes
+	toBrowser PayloadTypes
+	// G.711 of the browser transcoded to the codec, nil when
+	// both sides have the codec
+	transcoding *transcoding
+	// telephone-events of the browser, relayed when nil
+	onEvent func(code uint8, duration time.Duration)
+	// telephone-event of the browser for SendEvent
+	eventCodec *Codec
+
+	// the stream for the browser with the events of wueco
+	streamMu       sync.Mutex
+	browserOut     io.Writer
+	lastSeq        uint16
+	lastTimestamp  uint32
+	seqShift       uint16
+	eventTimestamp uint32
+
+	// last telephone-event of the browser given to onEvent
+	eventEnded bool
+	eventEnd   uint32
 }
 
-func NewRTPProxy(host string) (*RTPProxy, error) {
+// Option configures a RTPProxy.
+type Option func(*RTPProxy)
+
+// WithCodecs sets the codecs that LocalSDP announces to the SIP side.
+func WithCodecs(codecs []Codec) Option {
+	return func(c *RTPProxy) {
+		c.codecs = codecs
+	}
+}
+
+func NewRTPProxy(host string, opts ...Option) (*RTPProxy, error) {
 	rtpPort, err := getFreePort()
 	if err != nil {
 		return nil, fmt.Errorf("%w: fails to get a free port", err);
@@ -38,17 +90,23 @@ func NewRTPProxy(host string) (*RTPProxy, error) {
 	rtcpPort := rtpPort + 1
 	srvRTCP, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", host, rtcpPort))
 	if err != nil {
-		return nil, fmt.Errorf("%w: fails to listen for RTCP")
+		srv.Close()
+		return nil, fmt.Errorf("%w: fails to listen for RTCP", err)
 	}
 		
 
-	return &RTPProxy{
+	proxy := &RTPProxy{
 		server: srv,
 		serverRTCP: srvRTCP,
 		sipAddr: nil,
 		sipRTCPAddr: nil,
+		sipDirection: "sendrecv",
 		host: host,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(proxy)
+	}
+	return proxy, nil
 }
 
 func (c *RTPProxy) Addr() string {
@@ -61,76 +119,373 @@ func (c *RTPProxy) Port() int {
 	return iport
 }
 
-func (c *RTPProxy) SetSIPSDP(sdpBody string) {
+// SetSIPSDP points the proxy to the audio of the SDP of the SIP side,
+// the same SDP again as the answer of a 183 repeated in the 2xx is ignored.
+func (c *RTPProxy) SetSIPSDP(sdpBody string) error {
+	c.mu.RLock()
+	same := c.sipSDP == sdpBody
+	c.mu.RUnlock()
+	if same {
+		return nil
+	}
 	parsed := &sdp.SessionDescription{}
-	if err := parsed.Unmarshal([]byte(sdpBody)); err != nil {
-		log.Fatal(err)
+	if err := parsed.Unmarshal([]byte(sdpBody)); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: fails to parse SIP SDP", err)
+	}
+	audio := firstAudio(parsed)
+	if audio == nil || audio.MediaName.Port.Value == 0 {
+		return errors.New("SIP SDP without audio")
 	}
-	if len(parsed.MediaDescriptions) == 0 {
-		return
+	connection := audio.ConnectionInformation
+	if connection == nil {
+		connection = parsed.ConnectionInformation
+	}
+	if connection == nil || connection.Address == nil {
+		return errors.New("SIP SDP without connection address")
 	}
 
-	address := fmt.Sprintf("%s:%d",
-		parsed.ConnectionInformation.Address.Address,
-		parsed.MediaDescriptions[0].MediaName.Port.Value)
+	address := net.JoinHostPort(connection.Address.Address, strconv.Itoa(audio.MediaName.Port.Value))
 	addr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	addressRTCP := fmt.Sprintf("%s:%d",
-		parsed.ConnectionInformation.Address.Address,
-		parsed.MediaDescriptions[0].MediaName.Port.Value + 1)
+	addressRTCP := net.JoinHostPort(connection.Address.Address, strconv.Itoa(audio.MediaName.Port.Value+1))
 	addrRTCP, err := net.ResolveUDPAddr("udp", addressRTCP)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	direction := mediaDirection(parsed, audio)
+	// hold of RFC 2543
+	if ip := net.ParseIP(connection.Address.Address); ip != nil && ip.IsUnspecified() {
+		direction = "inactive"
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if direction != "inactive" || c.sipAddr == nil {
+		c.sipAddr = addr
+		c.sipRTCPAddr = addrRTCP
+	}
+	c.sipDirection = direction
+	c.sipSDP = sdpBody
+	c.sipCodecs = mediaCodecs(audio)
+	return nil
+}
+
+// SIPCodecs returns the codecs of the last SDP of the SIP side.
+func (c *RTPProxy) SIPCodecs() []Codec {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sipCodecs
+}
+
+// SetCodec sets the codec negotiated for the call, its payload
+// type is the one of the SIP side.
+func (c *RTPProxy) SetCodec(codec Codec) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.codec = &codec
+}
+
+// Codec returns the codec negotiated for the call.
+func (c *RTPProxy) Codec() (Codec, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.codec == nil {
+		return Codec{}, false
 	}
-	c.sipAddr = addr
-	c.sipRTCPAddr = addrRTCP
+	return *c.codec, true
 }
 
-func (c *RTPProxy) LocalSDP(sdpBody string) string {
+// sipEvent returns the telephone-event of the SIP side for the
+// codecs of clockRate RFC 4733 section 2.1.
+func (c *RTPProxy) sipEvent(clockRate uint32) (Codec, bool) {
+	event := Codec{Name: telephoneEvent, ClockRate: clockRate}
+	if len(c.codecs) > 0 && len(Intersect([]Codec{event}, c.codecs)) == 0 {
+		return Codec{}, false
+	}
+	found := Intersect(c.SIPCodecs(), []Codec{event})
+	if len(found) == 0 {
+		return Codec{}, false
+	}
+	return found[0], true
+}
+
+// SIPDirection is the direction of the audio of the SIP side, from
+// the point of view of the SIP side RFC 3264 section 6.1.
+func (c *RTPProxy) SIPDirection() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sipDirection
+}
+
+// sipTarget returns the address for the RTP to the SIP side, nil
+// while the SIP side doesn't receive.
+func (c *RTPProxy) sipTarget() net.Addr {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.sipDirection == "sendonly" || c.sipDirection == "inactive" {
+		return nil
+	}
+	return c.sipAddr
+}
+
+func (c *RTPProxy) sipRTCPTarget() net.Addr {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sipRTCPAddr
+}
+
+var directions = map[string]bool{
+	"sendrecv": true,
+	"sendonly": true,
+	"recvonly": true,
+	"inactive": true,
+}
+
+// mediaDirection returns the direction of the media, by default the
+// direction of the session RFC 4566 section 6.
+func mediaDirection(parsed *sdp.SessionDescription, media *sdp.MediaDescription) string {
+	for _, attributes := range [][]sdp.Attribute{media.Attributes, parsed.Attributes} {
+		for _, attribute := range attributes {
+			if directions[attribute.Key] {
+				return attribute.Key
+			}
+		}
+	}
+	return "sendrecv"
+}
+
+// WithDirection sets the direction of the audio of sdpBody.
+func WithDirection(sdpBody, direction string) string {
+	lines := strings.SplitAfter(sdpBody, "\n")
+	out := make([]string, 0, len(lines)+1)
+	audio, found := false, false
+	flush := func() {
+		if audio && !found {
+			out = append(out, "a="+direction+"\r\n")
+		}
+	}
+	for _, line := range lines {
+		trimmed := strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(trimmed, "m=") {
+			flush()
+			audio, found = strings.HasPrefix(trimmed, "m=audio "), false
+		}
+		if audio && strings.HasPrefix(trimmed, "a=") && directions[strings.TrimPrefix(trimmed, "a=")] {
+			found = true
+			line = "a=" + direction + "\r\n"
+		}
+		if line != "" {
+			out = append(out, line)
+		}
+	}
+	flush()
+	return strings.Join(out, "")
+}
+
+// LocalSDP rewrites the SDP of the browser for the SIP side, the first
+// audio is announced as RTP/AVP at the address of the proxy with the
+// codecs that can be relayed without the extensions of WebRTC and the
+// G.711 that the proxy can transcode. Once the codec of the call is
+// negotiated only it and the telephone-event of its clock are announced
+// with the payload types of the SIP side, when the browser lacks the
+// codec the other G.711 of the browser is transcoded.
+func (c *RTPProxy) LocalSDP(sdpBody string) (string, error) {
 	//https://pkg.go.dev/github.com/pion/sdp/v3#SessionDescription
 	parsed := &sdp.SessionDescription{}
-	if err := parsed.Unmarshal([]byte(sdpBody)); err != nil {
-		if !errors.Is(err, io.EOF) {
-			log.Fatalf("LocalSDP unmarshal: %s: [%s] %s", err, sdpBody, parsed)
+	if err := parsed.Unmarshal([]byte(sdpBody)); err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("%w: fails to parse SDP", err)
+	}
+	audio := firstAudio(parsed)
+	if audio == nil {
+		return "", errors.New("SDP without audio")
+	}
+	formats := relayFormats(audio, c.codecs)
+	if len(formats) == 0 {
+		return "", errors.New("SDP without codecs for RTP/AVP")
+	}
+	// payload types of the browser for the SIP side
+	renumber := make(map[string]string)
+	// rtpmap of the formats of the browser announced as another codec
+	rtpmaps := make(map[string]string)
+	// codecs announced to the SIP side for transcoding
+	transcoded := make([]sdp.Attribute, 0)
+	if codec, ok := c.Codec(); ok {
+		browserCodecs := mediaCodecs(audio)
+		browserCodec, err := c.SelectBrowserCodec(browserCodecs)
+		if err != nil {
+			return "", err
+		}
+		negotiated := []codecPair{{browserCodec, codec}}
+		if event, ok := c.sipEvent(codec.ClockRate); ok {
+			if matching := Intersect(browserCodecs, []Codec{event}); len(matching) > 0 {
+				negotiated = append(negotiated, codecPair{matching[0], event})
+			}
+		}
+		formats = make([]string, 0, len(negotiated))
+		for _, codecs := range negotiated {
+			browserPT := strconv.Itoa(int(codecs.browser.PayloadType))
+			renumber[browserPT] = strconv.Itoa(int(codecs.sip.PayloadType))
+			if !codecs.browser.Is(codecs.sip) {
+				rtpmaps[browserPT] = codecs.sip.rtpmap()
+			}
+			formats = append(formats, browserPT)
+		}
+	} else {
+		// the SIP side may answer with the other G.711
+		offered := mediaCodecs(audio)
+		if len(c.codecs) > 0 {
+			offered = Intersect(offered, c.codecs)
+		}
+		used := make(map[string]bool)
+		for _, format := range formats {
+			used[format] = true
+		}
+		for _, codec := range Transcoded(offered) {
+			format := strconv.Itoa(int(codec.PayloadType))
+			if used[format] || (len(c.codecs) > 0 && len(Intersect([]Codec{codec}, c.codecs)) == 0) {
+				continue
+			}
+			formats = append(formats, format)
+			transcoded = append(transcoded, sdp.Attribute{Key: "rtpmap", Value: codec.rtpmap()})
 		}
 	}
+
 	parsed.Origin.Username = "wueco"
 	parsed.Origin.UnicastAddress = c.host
-
-	// TODO apuntamos a ip del servidor
-	parsed.MediaDescriptions[0].ConnectionInformation.Address.Address = c.host
-	parsed.MediaDescriptions[0].MediaName.Port.Value = c.Port()
-	parsed.MediaDescriptions[0].MediaName.Protos = []string{"RTP/AVP"}
+	parsed.Origin.AddressType = addressType(c.host)
+	parsed.ConnectionInformation = nil
 	parsed.Attributes = make([]sdp.Attribute, 0)
 
+	audio.ConnectionInformation = &sdp.ConnectionInformation{
+		NetworkType: "IN",
+		AddressType: addressType(c.host),
+		Address:     &sdp.Address{Address: c.host},
+	}
+	audio.MediaName.Port.Value = c.Port()
+	audio.MediaName.Protos = []string{"RTP", "AVP"}
+
+	relayed := make(map[string]bool)
+	for _, format := range formats {
+		relayed[format] = true
+	}
 	attributes := make([]sdp.Attribute, 0)
-	for _, remoteAttribute := range parsed.MediaDescriptions[0].Attributes {
-		valids := map[string]bool{
-			"rtpmap": true,
-			"fmtp":   true,
-			"ptime":  true,
-			"sendrcv": true,
+	for _, remoteAttribute := range audio.Attributes {
+		switch remoteAttribute.Key {
+		case "rtpmap", "fmtp":
+			format, rest, _ := strings.Cut(remoteAttribute.Value, " ")
+			if !relayed[format] {
+				continue
+			}
+			if value, ok := rtpmaps[format]; ok {
+				if remoteAttribute.Key == "fmtp" {
+					continue
+				}
+				remoteAttribute.Value = value
+			} else if pt, ok := renumber[format]; ok {
+				remoteAttribute.Value = pt + " " + rest
+			}
+		case "ptime", "maxptime", "sendrecv", "sendonly", "recvonly", "inactive":
+		default:
+			continue
 		}
-		if _, ok := valids[remoteAttribute.Key]; ok {
-			attributes = append(attributes, remoteAttribute)
+		attributes = append(attributes, remoteAttribute)
+	}
+	attributes = append(attributes, transcoded...)
+	for i, format := range formats {
+		if pt, ok := renumber[format]; ok {
+			formats[i] = pt
 		}
 	}
-	parsed.MediaDescriptions[0].Attributes = attributes
-	// TODO: asumimos que la primera media es el audio
-	parsed.MediaDescriptions = []*sdp.MediaDescription{parsed.MediaDescriptions[0]}
+	audio.MediaName.Formats = formats
+	audio.Attributes = attributes
+	audio.Bandwidth = nil
+	parsed.MediaDescriptions = []*sdp.MediaDescription{audio}
 	out, err := parsed.Marshal()
 	if err != nil {
-		log.Fatalf("LocalSDP Marshal: %s", err)
+		return "", fmt.Errorf("%w: fails to marshal SDP", err)
+	}
+
+	return string(out), nil
+}
+
+// codecPair is a codec of the browser and the codec of the SIP side
+// relayed for it.
+type codecPair struct {
+	browser Codec
+	sip     Codec
+}
+
+// the codecs of WebRTC for retransmission and error correction
+var webrtcOnlyCodecs = map[string]bool{
+	"rtx":        true,
+	"red":        true,
+	"ulpfec":     true,
+	"flexfec-03": true,
+}
+
+// relayFormats returns the payload types of the media without
+// the codecs that only make sense for WebRTC, with relayed the
+// codecs not in relayed are also skipped.
+func relayFormats(media *sdp.MediaDescription, relayed []Codec) []string {
+	if len(relayed) > 0 {
+		formats := make([]string, 0)
+		for _, codec := range Intersect(mediaCodecs(media), relayed) {
+			formats = append(formats, strconv.Itoa(int(codec.PayloadType)))
+		}
+		return formats
+	}
+
+	codecs := make(map[string]string)
+	for _, attribute := range media.Attributes {
+		if attribute.Key != "rtpmap" {
+			continue
+		}
+		format, encoding, _ := strings.Cut(attribute.Value, " ")
+		name, _, _ := strings.Cut(encoding, "/")
+		codecs[format] = strings.ToLower(name)
+	}
+
+	formats := make([]string, 0)
+	for _, format := range media.MediaName.Formats {
+		name, ok := codecs[format]
+		if !ok {
+			// static payload types RFC 3551 section 6
+			if pt, err := strconv.Atoi(format); err != nil || pt >= 96 {
+				continue
+			}
+		}
+		if webrtcOnlyCodecs[name] {
+			continue
+		}
+		formats = append(formats, format)
 	}
+	return formats
+}
 
-	return string(out)
+func firstAudio(parsed *sdp.SessionDescription) *sdp.MediaDescription {
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media == "audio" {
+			return media
+		}
+	}
+	return nil
 }
 
+func addressType(host string) string {
+	if strings.Contains(host, ":") {
+		return "IP6"
+	}
+	return "IP4"
+}
+
+// Close releases the RTP and RTCP sockets, the loops of the
+// proxy return when their sockets or tracks are closed.
 func (c *RTPProxy) Close() {
 	c.server.Close()
+	c.serverRTCP.Close()
 }
 
 func (c *RTPProxy) Write(ctx context.Context, in *webrtc.TrackRemote) {
@@ -145,18 +500,33 @@ func (c *RTPProxy) Write(ctx context.Context, in *webrtc.TrackRemote) {
 		default:
 			n, _, err := in.Read(rtpBuf)
 			if err != nil {
+				// pion fails the packets with a payload type not
+				// negotiated and the packets too short
+				if n > 0 {
+					c.dropToSIP()
+					continue
+				}
 				return
 			}
 			if err = rtpPacket.Unmarshal(rtpBuf[:n]); err != nil {
-				panic(err)
+				continue
+			}
+			if codec := in.Codec(); strings.EqualFold(codec.MimeType, "audio/"+telephoneEvent) && c.browserEvent(rtpPacket, codec.ClockRate) {
+				continue
+			}
+			if !c.transcodeToSIP(rtpPacket) {
+				pt, ok := c.mapToSIP(rtpPacket.PayloadType)
+				if !ok {
+					continue
+				}
+				rtpPacket.PayloadType = pt
 			}
-			rtpPacket.PayloadType = 111
 			if n, err = rtpPacket.MarshalTo(rtpBuf); err != nil {
-				panic(err)
+				continue
 			}
 
-			if c.sipAddr != nil {
-				if _, writeErr := c.server.WriteTo(rtpBuf[:n], c.sipAddr); writeErr != nil {
+			if sipAddr := c.sipTarget(); sipAddr != nil {
+				if _, writeErr := c.server.WriteTo(rtpBuf[:n], sipAddr); writeErr != nil {
 					var opError *net.OpError
 					if errors.As(writeErr, &opError) && opError.Err.Error() == "write: connection refused" {
 						continue
@@ -175,16 +545,17 @@ func (c *RTPProxy) WriteRTCP(ctx context.Context, in *webrtc.RTPReceiver) {
 		case <-ctx.Done():
 			return
 		default:
-			n, _, rtcpErr := in.Read(rtcpBuf);
+			n, _, rtcpErr := in.Read(rtcpBuf)
 			if rtcpErr != nil {
-				if errors.Is(rtcpErr, io.EOF) {
-					return
-				}
-				panic(rtcpErr)
+				// the receiver is closed with the PeerConnection
+				return
 			}
-			if c.sipRTCPAddr != nil {
-				if _, err := c.serverRTCP.WriteTo(rtcpBuf[:n], c.sipRTCPAddr); err != nil {
-					panic(err)
+			if sipRTCPAddr := c.sipRTCPTarget(); sipRTCPAddr != nil {
+				if _, err := c.serverRTCP.WriteTo(rtcpBuf[:n], sipRTCPAddr); err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+					log.Printf("RTPPROXY RTCP WRITING ERROR: %s\n", err)
 				}
 			}
 		}
@@ -204,11 +575,12 @@ func (c *RTPProxy) ReadRTCP(ctx context.Context, out *webrtc.PeerConnection) {
 			}
 			pkts, err := rtcp.Unmarshal(rtcpBuf[:n])
 			if err != nil {
-				panic(err)
+				continue
 			}
 
+			// the loop ends when the socket is closed
 			if err = out.WriteRTCP(pkts); err != nil {
-				panic(err)
+				log.Printf("RTPPROXY RTCP READING ERROR: %s\n", err)
 			}
 		}
 	}
@@ -226,17 +598,22 @@ func (c *RTPProxy) Read(ctx context.Context, out io.Writer) {
 		default:
 			n, _, err := c.server.ReadFrom(rtpBuf)
 			if err != nil {
-				log.Printf("RTPPROXY READING ERROR: %s\n", err)
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("RTPPROXY READING ERROR: %s\n", err)
+				}
 				return
 			}
 			if err = rtpPacket.Unmarshal(rtpBuf[:n]); err != nil {
-				panic(err)
+				continue
 			}
-			if n, err = rtpPacket.MarshalTo(rtpBuf); err != nil {
-				panic(err)
+			if !c.transcodeToBrowser(rtpPacket) {
+				pt, ok := c.mapToBrowser(rtpPacket.PayloadType)
+				if !ok {
+					continue
+				}
+				rtpPacket.PayloadType = pt
 			}
-
-			if _, err := out.Write(rtpBuf[:n]); err != nil {
+			if err := c.relayToBrowser(out, rtpPacket, rtpBuf); err != nil {
 				log.Printf("RTPPROXY WRITING ERROR: %s\n", err)
 				return
 			}
@@ -0,0 +1,152 @@
+package rtpproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+const browserOffer = "v=0\r\n" +
+	"o=- 4611731400430051336 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"a=group:BUNDLE 0\r\n" +
+	"a=msid-semantic: WMS\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111 63 9 0 8 110 126\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=rtcp:9 IN IP4 0.0.0.0\r\n" +
+	"a=ice-ufrag:Zr3a\r\n" +
+	"a=ice-pwd:8ud2TzXh8ypd1zsTqh0xZeRB\r\n" +
+	"a=fingerprint:sha-256 9B:0E:2F:40:E6:54:4D:88:43:2D:2D:F9:0B:9F:26:A4:7C:BA:4E:13:3C:8E:1C:6E:91:66:52:61:7D:44:D1:61\r\n" +
+	"a=setup:actpass\r\n" +
+	"a=mid:0\r\n" +
+	"a=sendrecv\r\n" +
+	"a=rtcp-mux\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n" +
+	"a=rtcp-fb:111 transport-cc\r\n" +
+	"a=fmtp:111 minptime=10;useinbandfec=1\r\n" +
+	"a=rtpmap:63 red/48000/2\r\n" +
+	"a=fmtp:63 111/111\r\n" +
+	"a=rtpmap:9 G722/8000\r\n" +
+	"a=rtpmap:0 PCMU/8000\r\n" +
+	"a=rtpmap:8 PCMA/8000\r\n" +
+	"a=rtpmap:110 telephone-event/48000\r\n" +
+	"a=rtpmap:126 telephone-event/8000\r\n" +
+	"a=ssrc:3735928559 cname:wueco\r\n"
+
+func TestLocalSDP(t *testing.T) {
+	proxy, err := NewRTPProxy("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	local, err := proxy.LocalSDP(browserOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"o=wueco 4611731400430051336 2 IN IP4 127.0.0.1\r\n",
+		fmt.Sprintf("m=audio %d RTP/AVP 111 9 0 8 110 126\r\n", proxy.Port()),
+		"c=IN IP4 127.0.0.1\r\n",
+		"a=rtpmap:0 PCMU/8000\r\n",
+		"a=fmtp:111 minptime=10;useinbandfec=1\r\n",
+		"a=sendrecv\r\n",
+	} {
+		if !strings.Contains(local, expected) {
+			t.Errorf("expected %q in\n%s", expected, local)
+		}
+	}
+	for _, unexpected := range []string{"red/48000", "ice-ufrag", "fingerprint", "rtcp-fb", "ssrc", "BUNDLE", "SAVPF"} {
+		if strings.Contains(local, unexpected) {
+			t.Errorf("unexpected %q in\n%s", unexpected, local)
+		}
+	}
+}
+
+func TestSetSIPSDP(t *testing.T) {
+	proxy, err := NewRTPProxy("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	if err := proxy.SetSIPSDP("v=0\r\no=- 1 1 IN IP4 192.0.2.4\r\ns=-\r\nt=0 0\r\nm=audio 49170 RTP/AVP 0\r\nc=IN IP4 192.0.2.4\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if proxy.sipAddr.String() != "192.0.2.4:49170" || proxy.sipRTCPAddr.String() != "192.0.2.4:49171" {
+		t.Errorf("unexpected SIP address %s %s", proxy.sipAddr, proxy.sipRTCPAddr)
+	}
+	// the answer of the 183 repeated in the 200
+	proxy.sipAddr = nil
+	if err := proxy.SetSIPSDP("v=0\r\no=- 1 1 IN IP4 192.0.2.4\r\ns=-\r\nt=0 0\r\nm=audio 49170 RTP/AVP 0\r\nc=IN IP4 192.0.2.4\r\n"); err != nil || proxy.sipAddr != nil {
+		t.Errorf("expected the same SDP ignored got %v %v", proxy.sipAddr, err)
+	}
+	if err := proxy.SetSIPSDP("v=0\r\no=- 1 1 IN IP4 192.0.2.4\r\ns=-\r\nt=0 0\r\nm=video 49170 RTP/AVP 31\r\n"); err == nil {
+		t.Errorf("expected error for SDP without audio")
+	}
+}
+
+func TestCloseStopsLoops(t *testing.T) {
+	proxy, err := NewRTPProxy("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		proxy.Read(context.Background(), io.Discard)
+		done <- struct{}{}
+	}()
+	go func() {
+		proxy.ReadRTCP(context.Background(), nil)
+		done <- struct{}{}
+	}()
+	proxy.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("expected loops stopped by Close")
+		}
+	}
+}
+
+func TestWithDirection(t *testing.T) {
+	offer := "v=0\r\ns=-\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\na=sendrecv\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=sendrecv\r\n"
+	held := WithDirection(offer, "sendonly")
+	if held != "v=0\r\ns=-\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\na=sendonly\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=sendrecv\r\n" {
+		t.Errorf("unexpected SDP %q", held)
+	}
+	if got := WithDirection("v=0\r\nm=audio 9 RTP/AVP 0\r\n", "inactive"); got != "v=0\r\nm=audio 9 RTP/AVP 0\r\na=inactive\r\n" {
+		t.Errorf("expected direction added got %q", got)
+	}
+}
+
+func TestSetSIPSDPHold(t *testing.T) {
+	proxy, err := NewRTPProxy("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	sdp := "v=0\r\no=- 1 1 IN IP4 192.0.2.4\r\ns=-\r\nt=0 0\r\nm=audio 49170 RTP/AVP 0\r\nc=IN IP4 192.0.2.4\r\n"
+	if err := proxy.SetSIPSDP(sdp + "a=sendonly\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if proxy.SIPDirection() != "sendonly" || proxy.sipTarget() != nil {
+		t.Errorf("expected no RTP to the SIP side on hold")
+	}
+	// RFC 2543 hold keeps the address
+	if err := proxy.SetSIPSDP(strings.Replace(sdp, "c=IN IP4 192.0.2.4", "c=IN IP4 0.0.0.0", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if proxy.SIPDirection() != "inactive" || proxy.sipAddr.String() != "192.0.2.4:49170" {
+		t.Errorf("unexpected hold %s %s", proxy.SIPDirection(), proxy.sipAddr)
+	}
+	if err := proxy.SetSIPSDP(strings.Replace(sdp, "49170", "49180", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if target := proxy.sipTarget(); target == nil || target.String() != "192.0.2.4:49180" {
+		t.Errorf("expected resumed to the new address got %v", target)
+	}
+}
@@ -0,0 +1,135 @@
+package rtpproxy
+
+import (
+	"errors"
+	"fmt"
+
+	"bit4bit.in/wueco/g711"
+	"github.com/pion/rtp"
+)
+
+// the variants of G.711 transcoded between them, both have a
+// sample of one byte at the clock of 8000 RFC 3551 section 4.5.14
+var (
+	pcmu = staticCodecs[0]
+	pcma = staticCodecs[8]
+)
+
+// transcoding converts the payload of the codec of the browser to
+// the codec of the SIP side and back, the timestamps are kept.
+type transcoding struct {
+	browser   Codec
+	sip       Codec
+	toSIP     func(dst, src []byte)
+	toBrowser func(dst, src []byte)
+}
+
+// newTranscoding returns the transcoding between the G.711 of the
+// browser and the other G.711 of the SIP side.
+func newTranscoding(browser, sip Codec) (*transcoding, bool) {
+	switch {
+	case browser.Is(pcmu) && sip.Is(pcma):
+		return &transcoding{browser: browser, sip: sip, toSIP: g711.UlawToAlaw, toBrowser: g711.AlawToUlaw}, true
+	case browser.Is(pcma) && sip.Is(pcmu):
+		return &transcoding{browser: browser, sip: sip, toSIP: g711.AlawToUlaw, toBrowser: g711.UlawToAlaw}, true
+	}
+	return nil, false
+}
+
+// transcodedG711 returns the other variant of G.711 for codec.
+func transcodedG711(codec Codec) (Codec, bool) {
+	switch {
+	case codec.Is(pcmu):
+		return pcma, true
+	case codec.Is(pcma):
+		return pcmu, true
+	}
+	return Codec{}, false
+}
+
+// Transcodable returns the codecs of codecs in order that have no
+// codec in other but can be transcoded to one of them.
+func Transcodable(codecs, other []Codec) []Codec {
+	out := make([]Codec, 0)
+	for _, codec := range codecs {
+		if len(Intersect([]Codec{codec}, other)) > 0 {
+			continue
+		}
+		if transcoded, ok := transcodedG711(codec); ok && len(Intersect([]Codec{transcoded}, other)) > 0 {
+			out = append(out, codec)
+		}
+	}
+	return out
+}
+
+// Transcoded returns the variants of G.711 missing in codecs that
+// can be transcoded to a G.711 of codecs, with their static payload types.
+func Transcoded(codecs []Codec) []Codec {
+	out := make([]Codec, 0)
+	for _, codec := range codecs {
+		transcoded, ok := transcodedG711(codec)
+		if ok && len(Intersect([]Codec{transcoded}, codecs)) == 0 && len(Intersect([]Codec{transcoded}, out)) == 0 {
+			out = append(out, transcoded)
+		}
+	}
+	return out
+}
+
+// SelectBrowserCodec returns the codec of browserCodecs for the codec of
+// the call, when the browser lacks it the proxy transcodes the other
+// G.711 of the browser and it's returned instead.
+func (c *RTPProxy) SelectBrowserCodec(browserCodecs []Codec) (Codec, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.codec == nil {
+		return Codec{}, errors.New("codec of the call not negotiated")
+	}
+	if same := Intersect(browserCodecs, []Codec{*c.codec}); len(same) > 0 {
+		c.transcoding = nil
+		return same[0], nil
+	}
+	for _, codec := range browserCodecs {
+		if transcoding, ok := newTranscoding(codec, *c.codec); ok {
+			c.transcoding = transcoding
+			return codec, nil
+		}
+	}
+	return Codec{}, fmt.Errorf("SDP without the codec %s", *c.codec)
+}
+
+// Transcoding returns the codec of the browser when the proxy transcodes.
+func (c *RTPProxy) Transcoding() (Codec, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.transcoding == nil {
+		return Codec{}, false
+	}
+	return c.transcoding.browser, true
+}
+
+// transcodeToSIP converts a packet of the codec of the browser in place,
+// it's false for the packets that are relayed as they are.
+func (c *RTPProxy) transcodeToSIP(packet *rtp.Packet) bool {
+	c.mu.RLock()
+	transcoding := c.transcoding
+	c.mu.RUnlock()
+	if transcoding == nil || packet.PayloadType != transcoding.browser.PayloadType {
+		return false
+	}
+	transcoding.toSIP(packet.Payload, packet.Payload)
+	packet.PayloadType = transcoding.sip.PayloadType
+	return true
+}
+
+// transcodeToBrowser converts a packet of the codec of the SIP side in place.
+func (c *RTPProxy) transcodeToBrowser(packet *rtp.Packet) bool {
+	c.mu.RLock()
+	transcoding := c.transcoding
+	c.mu.RUnlock()
+	if transcoding == nil || packet.PayloadType != transcoding.sip.PayloadType {
+		return false
+	}
+	transcoding.toBrowser(packet.Payload, packet.Payload)
+	packet.PayloadType = transcoding.browser.PayloadType
+	return true
+}
@@ -0,0 +1,132 @@
+package rtpproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"bit4bit.in/wueco/g711"
+	"github.com/pion/rtp"
+)
+
+func TestTranscodable(t *testing.T) {
+	trunk := []Codec{pcma, {PayloadType: 18, Name: "G729", ClockRate: 8000}}
+	browser := []Codec{{PayloadType: 111, Name: "opus", ClockRate: 48000, Channels: 2}, pcmu}
+	if got := Transcodable(trunk, browser); len(got) != 1 || !got[0].Is(pcma) {
+		t.Errorf("expected PCMA transcodable got %v", got)
+	}
+	if got := Transcodable(trunk, append(browser, pcma)); len(got) != 0 {
+		t.Errorf("expected nothing to transcode with a common codec got %v", got)
+	}
+	if got := Transcoded(trunk); len(got) != 1 || got[0].PayloadType != 0 || !got[0].Is(pcmu) {
+		t.Errorf("expected PCMU for PCMA got %v", got)
+	}
+	if got := Transcoded(append(trunk, pcmu)); len(got) != 0 {
+		t.Errorf("expected nothing missing got %v", got)
+	}
+}
+
+func TestLocalSDPTranscodes(t *testing.T) {
+	proxy, err := NewRTPProxy("127.0.0.1", WithCodecs([]Codec{pcmu, pcma}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	// a softphone with only PCMU
+	offer := strings.Replace(browserOffer, " 111 63 9 0 8 110 126\r\n", " 0 126\r\n", 1)
+	local, err := proxy.LocalSDP(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		fmt.Sprintf("m=audio %d RTP/AVP 0 8\r\n", proxy.Port()),
+		"a=rtpmap:8 PCMA/8000\r\n",
+	} {
+		if !strings.Contains(local, expected) {
+			t.Errorf("expected %q in\n%s", expected, local)
+		}
+	}
+
+	// a trunk with only PCMA
+	proxy.SetCodec(pcma)
+	local, err = proxy.LocalSDP(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(local, fmt.Sprintf("m=audio %d RTP/AVP 8\r\n", proxy.Port())) || !strings.Contains(local, "a=rtpmap:8 PCMA/8000\r\n") || strings.Contains(local, "PCMU") {
+		t.Errorf("expected PCMA for the PCMU of the browser in\n%s", local)
+	}
+	if codec, ok := proxy.Transcoding(); !ok || !codec.Is(pcmu) || codec.PayloadType != 0 {
+		t.Errorf("expected PCMU of the browser transcoded got %v", codec)
+	}
+
+	// a common codec stops the transcoding
+	if _, err := proxy.LocalSDP(browserOffer); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := proxy.Transcoding(); ok {
+		t.Errorf("unexpected transcoding with PCMA in both sides")
+	}
+}
+
+func TestReadTranscodes(t *testing.T) {
+	proxy, err := NewRTPProxy("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	proxy.SetCodec(pcma)
+	if _, err := proxy.SelectBrowserCodec([]Codec{pcmu}); err != nil {
+		t.Fatal(err)
+	}
+	out := &packetWriter{packets: make(chan []byte, 1)}
+	go proxy.Read(context.Background(), out)
+
+	sip, err := net.Dial("udp", proxy.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sip.Close()
+	samples := []int16{0, 1000, -1000, 30000}
+	alaw := make([]byte, len(samples))
+	for i, sample := range samples {
+		alaw[i] = g711.EncodeAlaw(sample)
+	}
+	raw, err := (&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 8, SequenceNumber: 7, Timestamp: 160}, Payload: alaw}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sip.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case raw := <-out.packets:
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(raw); err != nil {
+			t.Fatal(err)
+		}
+		ulaw := make([]byte, len(alaw))
+		g711.AlawToUlaw(ulaw, alaw)
+		if packet.PayloadType != 0 || packet.Timestamp != 160 || !bytes.Equal(packet.Payload, ulaw) {
+			t.Errorf("expected PCMU at the timestamp of the SIP side got %d %d %x", packet.PayloadType, packet.Timestamp, packet.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the packet for the browser")
+	}
+
+	// and back to the SIP side
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 0, Timestamp: 320}, Payload: []byte{g711.EncodeUlaw(1000)}}
+	expected := make([]byte, 1)
+	g711.UlawToAlaw(expected, packet.Payload)
+	if !proxy.transcodeToSIP(packet) || packet.PayloadType != 8 || packet.Timestamp != 320 || !bytes.Equal(packet.Payload, expected) {
+		t.Errorf("expected PCMA to the SIP side got %d %d %x", packet.PayloadType, packet.Timestamp, packet.Payload)
+	}
+	// the telephone-events are not transcoded
+	if proxy.transcodeToSIP(&rtp.Packet{Header: rtp.Header{PayloadType: 126}}) {
+		t.Errorf("unexpected transcoding of other payload type")
+	}
+}
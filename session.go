@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"bit4bit.in/wueco/sipproto"
+	"bit4bit.in/wueco/transaction"
+	"bit4bit.in/wueco/transport"
+	"github.com/gorilla/websocket"
+)
+
+// session proxies the SIP messages between a websocket and the SIP
+// server, both legs are stateful through the transaction layer.
+type session struct {
+	conn     *websocket.Conn
+	wsMu     sync.Mutex
+	upstream *upstream
+	layer    *transaction.Layer
+
+	// remote address of the browser
+	remoteAddr string
+	// via of wueco on the requests sent to the browser
+	wsViaTransport string
+	wsSentBy       string
+	// identifies this websocket in the routes of wueco
+	flow string
+
+	dialogs *dialogs
+	// answers the challenges of the SIP server, nil when
+	// the browser answers them
+	auth          *authenticator
+	registrations *registrations
+	// closed with the websocket
+	done chan struct{}
+}
+
+// sendWS is the transaction.Sender of the websocket leg.
+func (s *session) sendWS(msg *sipproto.Message) error {
+	raw := msg.Bytes()
+	log.Printf("SIP -> WEBRTC: %s\n", string(raw))
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+	return s.conn.WriteMessage(websocket.TextMessage, raw)
+}
+
+// sendSIP is the transaction.Sender of the SIP leg, the
+// message goes by the current connection of the flow.
+func (s *session) sendSIP(msg *sipproto.Message) error {
+	conn, err := s.upstream.conn(s.flow)
+	if err != nil {
+		return err
+	}
+	return writeSIP(conn, msg)
+}
+
+// readWS handles the messages from the browser until the websocket fails.
+func (s *session) readWS() {
+	wsR := sipproto.NewReaderWS(s.conn)
+	go wsR.Run()
+	wsReader := sipproto.NewReader(bufio.NewReader(wsR))
+	wsReader.SetKeepalive(s.pongWS)
+	for {
+		msg, err := wsReader.ReadMessage()
+		if err != nil {
+			if errors.Is(err, errNeedMoreData) {
+				continue
+			}
+			if errors.Is(err, io.EOF) {
+				// the websocket is closed
+				return
+			}
+			log.Printf("[ERR] WS - SIP newSipMessage: %s\n", err)
+			return
+		}
+		if msg.IsRequest() {
+			err = s.handleWSRequest(msg)
+		} else {
+			err = s.handleWSResponse(msg)
+		}
+		if err != nil {
+			log.Printf("[ERR] WS -> SIP: %s\n", err)
+		}
+	}
+}
+
+// handleWSRequest forwards a request of the browser to the SIP server.
+func (s *session) handleWSRequest(msg *sipproto.Message) error {
+	srv, isNew, err := s.layer.Receive(msg, s.sendWS, true)
+	if err != nil {
+		return err
+	}
+	if srv != nil && !isNew {
+		return nil
+	}
+	sipConn, err := s.upstream.conn(s.flow)
+	if err != nil {
+		if srv != nil {
+			replyTo(srv, 503, "Service Unavailable")
+		}
+		return err
+	}
+
+	sipMsg, _ := newSIPMessage(msg)
+	sipMsg.popRoutes()
+	sipMsg.recordRoute(s.flow, sipConn.Transport(), s.upstream.advertise)
+	sipMsg.stampVia(s.remoteAddr)
+	s.rewriteWSContact(sipMsg, sipConn)
+	if srv != nil && s.unregisterShared(sipMsg, srv) {
+		return nil
+	}
+
+	c, err := s.callFor(sipMsg, true)
+	if err != nil {
+		if srv != nil {
+			replyTo(srv, 500, "Server Internal Error")
+		}
+		return err
+	}
+	if c != nil {
+		if err := proxyRTPWSToSIP(c, sipMsg); err != nil {
+			// a failed UPDATE or PRACK keeps the early dialog
+			if sipMsg.IsMethod("INVITE") {
+				s.abandon(c)
+			}
+			if srv != nil {
+				status := offerStatus(err)
+				replyTo(srv, status.code, status.reason)
+			}
+			return fmt.Errorf("proxyRTPWSToSIP: %w", err)
+		}
+		s.trackRequest(c, sipMsg)
+	}
+
+	if s.auth != nil {
+		s.auth.toSIP(sipMsg)
+	}
+	if c != nil {
+		c.toSIPSeq(sipMsg)
+	}
+	sipMsg.form = headerForm(*sipHeaderForm)
+	sipMsg.pushVia(s.flow, sipConn.Transport(), sipConn.LocalAddr().String())
+	out := sipMsg.message()
+	if srv == nil {
+		// ACK for 2xx
+		return s.sendSIP(out)
+	}
+	err = s.requestSIP(out, sipConn.Reliable(), false, transaction.ClientHandler{
+		Response: func(rsp *sipproto.Message) {
+			if err := s.forwardSIPResponse(rsp, srv); err != nil {
+				log.Printf("[ERR] SIP -> WS: %s\n", err)
+			}
+		},
+		Timeout: s.abandonOnTimeout(c, func() {
+			replyTo(srv, 408, "Request Timeout")
+		}),
+		TransportError: func(err error) {
+			log.Printf("[ERR] WS -> SIP: %s\n", err)
+			s.abandon(c)
+			replyTo(srv, 503, "Service Unavailable")
+		},
+	})
+	if err != nil {
+		s.abandon(c)
+		replyTo(srv, 503, "Service Unavailable")
+	}
+	return err
+}
+
+// requestSIP sends a request to the SIP server, a challenge is answered
+// once by the gateway and the 2xx to REGISTER update the bindings.
+func (s *session) requestSIP(out *sipproto.Message, reliable, retried bool, handler transaction.ClientHandler) error {
+	_, err := s.layer.Request(out, s.sendSIP, reliable, transaction.ClientHandler{
+		Response: func(rsp *sipproto.Message) {
+			if s.auth != nil && !retried {
+				if retry := s.auth.retry(out, rsp); retry != nil {
+					err := s.requestSIP(retry, reliable, true, handler)
+					if err == nil {
+						return
+					}
+					log.Printf("[ERR] WS -> SIP retry: %s\n", err)
+				}
+			}
+			if out.Request.Method == "REGISTER" && rsp.Response.IsSuccess() {
+				s.registrations.update(out, rsp)
+			}
+			if handler.Response != nil {
+				handler.Response(rsp)
+			}
+		},
+		Timeout:        handler.Timeout,
+		TransportError: handler.TransportError,
+	})
+	return err
+}
+
+// handleSIPResponse passes a response to its transaction, the
+// retransmissions of 2xx are forwarded without transaction.
+func (s *session) handleSIPResponse(msg *sipproto.Message) error {
+	if s.layer.Response(msg) {
+		return nil
+	}
+	if !msg.Response.IsSuccess() {
+		return nil
+	}
+	sipMsg, _ := newSIPMessage(msg)
+	return s.inCall(sipMsg, func() error {
+		if err := s.prepareSIPResponse(sipMsg); err != nil {
+			return err
+		}
+		return s.sendWS(sipMsg.message())
+	})
+}
+
+// forwardSIPResponse sends the response of the SIP server to the browser
+// through the server transaction srv.
+func (s *session) forwardSIPResponse(msg *sipproto.Message, srv *transaction.Server) error {
+	// 100 Trying is hop by hop
+	if msg.Response.StatusCode == 100 {
+		return nil
+	}
+	sipMsg, _ := newSIPMessage(msg)
+	return s.inCall(sipMsg, func() error {
+		err := s.prepareSIPResponse(sipMsg)
+		var status *statusError
+		if errors.As(err, &status) {
+			replyTo(srv, status.code, status.reason)
+		}
+		if err != nil {
+			return err
+		}
+		return srv.Respond(sipMsg.message())
+	})
+}
+
+// inCall runs fn in order with the other responses to the INVITE of
+// the call of sipMsg, the answer for the browser waits the ICE gathering
+// without blocking the upstream connection.
+func (s *session) inCall(sipMsg *sipMessage, fn func() error) error {
+	c, ok := s.dialogs.get(sipMsg.dialogID(false))
+	if !ok || sipMsg.CSeqMethod() != "INVITE" {
+		return fn()
+	}
+	c.serialize(func() {
+		if err := fn(); err != nil {
+			log.Printf("[ERR] SIP -> WS: %s\n", err)
+		}
+	})
+	return nil
+}
+
+func (s *session) prepareSIPResponse(sipMsg *sipMessage) error {
+	// the 2xx as sent by the SIP server for the ACK and BYE of wueco
+	received, _ := newSIPMessage(sipMsg.message())
+	if !sipMsg.popVia() {
+		return fmt.Errorf("response without via of wueco: %s", sipMsg.startLine())
+	}
+	s.rewriteSIPContact(sipMsg)
+	if s.auth != nil {
+		s.auth.toWS(sipMsg)
+	}
+	if c, ok := s.dialogs.get(sipMsg.dialogID(false)); ok {
+		c.toWSSeq(sipMsg)
+		err := errRefused
+		if !c.isRefused() {
+			err = proxyRTPSIPToWS(c, sipMsg)
+		}
+		if err != nil {
+			if sipMsg.response.IsSuccess() && sipMsg.CSeqMethod() == "INVITE" {
+				s.refuseSIPAnswer(c, received)
+				return &statusError{488, "Not Acceptable Here", fmt.Errorf("proxyRTPSIPToWS: %w", err)}
+			}
+			return fmt.Errorf("proxyRTPSIPToWS: %w", err)
+		}
+		if sipMsg.response.IsSuccess() && sipMsg.CSeqMethod() == "INVITE" && !c.browserAnswers {
+			c.setSIPDialog(received.dialogRequest)
+		}
+		s.trackResponse(c, sipMsg, sipMsg.dialogID(false))
+	}
+	return nil
+}
+
+var errRefused = errors.New("call refused")
+
+// refuseSIPAnswer ends the dialog of a 2xx of the SIP server that can't
+// be answered to the browser, every retransmission gets the ACK and
+// the BYE is sent once RFC 3261 section 13.2.2.4.
+func (s *session) refuseSIPAnswer(c *call, rsp *sipMessage) {
+	sipConn, err := s.upstream.conn(s.flow)
+	if err != nil {
+		log.Printf("[ERR] refuse %s: %s\n", c.id, err)
+		return
+	}
+	cseq, err := sipproto.ParseCSeq(rsp.header.Get("cseq"))
+	if err != nil {
+		return
+	}
+	ack, err := rsp.dialogRequest("ACK", cseq.Seq)
+	if err != nil {
+		log.Printf("[ERR] refuse %s: %s\n", c.id, err)
+		return
+	}
+	ack.pushVia(s.flow, sipConn.Transport(), sipConn.LocalAddr().String())
+	if err := s.sendSIP(ack.message()); err != nil {
+		log.Printf("[ERR] refuse %s ACK: %s\n", c.id, err)
+	}
+	if !c.refuse() {
+		return
+	}
+
+	bye, _ := rsp.dialogRequest("BYE", cseq.Seq+1)
+	bye.pushVia(s.flow, sipConn.Transport(), sipConn.LocalAddr().String())
+	err = s.requestSIP(bye.message(), sipConn.Reliable(), false, transaction.ClientHandler{
+		Response: func(rsp *sipproto.Message) {
+			if rsp.Response.IsFinal() {
+				s.hangup(c)
+			}
+		},
+		Timeout: func() {
+			s.hangup(c)
+		},
+	})
+	if err != nil {
+		log.Printf("[ERR] refuse %s BYE: %s\n", c.id, err)
+		s.hangup(c)
+	}
+}
+
+// handleSIPRequest forwards an in-dialog request of the SIP server arrived
+// by sipConn to the browser, the responses go back by the same connection.
+func (s *session) handleSIPRequest(sipConn transport.Conn, msg *sipproto.Message) error {
+	select {
+	case <-s.done:
+		sipMsg, _ := newSIPMessage(msg)
+		return rejectSIP(sipConn, sipMsg, 480, "Temporarily Unavailable")
+	default:
+	}
+	send := func(rsp *sipproto.Message) error {
+		return writeSIP(sipConn, rsp)
+	}
+	srv, isNew, err := s.layer.Receive(msg, send, sipConn.Reliable())
+	if err != nil {
+		return err
+	}
+	if srv != nil && !isNew {
+		return nil
+	}
+	if *dtmfInfo && srv != nil && s.receiveDTMF(msg, srv) {
+		return nil
+	}
+
+	_, err = s.forwardSIPRequest(sipConn, msg, "", transaction.ClientHandler{
+		Response: func(rsp *sipproto.Message) {
+			if err := s.forwardWSResponse(rsp, srv); err != nil {
+				log.Printf("[ERR] WS -> SIP: %s\n", err)
+			}
+		},
+		Timeout: func() {
+			replyTo(srv, 408, "Request Timeout")
+		},
+	})
+	var status *statusError
+	if errors.As(err, &status) && srv != nil {
+		replyTo(srv, status.code, status.reason)
+	}
+	return err
+}
+
+// statusError is a failure answered with a response.
+type statusError struct {
+	code   int
+	reason string
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.code, e.reason, e.err)
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// offerStatus is the response to a request with an offer that
+// fails, 491 on glare RFC 3261 section 14.2.
+func offerStatus(err error) *statusError {
+	if errors.Is(err, errGlare) {
+		return &statusError{491, "Request Pending", err}
+	}
+	return &statusError{488, "Not Acceptable Here", err}
+}
+
+// forwardSIPRequest sends a request of the SIP server arrived by sipConn
+// to the browser, wsContact replaces the Request-URI of the initial requests.
+// The responses go to handler, the ACK for 2xx has no transaction.
+func (s *session) forwardSIPRequest(sipConn transport.Conn, msg *sipproto.Message, wsContact string, handler transaction.ClientHandler) (*sipproto.Message, error) {
+	sipMsg, _ := newSIPMessage(msg)
+	if token, ok := sipMsg.popRoutes(); ok && token != s.flow {
+		return nil, &statusError{430, "Flow Failed", fmt.Errorf("unknown flow %s", token)}
+	}
+	if wsContact != "" {
+		if contact, err := sipproto.ParseAddress(wsContact); err == nil {
+			sipMsg.request.RequestURI = contact.URI
+		}
+	}
+	sipMsg.recordRoute(s.flow, sipConn.Transport(), s.upstream.advertise)
+	sipMsg.stampVia(sipConn.RemoteAddr().String())
+	s.rewriteSIPContact(sipMsg)
+
+	c, err := s.callFor(sipMsg, false)
+	if err != nil {
+		return nil, &statusError{500, "Server Internal Error", err}
+	}
+	if c != nil {
+		if err := proxyRTPSIPToWS(c, sipMsg); err != nil {
+			// a failed UPDATE or PRACK keeps the early dialog
+			if sipMsg.IsMethod("INVITE") {
+				s.abandon(c)
+			}
+			status := offerStatus(err)
+			status.err = fmt.Errorf("proxyRTPSIPToWS: %w", err)
+			return nil, status
+		}
+		s.trackRequest(c, sipMsg)
+		handler.Timeout = s.abandonOnTimeout(c, handler.Timeout)
+	}
+
+	sipMsg.pushVia(s.flow, s.wsViaTransport, s.wsSentBy)
+	out := sipMsg.message()
+	if sipMsg.IsMethod("ACK") {
+		return out, s.sendWS(out)
+	}
+	if _, err = s.layer.Request(out, s.sendWS, true, handler); err != nil && c != nil {
+		s.abandon(c)
+	}
+	return out, err
+}
+
+// handleWSResponse passes a response to its transaction, the
+// retransmissions of 2xx are forwarded without transaction.
+func (s *session) handleWSResponse(msg *sipproto.Message) error {
+	if s.layer.Response(msg) {
+		return nil
+	}
+	if !msg.Response.IsSuccess() {
+		return nil
+	}
+	sipMsg, _ := newSIPMessage(msg)
+	if err := s.prepareWSResponse(sipMsg); err != nil {
+		return err
+	}
+	return s.sendSIP(sipMsg.message())
+}
+
+// forwardWSResponse sends the response of the browser to the SIP server
+// through the server transaction srv.
+func (s *session) forwardWSResponse(msg *sipproto.Message, srv *transaction.Server) error {
+	if msg.Response.StatusCode == 100 {
+		return nil
+	}
+	sipMsg, _ := newSIPMessage(msg)
+	if err := s.prepareWSResponse(sipMsg); err != nil {
+		return err
+	}
+	if msg.Response.IsSuccess() && sipMsg.CSeqMethod() == "INVITE" {
+		if c, ok := s.dialogs.get(sipMsg.dialogID(true)); ok && c.browserAnswers {
+			invite, _ := newSIPMessage(srv.Request())
+			local := sipMsg.header.Get("To")
+			c.setSIPDialog(func(method string, seq uint32) (*sipMessage, error) {
+				return invite.calleeRequest(method, seq, local)
+			})
+		}
+	}
+	return srv.Respond(sipMsg.message())
+}
+
+func (s *session) prepareWSResponse(sipMsg *sipMessage) error {
+	if !sipMsg.popVia() {
+		return fmt.Errorf("response without via of wueco: %s", sipMsg.startLine())
+	}
+	sipConn, err := s.upstream.conn(s.flow)
+	if err != nil {
+		return err
+	}
+	s.rewriteWSContact(sipMsg, sipConn)
+	if c, ok := s.dialogs.get(sipMsg.dialogID(true)); ok {
+		if err := proxyRTPWSToSIP(c, sipMsg); err != nil {
+			return fmt.Errorf("proxyRTPWSToSIP: %w", err)
+		}
+		s.trackResponse(c, sipMsg, sipMsg.dialogID(true))
+	}
+	sipMsg.form = headerForm(*sipHeaderForm)
+	return nil
+}
+
+// close ends the session when the websocket closes, the session
+// keeps its flow until the bindings are released.
+func (s *session) close(grace time.Duration) {
+	close(s.done)
+	s.upstream.location.remove(s)
+	s.dialogs.closeAll()
+	go func() {
+		s.release(grace)
+		// a refresh answered between the close and the
+		// check of onBind may have bound the session again
+		s.upstream.location.remove(s)
+		s.upstream.detach(s)
+	}()
+}
+
+// callFor returns the call of the message, the initial INVITE
+// creates a call, other messages outside of a call returns nil.
+func (s *session) callFor(sipMsg *sipMessage, fromWS bool) (*call, error) {
+	id := sipMsg.dialogID(fromWS)
+	if c, ok := s.dialogs.get(id); ok {
+		return c, nil
+	}
+	if !sipMsg.IsMethod("INVITE") || !sipMsg.isDialogCreating() {
+		return nil, nil
+	}
+	c, err := newCall(id, !fromWS, s.hangup)
+	if err != nil {
+		return nil, err
+	}
+	if *dtmfInfo {
+		c.rtpengine.OnEvent(func(code uint8, duration time.Duration) {
+			s.sendDTMF(c, code, duration)
+		})
+	}
+	s.dialogs.add(c)
+	return c, nil
+}
+
+// trackRequest tears down the call on BYE and CANCEL.
+func (s *session) trackRequest(c *call, sipMsg *sipMessage) {
+	if sipMsg.IsMethod("BYE") || sipMsg.IsMethod("CANCEL") {
+		s.hangup(c)
+	}
+}
+
+// trackResponse follows the dialog with the responses to INVITE, the
+// final error responses tear down the call except the challenges
+// answered by a new INVITE of the same call.
+func (s *session) trackResponse(c *call, sipMsg *sipMessage, id dialogID) {
+	if sipMsg.CSeqMethod() != "INVITE" {
+		return
+	}
+	code := sipMsg.response.StatusCode
+	switch {
+	case code == 100:
+	case sipMsg.response.IsProvisional():
+		s.dialogs.confirm(c, id, false)
+	case sipMsg.response.IsSuccess():
+		s.dialogs.confirm(c, id, true)
+	case code == 401 || code == 407:
+	case code == 408 || code == 481 || !s.dialogs.established(c):
+		// a failed re-INVITE keeps the call RFC 3261 section 14.1
+		s.hangup(c)
+	}
+}
+
+// abandon tears down a call whose dialog was never established, a
+// failed re-INVITE keeps the call.
+func (s *session) abandon(c *call) {
+	if c != nil && !s.dialogs.established(c) {
+		s.hangup(c)
+	}
+}
+
+// abandonOnTimeout wraps the timeout of a request of the call c.
+func (s *session) abandonOnTimeout(c *call, timeout func()) func() {
+	return func() {
+		s.abandon(c)
+		if timeout != nil {
+			timeout()
+		}
+	}
+}
+
+func (s *session) hangup(c *call) {
+	if s.dialogs.remove(c) {
+		log.Printf("call %s terminated\n", c.id)
+		c.close()
+	}
+}
+
+// rewriteWSContact replaces the contact of the browser by a contact
+// of wueco reachable by sipConn.
+func (s *session) rewriteWSContact(sipMsg *sipMessage, sipConn transport.Conn) {
+	wsContact := sipMsg.header.Get("contact")
+	if wsContact == "" || wsContact == "*" {
+		return
+	}
+	sipAddr, sipContact := sipMsg.ContactFromTo(wsContact, s.upstream.advertise, sipConn.Transport())
+	s.upstream.location.addContact(sipAddr, s, wsContact)
+
+	// enviamos el contact de wueco
+	sipMsg.header.Set("contact", sipContact)
+}
+
+// rewriteSIPContact restores the contact of the browser.
+func (s *session) rewriteSIPContact(sipMsg *sipMessage) {
+	if wsContact, ok := s.upstream.location.wsContact(sipMsg.Contact(), s); ok {
+		sipMsg.header.Set("contact", wsContact)
+	}
+}
+
+// writeSIP sends the message to the SIP server, the requests too large
+// for UDP are sent by TCP and the via of wueco announces the transport used.
+func writeSIP(conn transport.Conn, msg *sipproto.Message) error {
+	out := conn
+	raw := msg.Bytes()
+	if msg.Request != nil {
+		selected, err := transport.Select(conn, len(raw))
+		if err != nil {
+			log.Printf("[ERR] transport.Select: %s", err)
+		}
+		if via, err := msg.Header.TopVia(); selected != conn && err == nil && strings.HasPrefix(via.Branch(), branchPrefix) {
+			sentBy := selected.LocalAddr().String()
+			flow, _ := branchFlow(via.Branch())
+			msg.Header.PopVia()
+			sipMsg, _ := newSIPMessage(msg)
+			sipMsg.pushVia(flow, selected.Transport(), sentBy)
+			msg.Header = sipMsg.header
+			raw = msg.Bytes()
+		}
+		out = selected
+	}
+	log.Printf("WEBRTC -> SIP: %s\n", string(raw))
+	_, err := out.Write(raw)
+	return err
+}
+
+// replyTo responds the request of srv.
+func replyTo(srv *transaction.Server, code int, reason string) {
+	req, _ := newSIPMessage(srv.Request())
+	if err := srv.Respond(newResponse(req, code, reason).message()); err != nil {
+		log.Printf("[ERR] replyTo %d: %s\n", code, err)
+	}
+}
@@ -1,17 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"io"
-	"log"
-	"net/textproto"
-	"regexp"
+	"net"
+	"strconv"
 	"strings"
 	"errors"
 
 	"bit4bit.in/wueco/sipproto"
-	"github.com/gorilla/websocket"
 )
 
 var (
@@ -19,9 +15,13 @@ var (
 )
 
 type sipMessage struct {
-	statusLine string
-	header     textproto.MIMEHeader
-	content    string
+	// request or response is set
+	request  *sipproto.Request
+	response *sipproto.Response
+	header   sipproto.Header
+	content  string
+	// form of the header names when serializing
+	form sipproto.HeaderForm
 }
 
 func (c sipMessage) To() string {
@@ -32,31 +32,114 @@ func (c sipMessage) Contact() string {
 	return c.extractAddr("contact")
 }
 
-func (c sipMessage) ContactFromTo(wsContact, host string) (string, string) {
-	reContactAttrs := regexp.MustCompile(">(.+)$")
-	reToName := regexp.MustCompile(":.+@")
-	toAddr := c.header.Get("to")
-	contactAttrs := strings.TrimLeft(reContactAttrs.FindString(wsContact), ">")
-	toName := strings.Trim(reToName.FindString(toAddr), ":@")
+// ContactFromTo builds the contact of wueco for the user of To,
+// the header params of the websocket contact are kept.
+func (c sipMessage) ContactFromTo(wsContact, host, transport string) (string, string) {
+	contact, err := sipproto.ParseAddress(wsContact)
+	if err != nil || contact.Wildcard {
+		contact = &sipproto.Address{}
+	}
+
+	user := ""
+	if to, err := c.address("to"); err == nil {
+		user = to.URI.User
+	}
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	contact.URI = &sipproto.URI{
+		Scheme: "sip",
+		User:   user,
+		Host:   hostname,
+		Params: sipproto.Params{{Name: "transport", Value: strings.ToLower(transport)}},
+	}
+	contact.URI.Port, _ = strconv.Atoi(port)
 
-	addr := fmt.Sprintf("sip:%s@%s;transport=tcp", toName, host)
-	return addr, fmt.Sprintf("<%s>%s", addr, contactAttrs)
+	return contact.URI.String(), contact.String()
+}
+
+func (c sipMessage) address(field string) (*sipproto.Address, error) {
+	addr, err := sipproto.ParseAddress(c.header.Get(field))
+	if err != nil {
+		return nil, err
+	}
+	if addr.Wildcard {
+		return nil, fmt.Errorf("%w: wildcard %s", sipproto.ErrInvalidAddress, field)
+	}
+	return addr, nil
 }
 
 func (c sipMessage) extractAddr(field string) string {
-	reAddr := regexp.MustCompile("<[^>]+")
-	return strings.Trim(reAddr.FindString(c.header.Get(field)), "<>")
+	addr, err := c.address(field)
+	if err != nil {
+		return ""
+	}
+	return addr.URI.String()
 }
 
-func (c sipMessage) IsStatus(status string) bool {
-	return strings.Contains(c.statusLine, status)
+func (c sipMessage) IsStatus(status int) bool {
+	return c.response != nil && c.response.StatusCode == status
 }
 
 func (c sipMessage) IsMethod(method string) bool {
-	return strings.Contains(c.statusLine, method)
+	return c.request != nil && c.request.Method == method
 }
 
-func (c sipMessage) marshal() []byte {
+// rseq returns the RSeq of a reliable provisional response RFC 3262.
+func (c sipMessage) rseq() (uint32, bool) {
+	if c.response == nil || !c.response.IsProvisional() || c.response.StatusCode == 100 {
+		return 0, false
+	}
+	if !c.header.HasOption("require", "100rel") {
+		return 0, false
+	}
+	rseq, err := sipproto.ParseRSeq(c.header.Get("rseq"))
+	if err != nil {
+		return 0, false
+	}
+	return rseq, true
+}
+
+// CSeqMethod is the method of the request, for responses
+// the method of the request that is answered.
+func (c sipMessage) CSeqMethod() string {
+	cseq, err := sipproto.ParseCSeq(c.header.Get("cseq"))
+	if err != nil {
+		return ""
+	}
+	return cseq.Method
+}
+
+// dialogID returns the dialog of the message, fromWS is
+// true for the messages of the browser.
+func (c sipMessage) dialogID(fromWS bool) dialogID {
+	var fromTag, toTag string
+	if from, err := c.address("from"); err == nil {
+		fromTag = from.Tag()
+	}
+	if to, err := c.address("to"); err == nil {
+		toTag = to.Tag()
+	}
+	id := dialogID{CallID: c.header.Get("call-id")}
+	// the browser is in From of its requests and of the responses it gets
+	if fromWS == (c.request != nil) {
+		id.LocalTag, id.RemoteTag = fromTag, toTag
+	} else {
+		id.LocalTag, id.RemoteTag = toTag, fromTag
+	}
+	return id
+}
+
+func (c sipMessage) startLine() string {
+	if c.request != nil {
+		return c.request.String()
+	}
+	return c.response.String()
+}
+
+// message returns the sipproto.Message with the header names in c.form.
+func (c sipMessage) message() *sipproto.Message {
 	// se prueba usando como referencia
 	// SetContent(content string)
 	// strings.TrimSpace
@@ -69,45 +152,96 @@ func (c sipMessage) marshal() []byte {
 			fixContent.Write([]byte{b})
 		}
 	}
-	content := fixContent.String()
-
 
-	rspBuf := new(bytes.Buffer)
-	rspBuf.WriteString(c.statusLine)
-	rspBuf.WriteString("\r\n")
-	c.header.Set("content-length", fmt.Sprintf("%d", len(content)))
-	for key, _ := range c.header {
-		fmt.Fprintf(rspBuf, "%s: %s\r\n", key, c.header.Get(key))
+	// se conserva el orden y nombre de las cabeceras como llegaron
+	msg := &sipproto.Message{
+		Request:  c.request,
+		Response: c.response,
+		Header:   c.header.Clone(),
+		Content:  fixContent.String(),
+		Form:     c.form,
 	}
-	rspBuf.WriteString("\r\n")
-	rspBuf.WriteString(content)
+	msg.StatusLine = c.startLine()
+	return msg
+}
 
-	rawSIP := bytes.Replace(rspBuf.Bytes(), []byte("SIP/2.0/TCP"), []byte("SIP/2.0/WS"), 1)
-	rawSIP = bytes.Replace(rawSIP, []byte("SIP/2.0/WS"), []byte("SIP/2.0/TCP"), 1)
-	return rawSIP
+func (c sipMessage) marshal() []byte {
+	return c.message().Bytes()
 }
 
-func (c sipMessage) WriteMessage(conn *websocket.Conn) error {
-	raw := c.marshal()
-	log.Printf("SIP -> WEBRTC: %s\n", string(raw))
-	return conn.WriteMessage(websocket.TextMessage, raw)
+func newTag() string {
+	return randomHex(6)
 }
 
-func (c sipMessage) Write(out io.Writer) (int, error) {
-	raw := c.marshal()
-	log.Printf("WEBRTC -> SIP: %s\n", string(raw))
-	return out.Write(raw)
+// newResponse builds a response for the request req without body,
+// the To of the final responses gets a tag when it has none.
+func newResponse(req *sipMessage, code int, reason string) *sipMessage {
+	rsp, _ := newSIPMessage(sipproto.NewResponse(req.message(), code, reason))
+	if to, err := rsp.address("to"); err == nil && to.Tag() == "" && code > 100 {
+		to.Params.Set("tag", newTag())
+		rsp.header.Set("to", to.String())
+	}
+	return rsp
 }
 
-func newSIPMessage(msg *sipproto.Message) (*sipMessage, error) {
-	header := textproto.MIMEHeader{}
+// dialogRequest builds a request of wueco in the dialog of the 2xx
+// response c RFC 3261 section 12.2.1.1, the routes of wueco are skipped.
+func (c sipMessage) dialogRequest(method string, seq uint32) (*sipMessage, error) {
+	contact, err := c.address("contact")
+	if err != nil {
+		return nil, fmt.Errorf("dialog without contact: %w", err)
+	}
+	req := &sipMessage{
+		request: &sipproto.Request{Method: method, RequestURI: contact.URI.Clone(), Version: sipproto.Version},
+	}
+	recordRoutes, _ := c.header.Addresses("record-route")
+	var routes []*sipproto.Address
+	for i := len(recordRoutes) - 1; i >= 0; i-- {
+		if _, ok := flowToken(recordRoutes[i].URI); !ok {
+			routes = append(routes, recordRoutes[i])
+		}
+	}
+	req.header.SetAddresses("Route", routes)
+	for _, name := range []string{"From", "To", "Call-ID"} {
+		req.header.Add(name, c.header.Get(name))
+	}
+	req.header.Add("CSeq", sipproto.CSeq{Seq: seq, Method: method}.String())
+	req.header.Add("Max-Forwards", "70")
+	return req, nil
+}
 
-	for key, val := range msg.Header {
-		header.Set(key, val)
+// calleeRequest builds a request of the callee in the dialog of the INVITE
+// c, local is the To of its 2xx with the tag RFC 3261 section 12.1.1.
+func (c sipMessage) calleeRequest(method string, seq uint32, local string) (*sipMessage, error) {
+	contact, err := c.address("contact")
+	if err != nil {
+		return nil, fmt.Errorf("dialog without contact: %w", err)
+	}
+	req := &sipMessage{
+		request: &sipproto.Request{Method: method, RequestURI: contact.URI.Clone(), Version: sipproto.Version},
 	}
+	recordRoutes, _ := c.header.Addresses("record-route")
+	var routes []*sipproto.Address
+	for _, recordRoute := range recordRoutes {
+		if _, ok := flowToken(recordRoute.URI); !ok {
+			routes = append(routes, recordRoute)
+		}
+	}
+	req.header.SetAddresses("Route", routes)
+	req.header.Add("From", local)
+	req.header.Add("To", c.header.Get("From"))
+	req.header.Add("Call-ID", c.header.Get("Call-ID"))
+	req.header.Add("CSeq", sipproto.CSeq{Seq: seq, Method: method}.String())
+	req.header.Add("Max-Forwards", "70")
+	return req, nil
+}
+
+func newSIPMessage(msg *sipproto.Message) (*sipMessage, error) {
+	msg = msg.Clone()
 	return &sipMessage{
-		statusLine: msg.StatusLine,
-		header:     header,
-		content:    msg.Content,
+		request:  msg.Request,
+		response: msg.Response,
+		header:   msg.Header,
+		content:  msg.Content,
 	}, nil
 }
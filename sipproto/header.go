@@ -0,0 +1,212 @@
+package sipproto
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HeaderField is a single header line as it was read from the wire,
+// a compact name is expanded to its long form RFC 3261 section 7.3.3.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Header keeps the header fields of a message in wire order, repeated
+// fields (Via, Route, Record-Route...) are kept as separate entries.
+type Header []HeaderField
+
+// Get returns the value of the first field named name, names are
+// compared case-insensitively.
+func (h Header) Get(name string) string {
+	for _, field := range h {
+		if equalName(field.Name, name) {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// Values returns every value of the fields named name in wire order.
+func (h Header) Values(name string) []string {
+	var values []string
+	for _, field := range h {
+		if equalName(field.Name, name) {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+func (h Header) Has(name string) bool {
+	for _, field := range h {
+		if equalName(field.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasOption is true when token is in the comma separated values of
+// the fields named name, as the option tags of Require and Supported.
+func (h Header) HasOption(name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, option := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(option), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Add appends a new field after the existing ones.
+func (h *Header) Add(name, value string) {
+	*h = append(*h, HeaderField{Name: name, Value: value})
+}
+
+// Set replaces the value of the first field named name keeping its
+// position, the remaining fields with the same name are removed.
+// If there is no such field it's appended.
+func (h *Header) Set(name, value string) {
+	out := (*h)[:0]
+	found := false
+	for _, field := range *h {
+		if equalName(field.Name, name) {
+			if found {
+				continue
+			}
+			field.Value = value
+			found = true
+		}
+		out = append(out, field)
+	}
+	*h = out
+	if !found {
+		h.Add(name, value)
+	}
+}
+
+// Del removes every field named name.
+func (h *Header) Del(name string) {
+	out := (*h)[:0]
+	for _, field := range *h {
+		if !equalName(field.Name, name) {
+			out = append(out, field)
+		}
+	}
+	*h = out
+}
+
+func (h Header) Clone() Header {
+	if h == nil {
+		return nil
+	}
+	out := make(Header, len(h))
+	copy(out, h)
+	return out
+}
+
+// HeaderForm selects how header names are written.
+type HeaderForm int
+
+const (
+	// FormAsRead keeps the names as they were read, the compact
+	// names are expanded when read.
+	FormAsRead HeaderForm = iota
+	// FormLong expands compact names, ex: l -> Content-Length.
+	FormLong
+	// FormCompact uses the compact name when it has one, ex: Via -> v.
+	FormCompact
+)
+
+// compact forms RFC 3261 section 7.3.3 and extensions
+var compactForms = map[string]string{
+	"v": "Via",
+	"f": "From",
+	"t": "To",
+	"i": "Call-ID",
+	"m": "Contact",
+	"l": "Content-Length",
+	"c": "Content-Type",
+	"k": "Supported",
+	"s": "Subject",
+	"e": "Content-Encoding",
+	"o": "Event",
+	"u": "Allow-Events",
+	"r": "Refer-To",
+	"b": "Referred-By",
+}
+
+var longForms = func() map[string]string {
+	forms := make(map[string]string, len(compactForms))
+	for compact, long := range compactForms {
+		forms[strings.ToLower(long)] = compact
+	}
+	return forms
+}()
+
+// LongForm returns the full name for a compact header name,
+// other names are returned unchanged.
+func LongForm(name string) string {
+	if long, ok := compactForms[strings.ToLower(name)]; ok {
+		return long
+	}
+	return name
+}
+
+// CompactForm returns the compact name for a header when
+// it has one, other names are returned unchanged.
+func CompactForm(name string) string {
+	if compact, ok := longForms[strings.ToLower(name)]; ok {
+		return compact
+	}
+	return name
+}
+
+// WithForm returns a copy of the header with the names written in form.
+func (h Header) WithForm(form HeaderForm) Header {
+	out := h.Clone()
+	for i := range out {
+		switch form {
+		case FormLong:
+			out[i].Name = LongForm(out[i].Name)
+		case FormCompact:
+			out[i].Name = CompactForm(out[i].Name)
+		}
+	}
+	return out
+}
+
+// equalName compares header names ignoring case and compact forms.
+func equalName(a, b string) bool {
+	return strings.EqualFold(LongForm(a), LongForm(b))
+}
+
+// parseHeader builds a Header from raw header lines, lines starting
+// with whitespace continue the value of the previous field, the
+// compact names are expanded.
+func parseHeader(lines []string) (Header, error) {
+	header := make(Header, 0, len(lines))
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(header) == 0 {
+				return nil, fmt.Errorf("unexpected continuation line %q", line)
+			}
+			last := &header[len(header)-1]
+			last.Value = last.Value + " " + strings.TrimSpace(line)
+			continue
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx <= 0 {
+			return nil, fmt.Errorf("malformed header line %q", line)
+		}
+		name := strings.TrimSpace(line[:idx])
+		value := strings.TrimSpace(line[idx+1:])
+		header.Add(LongForm(name), value)
+	}
+	return header, nil
+}
@@ -0,0 +1,96 @@
+package sipproto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHeaderSetKeepsPosition(t *testing.T) {
+	var header Header
+	header.Add("Via", "SIP/2.0/TCP a;branch=z9hG4bK1")
+	header.Add("Contact", "<sip:a@a>")
+	header.Add("Via", "SIP/2.0/TCP b;branch=z9hG4bK2")
+	header.Add("Content-Length", "0")
+
+	header.Set("contact", "<sip:b@b>")
+	if header[1].Name != "Contact" || header[1].Value != "<sip:b@b>" {
+		t.Errorf("fails to set in place got %v\n", header)
+	}
+
+	header.Set("via", "SIP/2.0/TCP c;branch=z9hG4bK3")
+	if len(header.Values("via")) != 1 || header[0].Value != "SIP/2.0/TCP c;branch=z9hG4bK3" {
+		t.Errorf("fails to replace repeated fields got %v\n", header)
+	}
+
+	header.Del("CONTENT-LENGTH")
+	if header.Has("content-length") {
+		t.Errorf("fails to delete got %v\n", header)
+	}
+}
+
+func TestHeaderCompactForm(t *testing.T) {
+	var header Header
+	header.Add("v", "SIP/2.0/TCP a;branch=z9hG4bK1")
+	header.Add("Call-ID", "abc")
+	header.Add("c", "application/sdp")
+
+	if header.Get("Via") != "SIP/2.0/TCP a;branch=z9hG4bK1" {
+		t.Errorf("fails to get via from compact form")
+	}
+	if header.Get("i") != "abc" {
+		t.Errorf("fails to get call-id from compact form")
+	}
+
+	long := header.WithForm(FormLong)
+	if long[0].Name != "Via" || long[2].Name != "Content-Type" {
+		t.Errorf("fails to expand got %v\n", long)
+	}
+	compact := header.WithForm(FormCompact)
+	if compact[1].Name != "i" || compact[0].Name != "v" {
+		t.Errorf("fails to compact got %v\n", compact)
+	}
+	if header[0].Name != "v" {
+		t.Errorf("WithForm must not modify the header")
+	}
+}
+
+func TestHeaderHasOption(t *testing.T) {
+	var header Header
+	header.Add("Require", "timer")
+	header.Add("k", "replaces, 100REL")
+
+	if !header.HasOption("require", "timer") {
+		t.Errorf("fails to find timer in require")
+	}
+	if !header.HasOption("supported", "100rel") {
+		t.Errorf("fails to find 100rel in compact supported")
+	}
+	if header.HasOption("require", "100rel") {
+		t.Errorf("100rel is not required")
+	}
+}
+
+func TestParseHeaderExpandsCompactNames(t *testing.T) {
+	header, err := parseHeader([]string{"v: SIP/2.0/TCP a;branch=z9hG4bK1", "call-ID: abc", "l: 0"})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if header[0].Name != "Via" || header[1].Name != "call-ID" || header[2].Name != "Content-Length" {
+		t.Errorf("fails to expand the compact names got %v\n", header)
+	}
+}
+
+func TestMessageBytesCompactForm(t *testing.T) {
+	msg := &Message{
+		StatusLine: "INVITE sip:bob@biloxi.com SIP/2.0",
+		Header:     Header{{Name: "Via", Value: "SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bKnashds7"}, {Name: "CSeq", Value: "1 INVITE"}},
+		Content:    "v=0\r\n",
+		Form:       FormCompact,
+	}
+	if raw := string(msg.Bytes()); !strings.Contains(raw, "\r\nv: SIP/2.0/WSS") || !strings.Contains(raw, "\r\nl: 5\r\n") || strings.Contains(raw, "Content-Length") {
+		t.Errorf("expected the compact names got %q", raw)
+	}
+	if msg.Header.Has("content-length") {
+		t.Errorf("Bytes must not modify the header")
+	}
+}
@@ -126,7 +126,155 @@ Content-Length: 0
 		t.Fatalf("%s", err)
 	}
 
-	if msg.Header["content-type"] != "application/sdp" {
+	if msg.Header.Get("content-type") != "application/sdp" {
 		t.Errorf("fails to get header content-type")
 	}
 }
+
+func TestReadRepeatedHeaders(t *testing.T) {
+	pdu := `SIP/2.0 200 OK
+Via: SIP/2.0/TCP gw.example.com;branch=z9hG4bK1
+Via: SIP/2.0/WS df7jal23ls0d.invalid;branch=z9hG4bK2
+Record-Route: <sip:p2.example.com;lr>
+Record-Route: <sip:p1.example.com;lr>
+Subject: a long
+ subject
+Content-Length: 0
+
+`
+	reader := NewReader(bufio.NewReader(bytes.NewBufferString(pdu)))
+
+	msg, err := reader.ReadMessage()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	vias := msg.Header.Values("via")
+	if len(vias) != 2 || vias[1] != "SIP/2.0/WS df7jal23ls0d.invalid;branch=z9hG4bK2" {
+		t.Errorf("fails to keep via stack got %v\n", vias)
+	}
+	routes := msg.Header.Values("Record-Route")
+	if len(routes) != 2 || routes[0] != "<sip:p2.example.com;lr>" {
+		t.Errorf("fails to keep record-route got %v\n", routes)
+	}
+	if msg.Header.Get("subject") != "a long subject" {
+		t.Errorf("fails to unfold header got %s\n", msg.Header.Get("subject"))
+	}
+}
+
+func TestReadCompactContentLength(t *testing.T) {
+	pdu := `INVITE sip:bob@biloxi.com SIP/2.0
+v: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds
+t: Bob <sip:bob@biloxi.com>
+f: Alice <sip:alice@atlanta.com>;tag=1928301774
+i: a84b4c76e66710@pc33.atlanta.com
+CSeq: 314159 INVITE
+c: application/sdp
+l: 3
+
+abcOPTIONS sip:bob@biloxi.com SIP/2.0
+l: 0
+
+`
+	reader := NewReader(bufio.NewReader(bytes.NewBufferString(pdu)))
+
+	msg, err := reader.ReadMessage()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if msg.Content != "abc" {
+		t.Errorf("fails to get content got %s\n", msg.Content)
+	}
+	if msg.Header.Get("content-type") != "application/sdp" {
+		t.Errorf("fails to get content-type from compact form")
+	}
+
+	msg, err = reader.ReadMessage()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if msg.StatusLine != "OPTIONS sip:bob@biloxi.com SIP/2.0" {
+		t.Errorf("stream desync got %s\n", msg.StatusLine)
+	}
+}
+
+func TestNewCancel(t *testing.T) {
+	pdu := `INVITE sip:bob@biloxi.com SIP/2.0
+Via: SIP/2.0/WS df7jal23ls0d.invalid;branch=z9hG4bKwueco1
+Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds
+Route: <sip:pbx.biloxi.com;lr>
+Max-Forwards: 69
+To: Bob <sip:bob@biloxi.com>
+From: Alice <sip:alice@atlanta.com>;tag=1928301774
+Call-ID: a84b4c76e66710@pc33.atlanta.com
+CSeq: 314159 INVITE
+Contact: <sip:alice@pc33.atlanta.com>
+Content-Type: application/sdp
+Content-Length: 3
+
+abc
+`
+	req, err := NewReader(bufio.NewReader(bytes.NewBufferString(pdu))).ReadMessage()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	cancel := NewCancel(req)
+	if cancel.StatusLine != "CANCEL sip:bob@biloxi.com SIP/2.0" {
+		t.Errorf("fails to build start line got %s", cancel.StatusLine)
+	}
+	if vias := cancel.Header.Values("via"); len(vias) != 1 || vias[0] != "SIP/2.0/WS df7jal23ls0d.invalid;branch=z9hG4bKwueco1" {
+		t.Errorf("CANCEL must have only the top via got %v", vias)
+	}
+	if cancel.Header.Get("cseq") != "314159 CANCEL" || cancel.Header.Get("route") != "<sip:pbx.biloxi.com;lr>" {
+		t.Errorf("fails to copy headers got %v", cancel.Header)
+	}
+	if cancel.Header.Has("contact") || cancel.Content != "" {
+		t.Errorf("CANCEL must not have contact nor body")
+	}
+}
+
+func TestReadKeepalives(t *testing.T) {
+	const options = "OPTIONS sip:bob@biloxi.com SIP/2.0\r\nCSeq: 1 OPTIONS\r\nContent-Length: 0\r\n\r\n"
+	reader := NewReader(bufio.NewReader(bytes.NewBufferString("\r\n\r\n" + options + "\r\n" + options)))
+	var keepalives []bool
+	reader.SetKeepalive(func(ping bool) {
+		keepalives = append(keepalives, ping)
+	})
+
+	for i := 0; i < 2; i++ {
+		msg, err := reader.ReadMessage()
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if !msg.IsRequest() || msg.Request.Method != "OPTIONS" {
+			t.Errorf("fails to read after keepalive got %+v\n", msg)
+		}
+	}
+	if len(keepalives) != 2 || !keepalives[0] || keepalives[1] {
+		t.Errorf("expected ping and pong got %v\n", keepalives)
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	pdu := "INVITE sip:bob@biloxi.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/TCP pbx.biloxi.com;branch=z9hG4bKpbx\r\n" +
+		"record-route: <sip:p2.biloxi.com;lr>\r\n" +
+		"Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds\r\n" +
+		"Record-Route: <sip:p1.atlanta.com;lr>\r\n" +
+		"To: Bob <sip:bob@biloxi.com>\r\n" +
+		"FROM: Alice <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+		"call-ID: a84b4c76e66710@pc33.atlanta.com\r\n" +
+		"X-Custom: one\r\n" +
+		"CSeq: 314159 INVITE\r\n" +
+		"X-Custom: two\r\n" +
+		"Content-Length: 3\r\n" +
+		"\r\n" +
+		"abc"
+	msg, err := NewReader(bufio.NewReader(bytes.NewBufferString(pdu))).ReadMessage()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if out := string(msg.Bytes()); out != pdu {
+		t.Errorf("expected the message as read got\n%q\nwant\n%q", out, pdu)
+	}
+}
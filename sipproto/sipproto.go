@@ -3,7 +3,6 @@ package sipproto
 import (
 	"bufio"
 	"bytes"
-	"net/textproto"
 	"strings"
 	"fmt"
 	"strconv"
@@ -22,7 +21,8 @@ type Reader interface {
 type sipRead struct {
 	R *bufio.Reader
 	state int
-	buf bytes.Buffer
+	// called for the CRLF keepalives between messages
+	keepalive func(ping bool)
 }
 
 func NewReader(reader *bufio.Reader) *sipRead {
@@ -31,14 +31,26 @@ func NewReader(reader *bufio.Reader) *sipRead {
 
 type Message struct {
 	StatusLine string
-	Header map[string]string
+	// Request or Response is set from the StatusLine
+	Request *Request
+	Response *Response
+	Header Header
 	Content string
+	// Form of the header names written by Bytes
+	Form HeaderForm
+}
+
+// SetKeepalive sets fn called for the keepalives between messages
+// RFC 5626 section 4.4.1, ping is true for a double CRLF and false
+// for the single CRLF of a pong.
+func (c *sipRead) SetKeepalive(fn func(ping bool)) {
+	c.keepalive = fn
 }
 
 func (c *sipRead) ReadMessage() (*Message, error) {
-	var buf bytes.Buffer
+	var lines []string
 
-	statusLine, isPrefix, err := c.R.ReadLine()
+	statusLine, isPrefix, err := c.skipKeepalives()
 	// NOTE: si no hago esto al finalizar la funcion
 	// statusLine contiene un valor diferente
 	statusLineString := string(statusLine)
@@ -46,48 +58,178 @@ func (c *sipRead) ReadMessage() (*Message, error) {
 	if err != nil || isPrefix == true {
 		return nil, fmt.Errorf("fails to read StatusLine: %w", err)
 	}
+	request, response, err := ParseStartLine(statusLineString)
+	if err != nil {
+		return nil, fmt.Errorf("fails to read StatusLine: %w", err)
+	}
 	c.state = stateHeader
 
 
 	// read header
 	for c.state == stateHeader {
-		line, _, err := c.R.ReadLine()
-		if len(line) == 0 && buf.Len() > 0 && buf.Bytes()[buf.Len() - 1] == '\n' {
-			buf.Write([]byte{'\n'})
+		line, err := c.readLine()
+		if len(line) == 0 && len(lines) > 0 {
 			c.state = stateContent
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
-		buf.Write(line)
-		buf.Write([]byte{'\n'})
+		lines = append(lines, line)
 	}
-	proto := textproto.NewReader(bufio.NewReader(&buf))
-	proto_header, err := proto.ReadMIMEHeader()
+	header, err := parseHeader(lines)
 	if err != nil {
-		return nil, fmt.Errorf("fails to read header: %s\n", err)
+		return nil, fmt.Errorf("fails to read header: %w", err)
 	}
 
-	header := make(map[string]string)
-	for key, _ := range proto_header {
-		header[strings.ToLower(key)] = proto_header.Get(key)
-	}
-	buf.Reset()
-
 	// content
 	var content strings.Builder
-	content_length, _ := strconv.Atoi(header["content-length"])
+	content_length, _ := strconv.Atoi(header.Get("content-length"))
 	for c.state == stateContent && content_length > 0 {
 		data := make([]byte, content_length)
 		n, err := c.R.Read(data)
 		if err != nil {
 			return nil, fmt.Errorf("state content: %w", err)
 		}
-		content.Write(data)
+		content.Write(data[:n])
 		content_length -= n
 	}
 	c.state = stateStatusLine
 
-	return &Message{Header: header, Content: content.String(), StatusLine: string(statusLineString)}, nil
+	return &Message{
+		Header: header,
+		Content: content.String(),
+		StatusLine: string(statusLineString),
+		Request: request,
+		Response: response,
+	}, nil
+}
+
+// skipKeepalives reads the start line ignoring the empty lines
+// before it RFC 3261 section 7.5.
+func (c *sipRead) skipKeepalives() ([]byte, bool, error) {
+	crlfs := 0
+	for {
+		line, isPrefix, err := c.R.ReadLine()
+		if err != nil || isPrefix || len(line) > 0 {
+			return line, isPrefix, err
+		}
+		crlfs++
+		// a keepalive ends with the data received
+		if c.R.Buffered() > 0 {
+			if next, err := c.R.Peek(1); err == nil && (next[0] == '\r' || next[0] == '\n') {
+				continue
+			}
+		}
+		if c.keepalive != nil {
+			c.keepalive(crlfs > 1)
+		}
+		crlfs = 0
+	}
+}
+
+// readLine reads a full line even when it doesn't fit in the
+// buffer of the underlying reader.
+func (c *sipRead) readLine() (string, error) {
+	var line []byte
+	for {
+		part, isPrefix, err := c.R.ReadLine()
+		line = append(line, part...)
+		if err != nil || !isPrefix {
+			return string(line), err
+		}
+	}
+}
+
+func (m *Message) IsRequest() bool {
+	return m.Request != nil
+}
+
+func (m *Message) startLine() string {
+	switch {
+	case m.Request != nil:
+		return m.Request.String()
+	case m.Response != nil:
+		return m.Response.String()
+	}
+	return m.StatusLine
+}
+
+// Bytes serializes the message, Content-Length is set from Content.
+func (m *Message) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(m.startLine())
+	buf.WriteString("\r\n")
+	header := m.Header.Clone()
+	header.Set("Content-Length", strconv.Itoa(len(m.Content)))
+	for _, field := range header.WithForm(m.Form) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", field.Name, field.Value)
+	}
+	buf.WriteString("\r\n")
+	buf.WriteString(m.Content)
+	return buf.Bytes()
+}
+
+func (m *Message) Clone() *Message {
+	out := *m
+	out.Header = m.Header.Clone()
+	if m.Request != nil {
+		out.Request = m.Request.Clone()
+	}
+	if m.Response != nil {
+		response := *m.Response
+		out.Response = &response
+	}
+	return &out
+}
+
+// NewResponse builds a response to req without body, the Via, From,
+// To, Call-ID and CSeq are copied from the request RFC 3261 section 8.2.6.2.
+func NewResponse(req *Message, code int, reason string) *Message {
+	rsp := &Message{
+		Response: &Response{Version: Version, StatusCode: code, Reason: reason},
+	}
+	for _, field := range req.Header {
+		switch strings.ToLower(LongForm(field.Name)) {
+		case "via", "from", "to", "call-id", "cseq":
+			rsp.Header.Add(field.Name, field.Value)
+			continue
+		}
+		if equalName(field.Name, "timestamp") && code == 100 {
+			rsp.Header.Add(field.Name, field.Value)
+		}
+	}
+	rsp.StatusLine = rsp.Response.String()
+	return rsp
+}
+
+// NewCancel builds the CANCEL of req with its Request-URI, top Via,
+// Route, From, To, Call-ID and CSeq number RFC 3261 section 9.1.
+func NewCancel(req *Message) *Message {
+	cancel := &Message{Request: req.Request.Clone()}
+	cancel.Request.Method = "CANCEL"
+	cancel.Request.Version = Version
+	viaCopied := false
+	for _, field := range req.Header {
+		switch strings.ToLower(LongForm(field.Name)) {
+		case "via":
+			if viaCopied {
+				continue
+			}
+			viaCopied = true
+		case "route", "from", "to", "call-id", "max-forwards":
+		case "cseq":
+			cseq, err := ParseCSeq(field.Value)
+			if err == nil {
+				cseq.Method = "CANCEL"
+				cancel.Header.Add(field.Name, cseq.String())
+			}
+			continue
+		default:
+			continue
+		}
+		cancel.Header.Add(field.Name, field.Value)
+	}
+	cancel.StatusLine = cancel.Request.String()
+	return cancel
 }
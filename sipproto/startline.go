@@ -0,0 +1,165 @@
+package sipproto
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidStartLine = errors.New("sip: invalid start line")
+	ErrInvalidCSeq      = errors.New("sip: invalid cseq")
+	ErrInvalidRAck      = errors.New("sip: invalid rack")
+)
+
+const Version = "SIP/2.0"
+
+// Request is the Request-Line of a request RFC 3261 section 7.1.
+type Request struct {
+	Method     string
+	RequestURI *URI
+	Version    string
+	// Request-URI as read, it's written while RequestURI is not
+	// replaced so its escaping and parameters are kept
+	raw    string
+	rawURI *URI
+}
+
+func (r *Request) String() string {
+	return fmt.Sprintf("%s %s %s", r.Method, r.URIString(), r.Version)
+}
+
+// URIString returns the Request-URI as it's written.
+func (r *Request) URIString() string {
+	if r.raw != "" && r.RequestURI == r.rawURI {
+		return r.raw
+	}
+	return r.RequestURI.String()
+}
+
+// Clone copies the request with its Request-URI.
+func (r *Request) Clone() *Request {
+	out := *r
+	out.RequestURI = r.RequestURI.Clone()
+	out.raw, out.rawURI = "", nil
+	if r.raw != "" && r.RequestURI == r.rawURI {
+		out.raw, out.rawURI = r.raw, out.RequestURI
+	}
+	return &out
+}
+
+// Response is the Status-Line of a response RFC 3261 section 7.2.
+type Response struct {
+	Version    string
+	StatusCode int
+	Reason     string
+}
+
+func (r *Response) String() string {
+	return fmt.Sprintf("%s %d %s", r.Version, r.StatusCode, r.Reason)
+}
+
+// IsProvisional is true for 1xx responses.
+func (r *Response) IsProvisional() bool {
+	return r.StatusCode >= 100 && r.StatusCode < 200
+}
+
+// IsSuccess is true for 2xx responses.
+func (r *Response) IsSuccess() bool {
+	return r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// IsFinal is true for responses ending the transaction.
+func (r *Response) IsFinal() bool {
+	return r.StatusCode >= 200
+}
+
+// ParseStartLine parses the first line of a message, only one
+// of the returned values is set.
+func ParseStartLine(line string) (*Request, *Response, error) {
+	parts := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	if len(parts) < 2 {
+		return nil, nil, fmt.Errorf("%w: %q", ErrInvalidStartLine, line)
+	}
+
+	if strings.HasPrefix(parts[0], "SIP/") {
+		code, err := strconv.Atoi(parts[1])
+		if err != nil || code < 100 || code > 699 {
+			return nil, nil, fmt.Errorf("%w: bad status code %q", ErrInvalidStartLine, line)
+		}
+		rsp := &Response{Version: parts[0], StatusCode: code}
+		if len(parts) == 3 {
+			rsp.Reason = parts[2]
+		}
+		return nil, rsp, nil
+	}
+
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "SIP/") {
+		return nil, nil, fmt.Errorf("%w: %q", ErrInvalidStartLine, line)
+	}
+	uri, err := ParseURI(parts[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidStartLine, err)
+	}
+	return &Request{Method: parts[0], RequestURI: uri, Version: parts[2], raw: parts[1], rawURI: uri}, nil, nil
+}
+
+// CSeq is the value of the CSeq header.
+type CSeq struct {
+	Seq    uint32
+	Method string
+}
+
+func ParseCSeq(value string) (CSeq, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return CSeq{}, fmt.Errorf("%w: %q", ErrInvalidCSeq, value)
+	}
+	seq, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return CSeq{}, fmt.Errorf("%w: %q", ErrInvalidCSeq, value)
+	}
+	return CSeq{Seq: uint32(seq), Method: fields[1]}, nil
+}
+
+func (c CSeq) String() string {
+	return fmt.Sprintf("%d %s", c.Seq, c.Method)
+}
+
+// ParseRSeq parses the RSeq header of a reliable provisional
+// response RFC 3262 section 7.1.
+func ParseRSeq(value string) (uint32, error) {
+	rseq, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+	if err != nil || rseq == 0 {
+		return 0, fmt.Errorf("%w: rseq %q", ErrInvalidRAck, value)
+	}
+	return uint32(rseq), nil
+}
+
+// RAck is the value of the RAck header of a PRACK, it identifies the
+// acknowledged response RFC 3262 section 7.2.
+type RAck struct {
+	RSeq uint32
+	CSeq CSeq
+}
+
+func ParseRAck(value string) (RAck, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return RAck{}, fmt.Errorf("%w: %q", ErrInvalidRAck, value)
+	}
+	rseq, err := ParseRSeq(fields[0])
+	if err != nil {
+		return RAck{}, fmt.Errorf("%w: %q", ErrInvalidRAck, value)
+	}
+	cseq, err := ParseCSeq(fields[1] + " " + fields[2])
+	if err != nil {
+		return RAck{}, fmt.Errorf("%w: %q", ErrInvalidRAck, value)
+	}
+	return RAck{RSeq: rseq, CSeq: cseq}, nil
+}
+
+func (r RAck) String() string {
+	return fmt.Sprintf("%d %s", r.RSeq, r.CSeq)
+}
@@ -0,0 +1,90 @@
+package sipproto
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRequestLine(t *testing.T) {
+	req, rsp, err := ParseStartLine("INVITE sip:200@biloxi.com SIP/2.0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if rsp != nil || req.Method != "INVITE" || req.RequestURI.User != "200" || req.Version != "SIP/2.0" {
+		t.Errorf("fails to parse request got %+v\n", req)
+	}
+}
+
+func TestParseStatusLine(t *testing.T) {
+	req, rsp, err := ParseStartLine("SIP/2.0 180 Ringing for INVITE")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if req != nil || rsp.StatusCode != 180 || rsp.Reason != "Ringing for INVITE" {
+		t.Errorf("fails to parse response got %+v\n", rsp)
+	}
+	if !rsp.IsProvisional() || rsp.IsFinal() {
+		t.Errorf("180 must be provisional")
+	}
+	if _, _, err := ParseStartLine("SIP/2.0 OK"); err == nil {
+		t.Errorf("expected error on bad status code")
+	}
+}
+
+func TestParseCSeq(t *testing.T) {
+	cseq, err := ParseCSeq("314159 INVITE")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if cseq.Seq != 314159 || cseq.Method != "INVITE" {
+		t.Errorf("fails to parse cseq got %+v\n", cseq)
+	}
+}
+
+func TestParseRAck(t *testing.T) {
+	rack, err := ParseRAck("776656 1 INVITE")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if rack.RSeq != 776656 || rack.CSeq.Seq != 1 || rack.CSeq.Method != "INVITE" {
+		t.Errorf("fails to parse rack got %+v\n", rack)
+	}
+	if rack.String() != "776656 1 INVITE" {
+		t.Errorf("unexpected rack %q", rack.String())
+	}
+	for _, value := range []string{"", "1 INVITE", "0 1 INVITE", "x 1 INVITE"} {
+		if _, err := ParseRAck(value); !errors.Is(err, ErrInvalidRAck) {
+			t.Errorf("expected ErrInvalidRAck for %q got %v", value, err)
+		}
+	}
+}
+
+func TestRequestLineKeepsRequestURI(t *testing.T) {
+	req, _, err := ParseStartLine("INVITE SIP:b%6Fb@biloxi.com;transport=ws;lr= SIP/2.0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if req.String() != "INVITE SIP:b%6Fb@biloxi.com;transport=ws;lr= SIP/2.0" {
+		t.Errorf("the Request-URI must be kept as read got %q", req)
+	}
+	if clone := req.Clone(); clone.String() != req.String() {
+		t.Errorf("the clone must keep the Request-URI as read got %q", clone)
+	}
+
+	uri, _ := ParseURI("sip:bob@10.0.0.1")
+	req.RequestURI = uri
+	if req.String() != "INVITE sip:bob@10.0.0.1 SIP/2.0" {
+		t.Errorf("expected the Request-URI replaced got %q", req)
+	}
+}
+
+func TestStatusLineWithoutReason(t *testing.T) {
+	_, rsp, err := ParseStartLine("SIP/2.0 200 ")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	// the SP before the Reason-Phrase is kept RFC 3261 section 7.2
+	if rsp.String() != "SIP/2.0 200 " {
+		t.Errorf("expected the Status-Line with empty reason got %q", rsp)
+	}
+}
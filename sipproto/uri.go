@@ -0,0 +1,452 @@
+package sipproto
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidURI     = errors.New("sip: invalid uri")
+	ErrInvalidAddress = errors.New("sip: invalid address")
+)
+
+// Param is a uri or header parameter, flags like lr have an empty Value.
+type Param struct {
+	Name  string
+	Value string
+}
+
+// Params keeps parameters in the order they were written.
+type Params []Param
+
+func (p Params) Get(name string) (string, bool) {
+	for _, param := range p {
+		if strings.EqualFold(param.Name, name) {
+			return param.Value, true
+		}
+	}
+	return "", false
+}
+
+func (p Params) Has(name string) bool {
+	_, ok := p.Get(name)
+	return ok
+}
+
+// Set replaces the value of name or appends it.
+func (p *Params) Set(name, value string) {
+	for i, param := range *p {
+		if strings.EqualFold(param.Name, name) {
+			(*p)[i].Value = value
+			return
+		}
+	}
+	*p = append(*p, Param{Name: name, Value: value})
+}
+
+func (p *Params) Del(name string) {
+	out := (*p)[:0]
+	for _, param := range *p {
+		if !strings.EqualFold(param.Name, name) {
+			out = append(out, param)
+		}
+	}
+	*p = out
+}
+
+func (p Params) Clone() Params {
+	if p == nil {
+		return nil
+	}
+	out := make(Params, len(p))
+	copy(out, p)
+	return out
+}
+
+// write writes the parameters with sep before each one.
+func (p Params) write(b *strings.Builder, sep byte) {
+	for _, param := range p {
+		b.WriteByte(sep)
+		b.WriteString(param.Name)
+		if param.Value != "" {
+			b.WriteByte('=')
+			b.WriteString(param.Value)
+		}
+	}
+}
+
+func parseParams(s string, sep byte) Params {
+	var params Params
+	for _, part := range splitOutsideQuotes(s, sep) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value := part, ""
+		if idx := strings.IndexByte(part, '='); idx >= 0 {
+			name, value = strings.TrimSpace(part[:idx]), strings.TrimSpace(part[idx+1:])
+		}
+		params = append(params, Param{Name: name, Value: value})
+	}
+	return params
+}
+
+// URI is a sip or sips uri RFC 3261 section 19.1, others schemes
+// (ex: tel) keep everything after the scheme in Opaque.
+type URI struct {
+	Scheme   string
+	User     string
+	Password string
+	// Host without brackets for IPv6
+	Host    string
+	Port    int
+	Params  Params
+	Headers Params
+	Opaque  string
+}
+
+func ParseURI(s string) (*URI, error) {
+	s = strings.TrimSpace(s)
+	idx := strings.IndexByte(s, ':')
+	if idx <= 0 {
+		return nil, fmt.Errorf("%w: missing scheme %q", ErrInvalidURI, s)
+	}
+	uri := &URI{Scheme: strings.ToLower(s[:idx])}
+	rest := s[idx+1:]
+	if uri.Scheme != "sip" && uri.Scheme != "sips" {
+		uri.Opaque = rest
+		return uri, nil
+	}
+
+	if idx := strings.IndexByte(rest, '?'); idx >= 0 {
+		uri.Headers = parseParams(rest[idx+1:], '&')
+		rest = rest[:idx]
+	}
+
+	if idx := strings.LastIndexByte(rest, '@'); idx >= 0 {
+		userinfo := rest[:idx]
+		rest = rest[idx+1:]
+		if idx := strings.IndexByte(userinfo, ':'); idx >= 0 {
+			uri.User, uri.Password = userinfo[:idx], userinfo[idx+1:]
+		} else {
+			uri.User = userinfo
+		}
+	}
+
+	hostport := rest
+	if idx := strings.IndexByte(rest, ';'); idx >= 0 {
+		hostport = rest[:idx]
+		uri.Params = parseParams(rest[idx+1:], ';')
+	}
+
+	if strings.HasPrefix(hostport, "[") {
+		end := strings.IndexByte(hostport, ']')
+		if end < 0 {
+			return nil, fmt.Errorf("%w: unterminated IPv6 host %q", ErrInvalidURI, s)
+		}
+		uri.Host = hostport[1:end]
+		hostport = hostport[end+1:]
+		if hostport != "" && hostport[0] != ':' {
+			return nil, fmt.Errorf("%w: bad host %q", ErrInvalidURI, s)
+		}
+	} else {
+		uri.Host = hostport
+		if idx := strings.LastIndexByte(hostport, ':'); idx >= 0 {
+			uri.Host = hostport[:idx]
+			hostport = hostport[idx:]
+		} else {
+			hostport = ""
+		}
+	}
+	if hostport != "" {
+		port, err := strconv.Atoi(hostport[1:])
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("%w: bad port %q", ErrInvalidURI, s)
+		}
+		uri.Port = port
+	}
+	if uri.Host == "" {
+		return nil, fmt.Errorf("%w: missing host %q", ErrInvalidURI, s)
+	}
+
+	return uri, nil
+}
+
+// HostPort returns host:port, the port is omitted when it's not set.
+func (u *URI) HostPort() string {
+	if u.Port == 0 {
+		if strings.Contains(u.Host, ":") {
+			return "[" + u.Host + "]"
+		}
+		return u.Host
+	}
+	return net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+}
+
+func (u *URI) String() string {
+	var b strings.Builder
+	b.WriteString(u.Scheme)
+	b.WriteByte(':')
+	if u.Opaque != "" {
+		b.WriteString(u.Opaque)
+		return b.String()
+	}
+	if u.User != "" {
+		b.WriteString(u.User)
+		if u.Password != "" {
+			b.WriteByte(':')
+			b.WriteString(u.Password)
+		}
+		b.WriteByte('@')
+	}
+	b.WriteString(u.HostPort())
+	u.Params.write(&b, ';')
+	if len(u.Headers) > 0 {
+		b.WriteByte('?')
+		var headers strings.Builder
+		u.Headers.write(&headers, '&')
+		b.WriteString(headers.String()[1:])
+	}
+	return b.String()
+}
+
+func (u *URI) Clone() *URI {
+	if u == nil {
+		return nil
+	}
+	out := *u
+	out.Params = u.Params.Clone()
+	out.Headers = u.Headers.Clone()
+	return &out
+}
+
+// Address is the value of From, To, Contact, Route... a name-addr
+// or addr-spec followed by header parameters (tag, expires, q).
+type Address struct {
+	DisplayName string
+	URI         *URI
+	Params      Params
+	// Wildcard is set for Contact: *
+	Wildcard bool
+}
+
+func ParseAddress(s string) (*Address, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, fmt.Errorf("%w: empty", ErrInvalidAddress)
+	}
+	if s == "*" {
+		return &Address{Wildcard: true}, nil
+	}
+
+	addr := &Address{}
+	rest := s
+	if rest[0] == '"' {
+		name, after, err := unquote(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s %q", ErrInvalidAddress, err, s)
+		}
+		addr.DisplayName = name
+		rest = strings.TrimSpace(after)
+		if !strings.HasPrefix(rest, "<") {
+			return nil, fmt.Errorf("%w: expected < after display name %q", ErrInvalidAddress, s)
+		}
+	}
+
+	var uri string
+	if idx := strings.IndexByte(rest, '<'); idx >= 0 {
+		if addr.DisplayName == "" {
+			addr.DisplayName = strings.TrimSpace(rest[:idx])
+		}
+		end := strings.IndexByte(rest[idx:], '>')
+		if end < 0 {
+			return nil, fmt.Errorf("%w: unterminated < %q", ErrInvalidAddress, s)
+		}
+		uri = rest[idx+1 : idx+end]
+		rest = rest[idx+end+1:]
+	} else {
+		// addr-spec: the parameters belongs to the header not to the uri
+		uri = rest
+		rest = ""
+		if idx := strings.IndexByte(uri, ';'); idx >= 0 {
+			uri, rest = uri[:idx], uri[idx:]
+		}
+	}
+
+	parsed, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	addr.URI = parsed
+
+	rest = strings.TrimSpace(rest)
+	if rest != "" {
+		if rest[0] != ';' {
+			return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidAddress, rest)
+		}
+		addr.Params = parseParams(rest[1:], ';')
+	}
+	return addr, nil
+}
+
+// ParseAddressList parses a comma separated list of addresses.
+func ParseAddressList(s string) ([]*Address, error) {
+	var addrs []*Address
+	for _, part := range splitOutsideQuotes(s, ',') {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		addr, err := ParseAddress(part)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func (a *Address) Tag() string {
+	tag, _ := a.Params.Get("tag")
+	return tag
+}
+
+// String always writes the name-addr form.
+func (a *Address) String() string {
+	if a.Wildcard {
+		return "*"
+	}
+	var b strings.Builder
+	if a.DisplayName != "" {
+		b.WriteString(quote(a.DisplayName))
+		b.WriteByte(' ')
+	}
+	b.WriteByte('<')
+	if a.URI != nil {
+		b.WriteString(a.URI.String())
+	}
+	b.WriteByte('>')
+	a.Params.write(&b, ';')
+	return b.String()
+}
+
+func (a *Address) Clone() *Address {
+	if a == nil {
+		return nil
+	}
+	out := *a
+	out.URI = a.URI.Clone()
+	out.Params = a.Params.Clone()
+	return &out
+}
+
+// unquote reads a quoted-string at the start of s and returns
+// the value and what follows it.
+func unquote(s string) (string, string, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i < len(s) {
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:], nil
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", errors.New("unterminated quoted string")
+}
+
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// splitOutsideQuotes splits s by sep ignoring the separators
+// inside quoted strings and <...>.
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	quoted, bracket := false, false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == '<' && !quoted:
+			bracket = true
+		case c == '>' && !quoted:
+			bracket = false
+		case c == sep && !quoted && !bracket:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Addresses returns every address of the fields named name in
+// order, a field may carry several addresses separated by comma.
+func (h Header) Addresses(name string) ([]*Address, error) {
+	var addrs []*Address
+	for _, value := range h.Values(name) {
+		parsed, err := ParseAddressList(value)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, parsed...)
+	}
+	return addrs, nil
+}
+
+// SetAddresses replaces the fields named name by a field per address,
+// the fields are written where the first one was.
+func (h *Header) SetAddresses(name string, addrs []*Address) {
+	pos := -1
+	out := (*h)[:0]
+	for _, field := range *h {
+		if equalName(field.Name, name) {
+			if pos < 0 {
+				pos = len(out)
+				name = field.Name
+			}
+			continue
+		}
+		out = append(out, field)
+	}
+	if pos < 0 {
+		pos = len(out)
+	}
+	fields := make(Header, 0, len(addrs))
+	for _, addr := range addrs {
+		fields = append(fields, HeaderField{Name: name, Value: addr.String()})
+	}
+	*h = append(out[:pos], append(fields, out[pos:]...)...)
+}
+
+// Insert adds a field before the first field named name,
+// without such field it's appended.
+func (h *Header) Insert(name, value string) {
+	field := HeaderField{Name: name, Value: value}
+	for i, existing := range *h {
+		if equalName(existing.Name, name) {
+			*h = append((*h)[:i], append(Header{field}, (*h)[i:]...)...)
+			return
+		}
+	}
+	h.Add(name, value)
+}
@@ -0,0 +1,112 @@
+package sipproto
+
+import (
+	"testing"
+)
+
+func TestParseURI(t *testing.T) {
+	uri, err := ParseURI("sips:alice:secret@[2001:db8::10]:5061;transport=tls;lr?subject=project&priority=urgent")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if uri.Scheme != "sips" || uri.User != "alice" || uri.Password != "secret" {
+		t.Errorf("fails to get userinfo got %+v\n", uri)
+	}
+	if uri.Host != "2001:db8::10" || uri.Port != 5061 {
+		t.Errorf("fails to get IPv6 host got %s %d\n", uri.Host, uri.Port)
+	}
+	if transport, _ := uri.Params.Get("transport"); transport != "tls" || !uri.Params.Has("lr") {
+		t.Errorf("fails to get params got %v\n", uri.Params)
+	}
+	if subject, _ := uri.Headers.Get("subject"); subject != "project" {
+		t.Errorf("fails to get headers got %v\n", uri.Headers)
+	}
+	if uri.String() != "sips:alice:secret@[2001:db8::10]:5061;transport=tls;lr?subject=project&priority=urgent" {
+		t.Errorf("fails to marshal got %s\n", uri.String())
+	}
+}
+
+func TestParseURIWithoutUser(t *testing.T) {
+	uri, err := ParseURI("sip:biloxi.com")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if uri.User != "" || uri.Host != "biloxi.com" || uri.Port != 0 {
+		t.Errorf("fails to parse got %+v\n", uri)
+	}
+	if _, err := ParseURI("biloxi.com"); err == nil {
+		t.Errorf("expected error without scheme")
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	addr, err := ParseAddress(`"Bob <the > builder>" <sip:bob@biloxi.com;transport=ws>;tag=a6c85cf;expires=3600`)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if addr.DisplayName != "Bob <the > builder>" {
+		t.Errorf("fails to get display name got %s\n", addr.DisplayName)
+	}
+	if addr.URI.User != "bob" || addr.URI.Host != "biloxi.com" {
+		t.Errorf("fails to get uri got %+v\n", addr.URI)
+	}
+	if transport, _ := addr.URI.Params.Get("transport"); transport != "ws" {
+		t.Errorf("fails to get uri params got %v\n", addr.URI.Params)
+	}
+	if addr.Tag() != "a6c85cf" {
+		t.Errorf("fails to get tag got %s\n", addr.Tag())
+	}
+	if expires, _ := addr.Params.Get("expires"); expires != "3600" {
+		t.Errorf("fails to get expires got %v\n", addr.Params)
+	}
+}
+
+func TestParseAddrSpec(t *testing.T) {
+	addr, err := ParseAddress("sip:alice@atlanta.com;tag=1928301774")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(addr.URI.Params) != 0 || addr.Tag() != "1928301774" {
+		t.Errorf("params of addr-spec belongs to the header got %+v %+v\n", addr.URI, addr.Params)
+	}
+	if addr.String() != "<sip:alice@atlanta.com>;tag=1928301774" {
+		t.Errorf("fails to marshal got %s\n", addr.String())
+	}
+}
+
+func TestParseAddressList(t *testing.T) {
+	addrs, err := ParseAddressList(`"a, b" <sip:p1.example.com;lr>, <sip:p2.example.com;lr>`)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(addrs) != 2 || addrs[0].DisplayName != "a, b" || addrs[1].URI.Host != "p2.example.com" {
+		t.Errorf("fails to parse list got %v\n", addrs)
+	}
+}
+
+func TestHeaderAddresses(t *testing.T) {
+	var header Header
+	header.Add("Call-ID", "abc")
+	header.Add("route", "<sip:p1.example.com;lr>, <sip:p2.example.com;lr>")
+	header.Add("CSeq", "1 BYE")
+	header.Add("Route", "<sip:p3.example.com;lr>")
+
+	routes, err := header.Addresses("Route")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(routes) != 3 || routes[2].URI.Host != "p3.example.com" {
+		t.Fatalf("fails to get routes got %v\n", routes)
+	}
+
+	header.SetAddresses("Route", routes[1:])
+	if len(header) != 4 || header[1].Name != "route" || header[1].Value != "<sip:p2.example.com;lr>" || header[2].Value != "<sip:p3.example.com;lr>" {
+		t.Errorf("fails to set routes got %v\n", header)
+	}
+
+	header.Insert("Record-Route", "<sip:gw.example.com;lr>")
+	header.Insert("Record-Route", "<sip:gw2.example.com;lr>")
+	if values := header.Values("record-route"); len(values) != 2 || values[0] != "<sip:gw2.example.com;lr>" {
+		t.Errorf("fails to insert got %v\n", header)
+	}
+}
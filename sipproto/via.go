@@ -0,0 +1,161 @@
+package sipproto
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidVia = errors.New("sip: invalid via")
+)
+
+// BranchMagicCookie starts the branch of RFC 3261 compliant requests.
+const BranchMagicCookie = "z9hG4bK"
+
+// Via is a single via-parm RFC 3261 section 20.42.
+type Via struct {
+	// Protocol ex: SIP/2.0
+	Protocol string
+	// Transport ex: UDP, TCP, TLS, WS, WSS
+	Transport string
+	Host      string
+	Port      int
+	Params    Params
+}
+
+func ParseVia(value string) (*Via, error) {
+	value = strings.TrimSpace(value)
+	idx := strings.IndexAny(value, " \t")
+	if idx < 0 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidVia, value)
+	}
+	sentProtocol := value[:idx]
+	slash := strings.LastIndexByte(sentProtocol, '/')
+	if slash <= 0 {
+		return nil, fmt.Errorf("%w: bad protocol %q", ErrInvalidVia, value)
+	}
+	via := &Via{
+		Protocol:  sentProtocol[:slash],
+		Transport: strings.ToUpper(sentProtocol[slash+1:]),
+	}
+
+	sentBy := strings.TrimSpace(value[idx:])
+	if idx := strings.IndexByte(sentBy, ';'); idx >= 0 {
+		via.Params = parseParams(sentBy[idx+1:], ';')
+		sentBy = strings.TrimSpace(sentBy[:idx])
+	}
+	host, port, err := net.SplitHostPort(sentBy)
+	if err != nil {
+		host = strings.Trim(sentBy, "[]")
+	} else {
+		via.Port, err = strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad port %q", ErrInvalidVia, value)
+		}
+	}
+	if host == "" {
+		return nil, fmt.Errorf("%w: missing sent-by %q", ErrInvalidVia, value)
+	}
+	via.Host = host
+	return via, nil
+}
+
+func (v *Via) Branch() string {
+	branch, _ := v.Params.Get("branch")
+	return branch
+}
+
+// SentBy returns host[:port].
+func (v *Via) SentBy() string {
+	uri := URI{Host: v.Host, Port: v.Port}
+	return uri.HostPort()
+}
+
+func (v *Via) String() string {
+	var b strings.Builder
+	b.WriteString(v.Protocol)
+	b.WriteByte('/')
+	b.WriteString(v.Transport)
+	b.WriteByte(' ')
+	b.WriteString(v.SentBy())
+	v.Params.write(&b, ';')
+	return b.String()
+}
+
+func (v *Via) Clone() *Via {
+	out := *v
+	out.Params = v.Params.Clone()
+	return &out
+}
+
+// Vias returns every via of the message from top to bottom,
+// a field may carry several via-parm separated by comma.
+func (h Header) Vias() ([]*Via, error) {
+	var vias []*Via
+	for _, value := range h.Values("via") {
+		for _, part := range splitOutsideQuotes(value, ',') {
+			via, err := ParseVia(part)
+			if err != nil {
+				return nil, err
+			}
+			vias = append(vias, via)
+		}
+	}
+	return vias, nil
+}
+
+func (h Header) TopVia() (*Via, error) {
+	for _, value := range h.Values("via") {
+		return ParseVia(splitOutsideQuotes(value, ',')[0])
+	}
+	return nil, fmt.Errorf("%w: missing via", ErrInvalidVia)
+}
+
+// SetTopVia replaces the top via keeping the rest of the stack.
+func (h Header) SetTopVia(via *Via) {
+	for i, field := range h {
+		if !equalName(field.Name, "via") {
+			continue
+		}
+		parts := splitOutsideQuotes(field.Value, ',')
+		parts[0] = via.String()
+		h[i].Value = strings.Join(parts, ",")
+		return
+	}
+}
+
+// PushVia adds via on top of the stack as a new field.
+func (h *Header) PushVia(via *Via) {
+	field := HeaderField{Name: "Via", Value: via.String()}
+	for i, existing := range *h {
+		if equalName(existing.Name, "via") {
+			*h = append((*h)[:i], append(Header{field}, (*h)[i:]...)...)
+			return
+		}
+	}
+	*h = append(Header{field}, *h...)
+}
+
+// PopVia removes the top via and returns it.
+func (h *Header) PopVia() (*Via, error) {
+	for i, field := range *h {
+		if !equalName(field.Name, "via") {
+			continue
+		}
+		parts := splitOutsideQuotes(field.Value, ',')
+		via, err := ParseVia(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) > 1 {
+			(*h)[i].Value = strings.TrimSpace(strings.Join(parts[1:], ","))
+		} else {
+			*h = append((*h)[:i], (*h)[i+1:]...)
+		}
+		return via, nil
+	}
+	return nil, fmt.Errorf("%w: missing via", ErrInvalidVia)
+}
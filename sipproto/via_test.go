@@ -0,0 +1,77 @@
+package sipproto
+
+import (
+	"testing"
+)
+
+func TestParseVia(t *testing.T) {
+	via, err := ParseVia("SIP/2.0/ws df7jal23ls0d.invalid;rport;branch=z9hG4bKnashds7")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if via.Protocol != "SIP/2.0" || via.Transport != "WS" || via.Host != "df7jal23ls0d.invalid" || via.Port != 0 {
+		t.Errorf("fails to parse via got %+v\n", via)
+	}
+	if via.Branch() != "z9hG4bKnashds7" || !via.Params.Has("rport") {
+		t.Errorf("fails to get params got %v\n", via.Params)
+	}
+
+	via, err = ParseVia("SIP/2.0/UDP [2001:db8::9]:5070;branch=z9hG4bK1")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if via.Host != "2001:db8::9" || via.Port != 5070 {
+		t.Errorf("fails to parse IPv6 sent-by got %+v\n", via)
+	}
+	if via.String() != "SIP/2.0/UDP [2001:db8::9]:5070;branch=z9hG4bK1" {
+		t.Errorf("fails to marshal got %s\n", via.String())
+	}
+}
+
+func TestSetTopVia(t *testing.T) {
+	var header Header
+	header.Add("Via", "SIP/2.0/WS a.invalid;branch=z9hG4bK1, SIP/2.0/UDP b;branch=z9hG4bK2")
+	header.Add("v", "SIP/2.0/UDP c;branch=z9hG4bK3")
+
+	via, err := header.TopVia()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	via.Transport = "UDP"
+	via.Params.Set("rport", "")
+	header.SetTopVia(via)
+
+	vias, err := header.Vias()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(vias) != 3 || vias[0].String() != "SIP/2.0/UDP a.invalid;branch=z9hG4bK1;rport" || vias[2].Host != "c" {
+		t.Errorf("fails to set top via got %v\n", header)
+	}
+}
+
+func TestPushPopVia(t *testing.T) {
+	var header Header
+	header.Add("Call-ID", "abc")
+	header.Add("Via", "SIP/2.0/WS a.invalid;branch=z9hG4bK1, SIP/2.0/UDP b;branch=z9hG4bK2")
+
+	header.PushVia(&Via{Protocol: "SIP/2.0", Transport: "TCP", Host: "10.0.0.1", Port: 5060, Params: Params{{Name: "branch", Value: "z9hG4bKgw"}}})
+	if header[1].Value != "SIP/2.0/TCP 10.0.0.1:5060;branch=z9hG4bKgw" {
+		t.Errorf("fails to push via got %v\n", header)
+	}
+
+	via, err := header.PopVia()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if via.Branch() != "z9hG4bKgw" {
+		t.Errorf("fails to pop pushed via got %s\n", via)
+	}
+	via, err = header.PopVia()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if via.Branch() != "z9hG4bK1" || header.Get("via") != "SIP/2.0/UDP b;branch=z9hG4bK2" {
+		t.Errorf("fails to pop from a multi-valued field got %v\n", header)
+	}
+}
@@ -53,7 +53,7 @@ Content-Length: 0
 		t.Fatalf("%s", err)
 	}
 
-	if msg.Header["content-type"] != "application/sdp" {
+	if msg.Header.Get("content-type") != "application/sdp" {
 		t.Errorf("fails to get header content-type")
 	}
 }
@@ -89,7 +89,7 @@ Content-Length: 0
 		t.Fatalf("%s", err)
 	}
 
-	if msg.Header["content-type"] != "application/sdp" {
+	if msg.Header.Get("content-type") != "application/sdp" {
 		t.Errorf("fails to get header content-type")
 	}
 }
@@ -0,0 +1,292 @@
+package transaction
+
+import (
+	"sync"
+	"time"
+
+	"bit4bit.in/wueco/sipproto"
+)
+
+// ClientHandler is the transaction user of a client transaction.
+type ClientHandler struct {
+	// Response receives the responses for the transaction user,
+	// retransmissions are absorbed
+	Response func(rsp *sipproto.Message)
+	// Timeout is called when timer B, C or F fires
+	Timeout func()
+	// TransportError is called when a retransmission can't be sent and
+	// the transaction terminates RFC 3261 section 17.1.4, without it
+	// Timeout is called
+	TransportError func(err error)
+}
+
+// Client is an INVITE (RFC 3261 section 17.1.1) or non-INVITE
+// (section 17.1.2) client transaction.
+type Client struct {
+	layer    *Layer
+	key      Key
+	request  *sipproto.Message
+	send     Sender
+	reliable bool
+	handler  ClientHandler
+	invite   bool
+
+	mu       sync.Mutex
+	state    State
+	interval time.Duration
+	// timer A or E
+	retransmit Timer
+	// timer B or F
+	timeout Timer
+	timerC  Timer
+	// the CANCEL was sent when timer C fired
+	canceled bool
+	// timer D or K
+	wait Timer
+	ack  *sipproto.Message
+}
+
+func newClient(layer *Layer, key Key, req *sipproto.Message, send Sender, reliable bool, handler ClientHandler) *Client {
+	return &Client{
+		layer:    layer,
+		key:      key,
+		request:  req,
+		send:     send,
+		reliable: reliable,
+		handler:  handler,
+		invite:   req.Request.Method == "INVITE",
+	}
+}
+
+func (c *Client) Key() Key {
+	return c.key
+}
+
+func (c *Client) Request() *sipproto.Message {
+	return c.request
+}
+
+func (c *Client) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *Client) start() error {
+	c.mu.Lock()
+	clock := c.layer.clock
+	if c.invite {
+		c.state = StateCalling
+		c.timerC = clock.AfterFunc(c.layer.timerC, c.onTimerC)
+	} else {
+		c.state = StateTrying
+	}
+	if !c.reliable {
+		c.interval = c.layer.t1
+		c.retransmit = clock.AfterFunc(c.interval, c.onRetransmit)
+	}
+	c.timeout = clock.AfterFunc(64*c.layer.t1, c.onTimeout)
+	c.mu.Unlock()
+
+	if err := c.send(c.request); err != nil {
+		c.mu.Lock()
+		c.terminate()
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// onRetransmit is timer A or E, a retransmission that can't be
+// sent terminates the transaction like the first request.
+func (c *Client) onRetransmit() {
+	c.mu.Lock()
+	switch {
+	case c.invite && c.state == StateCalling:
+		c.interval *= 2
+	case !c.invite && c.state == StateTrying:
+		c.interval *= 2
+		if c.interval > c.layer.t2 {
+			c.interval = c.layer.t2
+		}
+	case !c.invite && c.state == StateProceeding:
+		c.interval = c.layer.t2
+	default:
+		c.mu.Unlock()
+		return
+	}
+	if err := c.send(c.request); err != nil {
+		c.terminate()
+		c.mu.Unlock()
+		c.transportError(err)
+		return
+	}
+	c.retransmit = c.layer.clock.AfterFunc(c.interval, c.onRetransmit)
+	c.mu.Unlock()
+}
+
+// onTimeout is timer B or F.
+func (c *Client) onTimeout() {
+	c.mu.Lock()
+	if c.invite && c.state != StateCalling || !c.invite && c.state != StateTrying && c.state != StateProceeding {
+		c.mu.Unlock()
+		return
+	}
+	c.terminate()
+	c.mu.Unlock()
+	c.timedOut()
+}
+
+// onTimerC is timer C RFC 3261 section 16.8, the branch with a provisional
+// response is canceled and it times out when no final response arrives
+// 64*T1 after the CANCEL.
+func (c *Client) onTimerC() {
+	c.mu.Lock()
+	if c.state != StateProceeding {
+		c.mu.Unlock()
+		return
+	}
+	if c.canceled {
+		c.terminate()
+		c.mu.Unlock()
+		c.timedOut()
+		return
+	}
+	c.canceled = true
+	c.timerC = c.layer.clock.AfterFunc(64*c.layer.t1, c.onTimerC)
+	c.mu.Unlock()
+
+	if _, err := c.layer.Request(sipproto.NewCancel(c.request), c.send, c.reliable, ClientHandler{}); err != nil {
+		c.mu.Lock()
+		c.terminate()
+		c.mu.Unlock()
+		c.transportError(err)
+	}
+}
+
+func (c *Client) timedOut() {
+	if c.handler.Timeout != nil {
+		c.handler.Timeout()
+	}
+}
+
+func (c *Client) transportError(err error) {
+	if c.handler.TransportError == nil {
+		c.timedOut()
+		return
+	}
+	c.handler.TransportError(err)
+}
+
+func (c *Client) receive(rsp *sipproto.Message) {
+	if rsp.Response == nil {
+		return
+	}
+	c.mu.Lock()
+	deliver := false
+	if c.invite {
+		deliver = c.receiveInvite(rsp)
+	} else {
+		deliver = c.receiveNonInvite(rsp)
+	}
+	c.mu.Unlock()
+
+	if deliver && c.handler.Response != nil {
+		c.handler.Response(rsp)
+	}
+}
+
+func (c *Client) receiveInvite(rsp *sipproto.Message) bool {
+	switch c.state {
+	case StateCalling, StateProceeding:
+		stopTimer(c.retransmit)
+		switch {
+		case rsp.Response.IsProvisional():
+			c.state = StateProceeding
+			stopTimer(c.timerC)
+			c.timerC = c.layer.clock.AfterFunc(c.layer.timerC, c.onTimerC)
+		case rsp.Response.IsSuccess():
+			c.terminate()
+		default:
+			c.ack = newAck(c.request, rsp)
+			c.send(c.ack)
+			c.state = StateCompleted
+			c.stopTimers()
+			c.wait = c.after(wait(c.reliable, TimerD))
+		}
+		return true
+	case StateCompleted:
+		if !rsp.Response.IsSuccess() && rsp.Response.IsFinal() {
+			c.send(c.ack)
+		}
+	}
+	return false
+}
+
+func (c *Client) receiveNonInvite(rsp *sipproto.Message) bool {
+	switch c.state {
+	case StateTrying, StateProceeding:
+		if rsp.Response.IsProvisional() {
+			c.state = StateProceeding
+			return true
+		}
+		c.state = StateCompleted
+		c.stopTimers()
+		c.wait = c.after(wait(c.reliable, c.layer.t4))
+		return true
+	}
+	return false
+}
+
+// after terminates the transaction after d.
+func (c *Client) after(d time.Duration) Timer {
+	if d == 0 {
+		c.terminate()
+		return nil
+	}
+	return c.layer.clock.AfterFunc(d, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.terminate()
+	})
+}
+
+func (c *Client) stopTimers() {
+	stopTimer(c.retransmit)
+	stopTimer(c.timeout)
+	stopTimer(c.timerC)
+}
+
+func (c *Client) terminate() {
+	if c.state == StateTerminated {
+		return
+	}
+	c.state = StateTerminated
+	c.stopTimers()
+	stopTimer(c.wait)
+	c.layer.removeClient(c.key, c)
+}
+
+// newAck builds the ACK for a non-2xx final response RFC 3261 section 17.1.1.3.
+func newAck(req, rsp *sipproto.Message) *sipproto.Message {
+	ack := &sipproto.Message{Request: req.Request.Clone()}
+	ack.Request.Method = "ACK"
+	if via, err := req.Header.TopVia(); err == nil {
+		ack.Header.Add("Via", via.String())
+	}
+	for _, name := range []string{"Max-Forwards", "From"} {
+		if value := req.Header.Get(name); value != "" {
+			ack.Header.Add(name, value)
+		}
+	}
+	ack.Header.Add("To", rsp.Header.Get("to"))
+	ack.Header.Add("Call-ID", req.Header.Get("call-id"))
+	if cseq, err := sipproto.ParseCSeq(req.Header.Get("cseq")); err == nil {
+		ack.Header.Add("CSeq", sipproto.CSeq{Seq: cseq.Seq, Method: "ACK"}.String())
+	}
+	for _, route := range req.Header.Values("route") {
+		ack.Header.Add("Route", route)
+	}
+	ack.StatusLine = ack.Request.String()
+	return ack
+}
@@ -0,0 +1,25 @@
+package transaction
+
+import (
+	"time"
+)
+
+// Timer is a pending function of a Clock.
+type Timer interface {
+	Stop() bool
+}
+
+// Clock runs the timers of the transactions, tests replace it
+// to control the time.
+type Clock interface {
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type systemClock struct{}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// SystemClock uses the timers of package time.
+var SystemClock Clock = systemClock{}
@@ -0,0 +1,185 @@
+package transaction
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"bit4bit.in/wueco/sipproto"
+)
+
+// Server is an INVITE (RFC 3261 section 17.2.1) or non-INVITE
+// (section 17.2.2) server transaction.
+type Server struct {
+	layer    *Layer
+	key      Key
+	request  *sipproto.Message
+	send     Sender
+	reliable bool
+	invite   bool
+
+	mu       sync.Mutex
+	state    State
+	last     *sipproto.Message
+	interval time.Duration
+	// timer G
+	retransmit Timer
+	// timer H
+	timeout Timer
+	// timer I or J
+	wait Timer
+}
+
+func newServer(layer *Layer, key Key, req *sipproto.Message, send Sender, reliable bool) *Server {
+	return &Server{
+		layer:    layer,
+		key:      key,
+		request:  req,
+		send:     send,
+		reliable: reliable,
+		invite:   req.Request.Method == "INVITE",
+	}
+}
+
+func (s *Server) Key() Key {
+	return s.key
+}
+
+func (s *Server) Request() *sipproto.Message {
+	return s.request
+}
+
+func (s *Server) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// start sends 100 Trying for INVITE, the transaction user
+// may take longer than 200ms RFC 3261 section 17.2.1.
+func (s *Server) start() error {
+	if !s.invite {
+		s.mu.Lock()
+		s.state = StateTrying
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Lock()
+	s.state = StateProceeding
+	s.mu.Unlock()
+	return s.Respond(sipproto.NewResponse(s.request, 100, "Trying"))
+}
+
+// Respond sends a response of the transaction user.
+func (s *Server) Respond(rsp *sipproto.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.invite {
+		return s.respondInvite(rsp)
+	}
+	return s.respondNonInvite(rsp)
+}
+
+func (s *Server) respondInvite(rsp *sipproto.Message) error {
+	if s.state != StateProceeding {
+		return fmt.Errorf("%w: respond %d in %s", ErrInvalidState, rsp.Response.StatusCode, s.state)
+	}
+	err := s.send(rsp)
+	switch {
+	case rsp.Response.IsProvisional():
+		s.last = rsp
+	case rsp.Response.IsSuccess():
+		// the 2xx retransmissions belongs to the transaction user
+		s.terminate()
+	default:
+		s.last = rsp
+		s.state = StateCompleted
+		if !s.reliable {
+			s.interval = s.layer.t1
+			s.retransmit = s.layer.clock.AfterFunc(s.interval, s.onRetransmit)
+		}
+		s.timeout = s.layer.clock.AfterFunc(64*s.layer.t1, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.state == StateCompleted {
+				s.terminate()
+			}
+		})
+	}
+	return err
+}
+
+func (s *Server) respondNonInvite(rsp *sipproto.Message) error {
+	if s.state != StateTrying && s.state != StateProceeding {
+		return fmt.Errorf("%w: respond %d in %s", ErrInvalidState, rsp.Response.StatusCode, s.state)
+	}
+	err := s.send(rsp)
+	s.last = rsp
+	if rsp.Response.IsProvisional() {
+		s.state = StateProceeding
+		return err
+	}
+	s.state = StateCompleted
+	s.wait = s.after(wait(s.reliable, 64*s.layer.t1))
+	return err
+}
+
+// onRetransmit is timer G.
+func (s *Server) onRetransmit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != StateCompleted {
+		return
+	}
+	s.send(s.last)
+	s.interval *= 2
+	if s.interval > s.layer.t2 {
+		s.interval = s.layer.t2
+	}
+	s.retransmit = s.layer.clock.AfterFunc(s.interval, s.onRetransmit)
+}
+
+// receive handles retransmissions of the request and the ACK.
+func (s *Server) receive(req *sipproto.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req.Request.Method == "ACK" {
+		if s.invite && s.state == StateCompleted {
+			s.state = StateConfirmed
+			stopTimer(s.retransmit)
+			stopTimer(s.timeout)
+			s.wait = s.after(wait(s.reliable, s.layer.t4))
+		}
+		return
+	}
+	switch s.state {
+	case StateProceeding, StateCompleted:
+		if s.last != nil {
+			s.send(s.last)
+		}
+	}
+}
+
+// after terminates the transaction after d.
+func (s *Server) after(d time.Duration) Timer {
+	if d == 0 {
+		s.terminate()
+		return nil
+	}
+	return s.layer.clock.AfterFunc(d, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.terminate()
+	})
+}
+
+func (s *Server) terminate() {
+	if s.state == StateTerminated {
+		return
+	}
+	s.state = StateTerminated
+	stopTimer(s.retransmit)
+	stopTimer(s.timeout)
+	stopTimer(s.wait)
+	s.layer.removeServer(s.key, s)
+}
@@ -0,0 +1,260 @@
+// Package transaction implements the SIP transactions of RFC 3261
+// section 17: INVITE and non-INVITE client and server transactions.
+package transaction
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"bit4bit.in/wueco/sipproto"
+)
+
+var (
+	ErrMissingBranch = errors.New("transaction: missing RFC 3261 branch")
+	ErrExists        = errors.New("transaction: already exists")
+	ErrInvalidState  = errors.New("transaction: invalid state")
+)
+
+// default timer values RFC 3261 section 17.1.1.1 and table 4
+const (
+	T1 = 500 * time.Millisecond
+	T2 = 4 * time.Second
+	T4 = 5 * time.Second
+	// TimerC is the proxy INVITE timer RFC 3261 section 16.6
+	TimerC = 3 * time.Minute
+	// TimerD is the wait for response retransmissions over unreliable transports
+	TimerD = 32 * time.Second
+)
+
+type State int
+
+const (
+	StateCalling State = iota
+	StateTrying
+	StateProceeding
+	StateCompleted
+	StateConfirmed
+	StateTerminated
+)
+
+func (s State) String() string {
+	switch s {
+	case StateCalling:
+		return "Calling"
+	case StateTrying:
+		return "Trying"
+	case StateProceeding:
+		return "Proceeding"
+	case StateCompleted:
+		return "Completed"
+	case StateConfirmed:
+		return "Confirmed"
+	case StateTerminated:
+		return "Terminated"
+	}
+	return "Unknown"
+}
+
+// Sender writes a message to the transport of the transaction.
+type Sender func(msg *sipproto.Message) error
+
+// Key matches the messages of a transaction RFC 3261 section 17.1.3
+// and 17.2.3, SentBy is only used by server transactions.
+type Key struct {
+	Branch string
+	SentBy string
+	Method string
+}
+
+func clientKey(msg *sipproto.Message) (Key, error) {
+	return newKey(msg, false)
+}
+
+func serverKey(msg *sipproto.Message) (Key, error) {
+	return newKey(msg, true)
+}
+
+// ServerKey returns the key of the server transaction of a request,
+// the key of an ACK is the key of its INVITE.
+func ServerKey(req *sipproto.Message) (Key, error) {
+	return serverKey(req)
+}
+
+func newKey(msg *sipproto.Message, server bool) (Key, error) {
+	via, err := msg.Header.TopVia()
+	if err != nil {
+		return Key{}, err
+	}
+	if !strings.HasPrefix(via.Branch(), sipproto.BranchMagicCookie) {
+		return Key{}, fmt.Errorf("%w: %q", ErrMissingBranch, via.Branch())
+	}
+	cseq, err := sipproto.ParseCSeq(msg.Header.Get("cseq"))
+	if err != nil {
+		return Key{}, err
+	}
+	key := Key{Branch: via.Branch(), Method: cseq.Method}
+	if key.Method == "ACK" {
+		key.Method = "INVITE"
+	}
+	if server {
+		key.SentBy = via.SentBy()
+	}
+	return key, nil
+}
+
+// Layer keeps the transactions alive until they terminate.
+type Layer struct {
+	clock  Clock
+	t1     time.Duration
+	t2     time.Duration
+	t4     time.Duration
+	timerC time.Duration
+
+	mu      sync.Mutex
+	clients map[Key]*Client
+	servers map[Key]*Server
+}
+
+type Option func(*Layer)
+
+// WithClock sets the clock of the timers.
+func WithClock(clock Clock) Option {
+	return func(l *Layer) {
+		l.clock = clock
+	}
+}
+
+// WithTimers changes the values of T1, T2 and T4.
+func WithTimers(t1, t2, t4 time.Duration) Option {
+	return func(l *Layer) {
+		l.t1 = t1
+		l.t2 = t2
+		l.t4 = t4
+	}
+}
+
+func NewLayer(opts ...Option) *Layer {
+	l := &Layer{
+		clock:   SystemClock,
+		t1:      T1,
+		t2:      T2,
+		t4:      T4,
+		timerC:  TimerC,
+		clients: make(map[Key]*Client),
+		servers: make(map[Key]*Server),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Request starts a client transaction sending req, the ACK requests
+// don't have a transaction and they must be sent by the caller.
+func (l *Layer) Request(req *sipproto.Message, send Sender, reliable bool, handler ClientHandler) (*Client, error) {
+	key, err := clientKey(req)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	if _, ok := l.clients[key]; ok {
+		l.mu.Unlock()
+		return nil, fmt.Errorf("%w: %v", ErrExists, key)
+	}
+	client := newClient(l, key, req, send, reliable, handler)
+	l.clients[key] = client
+	l.mu.Unlock()
+
+	if err := client.start(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Response passes rsp to its client transaction, it returns false when
+// no transaction matches (ex: retransmissions of 2xx) so the caller
+// handles it.
+func (l *Layer) Response(rsp *sipproto.Message) bool {
+	key, err := clientKey(rsp)
+	if err != nil {
+		return false
+	}
+	l.mu.Lock()
+	client, ok := l.clients[key]
+	l.mu.Unlock()
+	if !ok {
+		return false
+	}
+	client.receive(rsp)
+	return true
+}
+
+// Receive passes a request to its server transaction, a new transaction is
+// created when none matches and isNew is true, the retransmissions and the
+// ACK for non-2xx are absorbed. ACK for 2xx returns a nil Server.
+func (l *Layer) Receive(req *sipproto.Message, send Sender, reliable bool) (server *Server, isNew bool, err error) {
+	key, err := serverKey(req)
+	if err != nil {
+		return nil, false, err
+	}
+	l.mu.Lock()
+	server, ok := l.servers[key]
+	if ok {
+		l.mu.Unlock()
+		server.receive(req)
+		return server, false, nil
+	}
+	if req.Request.Method == "ACK" {
+		l.mu.Unlock()
+		return nil, false, nil
+	}
+	server = newServer(l, key, req, send, reliable)
+	l.servers[key] = server
+	l.mu.Unlock()
+
+	if err := server.start(); err != nil {
+		return nil, false, err
+	}
+	return server, true, nil
+}
+
+// Server returns the server transaction of key.
+func (l *Layer) Server(key Key) (*Server, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	server, ok := l.servers[key]
+	return server, ok
+}
+
+func (l *Layer) removeClient(key Key, client *Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients[key] == client {
+		delete(l.clients, key)
+	}
+}
+
+func (l *Layer) removeServer(key Key, server *Server) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.servers[key] == server {
+		delete(l.servers, key)
+	}
+}
+
+// wait returns d for unreliable transports and zero for reliable.
+func wait(reliable bool, d time.Duration) time.Duration {
+	if reliable {
+		return 0
+	}
+	return d
+}
+
+func stopTimer(timer Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
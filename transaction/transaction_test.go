@@ -0,0 +1,416 @@
+package transaction
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"bit4bit.in/wueco/sipproto"
+)
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Duration
+	f       func()
+	stopped bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := !t.stopped
+	t.stopped = true
+	return active
+}
+
+// fakeClock runs the timers when the time is advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Duration
+	timers []*fakeTimer
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &fakeTimer{clock: c, at: c.now + d, f: f}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now + d
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at < c.timers[j].at })
+		if len(c.timers) == 0 || c.timers[0].at > end {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		timer := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = timer.at
+		run := !timer.stopped
+		timer.stopped = true
+		c.mu.Unlock()
+		if run {
+			timer.f()
+		}
+	}
+}
+
+type sent struct {
+	mu   sync.Mutex
+	msgs []*sipproto.Message
+}
+
+func (s *sent) send(msg *sipproto.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgs = append(s.msgs, msg)
+	return nil
+}
+
+func (s *sent) count(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, msg := range s.msgs {
+		if msg.Request != nil && msg.Request.Method == method {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *sent) responses(code int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, msg := range s.msgs {
+		if msg.Response != nil && msg.Response.StatusCode == code {
+			n++
+		}
+	}
+	return n
+}
+
+func parse(t *testing.T, pdu string) *sipproto.Message {
+	msg, err := sipproto.NewReader(bufio.NewReader(bytes.NewBufferString(pdu))).ReadMessage()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return msg
+}
+
+const invite = `INVITE sip:bob@biloxi.com SIP/2.0
+Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds
+Max-Forwards: 70
+To: Bob <sip:bob@biloxi.com>
+From: Alice <sip:alice@atlanta.com>;tag=1928301774
+Call-ID: a84b4c76e66710@pc33.atlanta.com
+CSeq: 314159 INVITE
+Content-Length: 0
+
+`
+
+const register = `REGISTER sip:biloxi.com SIP/2.0
+Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bKnashds7
+To: Bob <sip:bob@biloxi.com>
+From: Bob <sip:bob@biloxi.com>;tag=456248
+Call-ID: 843817637684230@998sdasdh09
+CSeq: 1826 REGISTER
+Content-Length: 0
+
+`
+
+func response(t *testing.T, req *sipproto.Message, code int) *sipproto.Message {
+	rsp := sipproto.NewResponse(req, code, "Reason")
+	if code > 100 {
+		rsp.Header.Set("To", req.Header.Get("to")+";tag=a6c85cf")
+	}
+	return parse(t, string(rsp.Bytes()))
+}
+
+func TestInviteClientRetransmitsAndTimesOut(t *testing.T) {
+	clock := &fakeClock{}
+	layer := NewLayer(WithClock(clock))
+	out := &sent{}
+	timeout := false
+
+	req := parse(t, invite)
+	_, err := layer.Request(req, out.send, false, ClientHandler{Timeout: func() { timeout = true }})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// timer A: 500ms, 1s, 2s, 4s, 8s, 16s until timer B at 32s
+	clock.Advance(64*T1 - time.Millisecond)
+	if n := out.count("INVITE"); n != 7 {
+		t.Errorf("expected 7 INVITE got %d", n)
+	}
+	if timeout {
+		t.Errorf("timeout before timer B")
+	}
+	clock.Advance(time.Millisecond)
+	if !timeout {
+		t.Errorf("expected timeout on timer B")
+	}
+	if layer.Response(response(t, req, 200)) {
+		t.Errorf("terminated transaction must not match")
+	}
+}
+
+func TestInviteClientReliableDoesNotRetransmit(t *testing.T) {
+	clock := &fakeClock{}
+	layer := NewLayer(WithClock(clock))
+	out := &sent{}
+
+	if _, err := layer.Request(parse(t, invite), out.send, true, ClientHandler{}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	clock.Advance(10 * time.Second)
+	if n := out.count("INVITE"); n != 1 {
+		t.Errorf("expected 1 INVITE got %d", n)
+	}
+}
+
+func TestInviteClientAcksNon2xx(t *testing.T) {
+	clock := &fakeClock{}
+	layer := NewLayer(WithClock(clock))
+	out := &sent{}
+	var responses []int
+
+	req := parse(t, invite)
+	client, err := layer.Request(req, out.send, false, ClientHandler{
+		Response: func(rsp *sipproto.Message) { responses = append(responses, rsp.Response.StatusCode) },
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	layer.Response(response(t, req, 180))
+	clock.Advance(2 * time.Second)
+	if n := out.count("INVITE"); n != 1 {
+		t.Errorf("provisional must stop timer A got %d INVITE", n)
+	}
+
+	busy := response(t, req, 486)
+	layer.Response(busy)
+	layer.Response(busy)
+	if client.State() != StateCompleted {
+		t.Errorf("expected Completed got %s", client.State())
+	}
+	if n := out.count("ACK"); n != 2 {
+		t.Errorf("expected ACK per final response got %d", n)
+	}
+	if len(responses) != 2 || responses[1] != 486 {
+		t.Errorf("retransmissions must be absorbed got %v", responses)
+	}
+
+	ack := out.msgs[len(out.msgs)-1]
+	via, _ := ack.Header.TopVia()
+	if via.Branch() != "z9hG4bK776asdhds" || ack.Header.Get("cseq") != "314159 ACK" || ack.Header.Get("to") != busy.Header.Get("to") {
+		t.Errorf("fails to build ACK got %s", ack.Bytes())
+	}
+
+	clock.Advance(TimerD)
+	if client.State() != StateTerminated {
+		t.Errorf("expected Terminated after timer D got %s", client.State())
+	}
+}
+
+func TestInviteClientTimerCCancels(t *testing.T) {
+	clock := &fakeClock{}
+	layer := NewLayer(WithClock(clock))
+	out := &sent{}
+	timeout := false
+
+	req := parse(t, invite)
+	client, err := layer.Request(req, out.send, true, ClientHandler{Timeout: func() { timeout = true }})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	layer.Response(response(t, req, 180))
+	clock.Advance(TimerC)
+	if n := out.count("CANCEL"); n != 1 {
+		t.Fatalf("expected CANCEL on timer C got %d", n)
+	}
+	if timeout || client.State() != StateProceeding {
+		t.Errorf("the branch waits the final response after CANCEL got %s", client.State())
+	}
+
+	clock.Advance(64 * T1)
+	if !timeout || client.State() != StateTerminated {
+		t.Errorf("expected timeout without final response after CANCEL got %s", client.State())
+	}
+}
+
+func TestClientRetransmitTransportError(t *testing.T) {
+	clock := &fakeClock{}
+	layer := NewLayer(WithClock(clock))
+	var reported error
+	failed := errors.New("connection refused")
+	sends := 0
+	send := func(*sipproto.Message) error {
+		sends++
+		if sends > 1 {
+			return failed
+		}
+		return nil
+	}
+
+	client, err := layer.Request(parse(t, register), send, false, ClientHandler{
+		Timeout:        func() { t.Errorf("unexpected timeout") },
+		TransportError: func(err error) { reported = err },
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	clock.Advance(T1)
+	if reported != failed || client.State() != StateTerminated {
+		t.Errorf("expected the transport error reported got %v %s", reported, client.State())
+	}
+	clock.Advance(64 * T1)
+	if sends != 2 {
+		t.Errorf("expected no retransmission after the error got %d sends", sends)
+	}
+}
+
+func TestNonInviteClient(t *testing.T) {
+	clock := &fakeClock{}
+	layer := NewLayer(WithClock(clock))
+	out := &sent{}
+	final := 0
+
+	req := parse(t, register)
+	client, err := layer.Request(req, out.send, false, ClientHandler{
+		Response: func(rsp *sipproto.Message) { final = rsp.Response.StatusCode },
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// timer E: 500ms, 1s, 2s, 4s, 4s
+	clock.Advance(11500 * time.Millisecond)
+	if n := out.count("REGISTER"); n != 6 {
+		t.Errorf("expected 6 REGISTER got %d", n)
+	}
+
+	layer.Response(response(t, req, 200))
+	if final != 200 || client.State() != StateCompleted {
+		t.Errorf("expected Completed with 200 got %d %s", final, client.State())
+	}
+	clock.Advance(T4)
+	if client.State() != StateTerminated {
+		t.Errorf("expected Terminated after timer K got %s", client.State())
+	}
+}
+
+func TestNonInviteClientTimeout(t *testing.T) {
+	clock := &fakeClock{}
+	layer := NewLayer(WithClock(clock))
+	timeout := false
+
+	if _, err := layer.Request(parse(t, register), (&sent{}).send, true, ClientHandler{Timeout: func() { timeout = true }}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	clock.Advance(64 * T1)
+	if !timeout {
+		t.Errorf("expected timeout on timer F")
+	}
+}
+
+func TestInviteServer(t *testing.T) {
+	clock := &fakeClock{}
+	layer := NewLayer(WithClock(clock))
+	out := &sent{}
+
+	req := parse(t, invite)
+	server, isNew, err := layer.Receive(req, out.send, false)
+	if err != nil || !isNew {
+		t.Fatalf("expected new transaction %s", err)
+	}
+	if out.responses(100) != 1 {
+		t.Errorf("expected 100 Trying")
+	}
+
+	// retransmission gets the last response
+	if _, isNew, _ := layer.Receive(parse(t, invite), out.send, false); isNew {
+		t.Errorf("retransmission must match the transaction")
+	}
+	if out.responses(100) != 2 {
+		t.Errorf("expected 100 Trying retransmitted")
+	}
+
+	if err := server.Respond(response(t, req, 486)); err != nil {
+		t.Fatalf("%s", err)
+	}
+	// timer G: 500ms, 1s, 2s
+	clock.Advance(3500 * time.Millisecond)
+	if n := out.responses(486); n != 4 {
+		t.Errorf("expected 4 486 got %d", n)
+	}
+
+	ack := parse(t, string(newAck(req, response(t, req, 486)).Bytes()))
+	if srv, _, _ := layer.Receive(ack, out.send, false); srv != server {
+		t.Errorf("ACK must match the INVITE transaction")
+	}
+	if server.State() != StateConfirmed {
+		t.Errorf("expected Confirmed got %s", server.State())
+	}
+	clock.Advance(10 * time.Second)
+	if n := out.responses(486); n != 4 {
+		t.Errorf("ACK must stop timer G got %d", n)
+	}
+	if server.State() != StateTerminated {
+		t.Errorf("expected Terminated after timer I got %s", server.State())
+	}
+}
+
+func TestInviteServerWithoutAck(t *testing.T) {
+	clock := &fakeClock{}
+	layer := NewLayer(WithClock(clock))
+
+	req := parse(t, invite)
+	server, _, _ := layer.Receive(req, (&sent{}).send, false)
+	server.Respond(response(t, req, 404))
+	clock.Advance(64 * T1)
+	if server.State() != StateTerminated {
+		t.Errorf("expected Terminated after timer H got %s", server.State())
+	}
+}
+
+func TestNonInviteServer(t *testing.T) {
+	clock := &fakeClock{}
+	layer := NewLayer(WithClock(clock))
+	out := &sent{}
+
+	req := parse(t, register)
+	server, _, err := layer.Receive(req, out.send, false)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if out.responses(100) != 0 {
+		t.Errorf("non-INVITE must not send 100 Trying")
+	}
+	server.Respond(response(t, req, 200))
+	layer.Receive(parse(t, register), out.send, false)
+	if n := out.responses(200); n != 2 {
+		t.Errorf("retransmission must get the final response got %d", n)
+	}
+	if err := server.Respond(response(t, req, 200)); err == nil {
+		t.Errorf("expected error responding twice")
+	}
+	clock.Advance(64 * T1)
+	if server.State() != StateTerminated {
+		t.Errorf("expected Terminated after timer J got %s", server.State())
+	}
+}
@@ -0,0 +1,71 @@
+package transport
+
+import (
+	"bufio"
+	"net"
+
+	"bit4bit.in/wueco/sipproto"
+)
+
+// Pinger is implemented by the connections with the CRLF keepalive
+// of RFC 5626 section 4.4.1.
+type Pinger interface {
+	// Ping sends a double CRLF
+	Ping() error
+	// Pong receives the CRLF answered by the server
+	Pong() <-chan struct{}
+}
+
+// streamConn frames the messages of a stream oriented connection
+// by Content-Length.
+type streamConn struct {
+	net.Conn
+	reader    sipproto.Reader
+	transport string
+	pong      chan struct{}
+}
+
+func newStreamConn(conn net.Conn, transport string) *streamConn {
+	c := &streamConn{
+		Conn:      conn,
+		transport: transport,
+		pong:      make(chan struct{}, 1),
+	}
+	reader := sipproto.NewReader(bufio.NewReader(conn))
+	reader.SetKeepalive(c.keepalive)
+	c.reader = reader
+	return c
+}
+
+func (c *streamConn) ReadMessage() (*sipproto.Message, error) {
+	return c.reader.ReadMessage()
+}
+
+func (c *streamConn) Transport() string {
+	return c.transport
+}
+
+func (c *streamConn) Reliable() bool {
+	return true
+}
+
+func (c *streamConn) Ping() error {
+	_, err := c.Write([]byte("\r\n\r\n"))
+	return err
+}
+
+func (c *streamConn) Pong() <-chan struct{} {
+	return c.pong
+}
+
+// keepalive answers the pings of the server and passes the pongs.
+func (c *streamConn) keepalive(ping bool) {
+	if ping {
+		c.Write([]byte("\r\n"))
+		return
+	}
+	select {
+	case c.pong <- struct{}{}:
+	default:
+	}
+}
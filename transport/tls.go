@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// TLSOptions configures the TLS connection to the SIP server.
+type TLSOptions struct {
+	// CAFile is a PEM bundle to verify the server, the system
+	// pool is used when it's empty
+	CAFile string
+	// CertFile and KeyFile are the optional client certificate
+	CertFile string
+	KeyFile  string
+	// ServerName is used for SNI and to verify the certificate,
+	// by default the host of the target
+	ServerName string
+}
+
+// Config builds the tls.Config, the certificate of the server
+// is always verified.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: o.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("transport: fails to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("transport: no certificates in %s", o.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, errors.New("transport: client certificate requires cert and key")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("transport: fails to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func dialTLS(address string, config *tls.Config) (Conn, error) {
+	if config == nil {
+		config = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	conn, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamConn(conn, "TLS"), nil
+}
@@ -0,0 +1,132 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bit4bit.in/wueco/sipproto"
+)
+
+// newTestCertificate returns a self signed certificate for sip.example.com
+// and the path of its PEM.
+func newTestCertificate(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sip.example.com"},
+		DNSNames:              []string{"sip.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+func TestTLSConn(t *testing.T) {
+	cert, caFile := newTestCertificate(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer ln.Close()
+
+	received := make(chan *sipproto.Message, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msg, err := sipproto.NewReader(bufio.NewReader(conn)).ReadMessage()
+		if err != nil {
+			close(received)
+			return
+		}
+		received <- msg
+	}()
+
+	config, err := TLSOptions{CAFile: caFile, ServerName: "sip.example.com"}.Config()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	conn, err := Dial(Target{Transport: "tls", Address: ln.Addr().String()}, WithTLSConfig(config))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+	if conn.Transport() != "TLS" || !conn.Reliable() {
+		t.Errorf("expected reliable TLS transport")
+	}
+
+	if _, err := conn.Write([]byte(options)); err != nil {
+		t.Fatalf("%s", err)
+	}
+	msg := <-received
+	if msg == nil || msg.Request.Method != "OPTIONS" {
+		t.Errorf("fails to send over tls got %+v\n", msg)
+	}
+}
+
+func TestTLSVerifiesServerName(t *testing.T) {
+	cert, caFile := newTestCertificate(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	config, err := TLSOptions{CAFile: caFile, ServerName: "other.example.com"}.Config()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := Dial(Target{Transport: "tls", Address: ln.Addr().String()}, WithTLSConfig(config)); err == nil {
+		t.Errorf("expected verification error")
+	}
+
+	// without the CA the system pool doesn't trust the certificate
+	if _, err := Dial(Target{Transport: "tls", Address: ln.Addr().String()}); err == nil {
+		t.Errorf("expected unknown authority error")
+	}
+}
+
+func TestTLSOptionsRequiresKeyPair(t *testing.T) {
+	if _, err := (TLSOptions{CertFile: "cert.pem"}).Config(); err == nil {
+		t.Errorf("expected error without key")
+	}
+}
@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"bit4bit.in/wueco/sipproto"
+)
+
+var (
+	ErrUnknownTransport = errors.New("transport: unknown transport")
+)
+
+// MaxDatagramSize is the size from which a request over UDP
+// must use a congestion controlled transport RFC 3261 section 18.1.1.
+const MaxDatagramSize = 1300
+
+// Conn is a connection to a SIP server.
+type Conn interface {
+	ReadMessage() (*sipproto.Message, error)
+	Write(p []byte) (int, error)
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	// Transport is the name used in Via ex: UDP, TCP
+	Transport() string
+	// Reliable is false when the messages can be lost
+	Reliable() bool
+	Close() error
+}
+
+// Target is a SIP destination ex: udp:1.2.3.4:5060.
+type Target struct {
+	// Transport ex: udp, tcp, tls
+	Transport string
+	Address   string
+}
+
+// ParseTarget parses [transport:]host:port, tcp is used
+// when the transport is missing.
+func ParseTarget(s string) (Target, error) {
+	target := Target{Transport: "tcp", Address: s}
+	if idx := strings.IndexByte(s, ':'); idx > 0 {
+		switch name := strings.ToLower(s[:idx]); name {
+		case "udp", "tcp", "tls":
+			target = Target{Transport: name, Address: s[idx+1:]}
+		}
+	}
+	if _, _, err := net.SplitHostPort(target.Address); err != nil {
+		return Target{}, fmt.Errorf("transport: invalid target %q: %w", s, err)
+	}
+	return target, nil
+}
+
+func (t Target) String() string {
+	return t.Transport + ":" + t.Address
+}
+
+type dialOptions struct {
+	tlsConfig *tls.Config
+}
+
+type DialOption func(*dialOptions)
+
+// WithTLSConfig sets the configuration of tls targets.
+func WithTLSConfig(config *tls.Config) DialOption {
+	return func(c *dialOptions) {
+		c.tlsConfig = config
+	}
+}
+
+func Dial(target Target, opts ...DialOption) (Conn, error) {
+	options := &dialOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	switch target.Transport {
+	case "tls":
+		return dialTLS(target.Address, options.tlsConfig)
+	case "udp":
+		return dialUDP(target.Address)
+	case "tcp":
+		conn, err := net.Dial("tcp", target.Address)
+		if err != nil {
+			return nil, err
+		}
+		return newStreamConn(conn, "TCP"), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownTransport, target.Transport)
+}
+
+// Select returns the connection for sending a request of size bytes,
+// over UDP the large requests are sent by TCP to the same server
+// RFC 3261 section 18.1.1. When TCP fails conn is returned with the error.
+func Select(conn Conn, size int) (Conn, error) {
+	udp, ok := conn.(*udpConn)
+	if !ok || size <= MaxDatagramSize {
+		return conn, nil
+	}
+	stream, err := udp.streamConn()
+	if err != nil {
+		return conn, err
+	}
+	return stream, nil
+}
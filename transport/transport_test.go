@@ -0,0 +1,264 @@
+package transport
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"bit4bit.in/wueco/sipproto"
+)
+
+const options = "OPTIONS sip:bob@biloxi.com SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP pc33.atlanta.com;rport;branch=z9hG4bK776asdhds\r\n" +
+	"Call-ID: a84b4c76e66710@pc33.atlanta.com\r\n" +
+	"CSeq: 1 OPTIONS\r\n" +
+	"Content-Length: 0\r\n\r\n"
+
+func TestParseTarget(t *testing.T) {
+	target, err := ParseTarget("udp:1.2.3.4:5060")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if target.Transport != "udp" || target.Address != "1.2.3.4:5060" {
+		t.Errorf("fails to parse target got %+v\n", target)
+	}
+
+	target, err = ParseTarget("1.2.3.4:5060")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if target.Transport != "tcp" {
+		t.Errorf("expected tcp by default got %s\n", target.Transport)
+	}
+
+	if _, err := ParseTarget("udp:1.2.3.4"); err == nil {
+		t.Errorf("expected error without port")
+	}
+}
+
+func TestUDPConn(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer server.Close()
+
+	conn, err := Dial(Target{Transport: "udp", Address: server.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+	if conn.Reliable() || conn.Transport() != "UDP" {
+		t.Errorf("udp is not reliable")
+	}
+
+	if _, err := conn.Write([]byte(options)); err != nil {
+		t.Fatalf("%s", err)
+	}
+	buf := make([]byte, 2048)
+	n, from, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if string(buf[:n]) != options {
+		t.Errorf("fails to send datagram got %s\n", buf[:n])
+	}
+
+	// without content-length the body is the rest of the datagram
+	response := "SIP/2.0 200 OK\r\nCSeq: 1 OPTIONS\r\n\r\nhello"
+	if _, err := server.WriteTo([]byte(response), from); err != nil {
+		t.Fatalf("%s", err)
+	}
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if msg.Response == nil || msg.Response.StatusCode != 200 || msg.Content != "hello" {
+		t.Errorf("fails to read datagram got %+v\n", msg)
+	}
+}
+
+func TestUDPConnServerRestart(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	address := server.LocalAddr().String()
+	conn, err := Dial(Target{Transport: "udp", Address: address})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+
+	// the port unreachable of the server down fails a read of the socket
+	server.Close()
+	if _, err := conn.Write([]byte(options)); err != nil {
+		t.Fatalf("%s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	server, err = net.ListenPacket("udp", address)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer server.Close()
+	if _, err := conn.Write([]byte(options)); err != nil {
+		t.Fatalf("%s", err)
+	}
+	buf := make([]byte, 2048)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	_, from, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := server.WriteTo([]byte("SIP/2.0 200 OK\r\nCSeq: 1 OPTIONS\r\nContent-Length: 0\r\n\r\n"), from); err != nil {
+		t.Fatalf("%s", err)
+	}
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("expected the response of the server restarted got %s", err)
+	}
+	if msg.Response == nil || msg.Response.StatusCode != 200 {
+		t.Errorf("unexpected message %+v\n", msg)
+	}
+
+	conn.Close()
+	if _, err := conn.ReadMessage(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected closed got %v", err)
+	}
+}
+
+func TestUDPSelectTCPForLargeRequests(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer server.Close()
+	ln, err := net.Listen("tcp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer ln.Close()
+
+	conn, err := Dial(Target{Transport: "udp", Address: server.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+
+	small, err := Select(conn, len(options))
+	if err != nil || small != conn {
+		t.Errorf("small requests must use udp")
+	}
+
+	large, err := Select(conn, MaxDatagramSize+1)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !large.Reliable() || large.Transport() != "TCP" {
+		t.Errorf("large requests must use tcp")
+	}
+
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer accepted.Close()
+	body := strings.Repeat("a", MaxDatagramSize)
+	response := "SIP/2.0 200 OK\r\nCSeq: 1 OPTIONS\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	if _, err := accepted.Write([]byte(response)); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// responses over tcp are read from the udp connection
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if msg.Content != body {
+		t.Errorf("fails to read from tcp got %d bytes\n", len(msg.Content))
+	}
+}
+
+func TestStreamConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer ln.Close()
+
+	conn, err := Dial(Target{Transport: "tcp", Address: ln.Addr().String()})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer accepted.Close()
+	if _, err := conn.Write([]byte(options)); err != nil {
+		t.Fatalf("%s", err)
+	}
+	msg, err := sipproto.NewReader(bufio.NewReader(accepted)).ReadMessage()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !msg.IsRequest() || msg.Request.Method != "OPTIONS" {
+		t.Errorf("fails to send over tcp got %+v\n", msg)
+	}
+}
+
+func TestStreamConnKeepalive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer ln.Close()
+
+	conn, err := Dial(Target{Transport: "tcp", Address: ln.Addr().String()})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer accepted.Close()
+	go conn.ReadMessage()
+
+	pinger, ok := conn.(Pinger)
+	if !ok {
+		t.Fatalf("tcp must have keepalives")
+	}
+	if err := pinger.Ping(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "\r\n\r\n" {
+		t.Fatalf("expected ping got %q %v", buf, err)
+	}
+	// the pong of the server and its ping
+	if _, err := accepted.Write([]byte("\r\n")); err != nil {
+		t.Fatalf("%s", err)
+	}
+	select {
+	case <-pinger.Pong():
+	case <-time.After(time.Second):
+		t.Fatalf("expected pong")
+	}
+	if _, err := accepted.Write([]byte("\r\n\r\n")); err != nil {
+		t.Fatalf("%s", err)
+	}
+	accepted.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(accepted, buf[:2]); err != nil || string(buf[:2]) != "\r\n" {
+		t.Errorf("expected pong for the ping of the server got %q %v", buf[:2], err)
+	}
+}
@@ -0,0 +1,166 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+
+	"bit4bit.in/wueco/sipproto"
+)
+
+type readResult struct {
+	msg *sipproto.Message
+	err error
+}
+
+// udpConn sends a message per datagram, it keeps a TCP connection
+// to the same server for the requests that don't fit in a datagram.
+type udpConn struct {
+	*net.UDPConn
+	incoming chan readResult
+	done     chan struct{}
+
+	mu     sync.Mutex
+	stream *streamConn
+	closed bool
+}
+
+func dialUDP(address string) (*udpConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	c := &udpConn{
+		UDPConn:  conn,
+		incoming: make(chan readResult),
+		done:     make(chan struct{}),
+	}
+	go c.readDatagrams()
+	return c, nil
+}
+
+// readDatagrams delivers the datagrams until the connection fails, the
+// ICMP port unreachable of a server restarting (ECONNREFUSED on a
+// connected socket) doesn't stop the reading.
+func (c *udpConn) readDatagrams() {
+	buf := make([]byte, 65535)
+	for {
+		n, err := c.UDPConn.Read(buf)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			continue
+		}
+		if err != nil {
+			c.deliver(readResult{err: err})
+			return
+		}
+		msg, err := parseDatagram(buf[:n])
+		if err != nil {
+			// datagrams are independent, a bad one is discarded
+			continue
+		}
+		if !c.deliver(readResult{msg: msg}) {
+			return
+		}
+	}
+}
+
+func (c *udpConn) readStream(stream *streamConn) {
+	for {
+		msg, err := stream.ReadMessage()
+		if err != nil {
+			c.mu.Lock()
+			if c.stream == stream {
+				c.stream = nil
+			}
+			c.mu.Unlock()
+			stream.Close()
+			return
+		}
+		if !c.deliver(readResult{msg: msg}) {
+			return
+		}
+	}
+}
+
+func (c *udpConn) deliver(result readResult) bool {
+	select {
+	case c.incoming <- result:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *udpConn) ReadMessage() (*sipproto.Message, error) {
+	select {
+	case result := <-c.incoming:
+		return result.msg, result.err
+	case <-c.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (c *udpConn) Transport() string {
+	return "UDP"
+}
+
+func (c *udpConn) Reliable() bool {
+	return false
+}
+
+// streamConn returns the TCP connection to the server, it's dialed
+// on first use and the messages read from it are delivered by ReadMessage.
+func (c *udpConn) streamConn() (*streamConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, net.ErrClosed
+	}
+	if c.stream != nil {
+		return c.stream, nil
+	}
+	conn, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	c.stream = newStreamConn(conn, "TCP")
+	go c.readStream(c.stream)
+	return c.stream, nil
+}
+
+func (c *udpConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	if c.stream != nil {
+		c.stream.Close()
+	}
+	return c.UDPConn.Close()
+}
+
+// parseDatagram reads a message from a datagram, without
+// Content-Length the body is the rest of the datagram RFC 3261 section 18.3.
+func parseDatagram(data []byte) (*sipproto.Message, error) {
+	buf := bufio.NewReader(bytes.NewReader(data))
+	msg, err := sipproto.NewReader(buf).ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if !msg.Header.Has("content-length") {
+		rest, _ := io.ReadAll(buf)
+		msg.Content = string(rest)
+	}
+	return msg, nil
+}
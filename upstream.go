@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"bit4bit.in/wueco/sipproto"
+	"bit4bit.in/wueco/transaction"
+	"bit4bit.in/wueco/transport"
+)
+
+// backoff between the reconnections of an upstream connection
+const (
+	upstreamMinBackoff = 500 * time.Millisecond
+	upstreamMaxBackoff = 30 * time.Second
+)
+
+var errUpstreamDown = errors.New("upstream connection down")
+
+// upstream multiplexes the sessions of every websocket over a pool of
+// persistent connections to the SIP server, the messages of the SIP
+// server are routed back to the session by the flow token of wueco.
+type upstream struct {
+	target transport.Target
+	opts   []transport.DialOption
+	slots  []*upstreamSlot
+
+	// routes the initial requests of the SIP server
+	location *location
+	// server transactions of the forked requests and
+	// client transactions of the OPTIONS probes
+	layer *transaction.Layer
+	// intervals of the CRLF keepalives and the OPTIONS, 0 disables
+	pingInterval  time.Duration
+	probeInterval time.Duration
+	// host:port of wueco in Record-Route and Contact, the local
+	// address of a connection changes with the reconnections
+	advertise string
+
+	mu       sync.RWMutex
+	sessions map[string]*session
+	forks    map[transaction.Key]*fork
+}
+
+// upstreamSlot keeps the current connection of the pool, nil while reconnecting.
+type upstreamSlot struct {
+	mu   sync.RWMutex
+	conn transport.Conn
+}
+
+func newUpstream(target transport.Target, size int, opts ...transport.DialOption) *upstream {
+	if size < 1 {
+		size = 1
+	}
+	u := &upstream{
+		target:   target,
+		opts:     opts,
+		location: newLocation(),
+		layer:    transaction.NewLayer(),
+		sessions: make(map[string]*session),
+		forks:    make(map[transaction.Key]*fork),
+	}
+	for i := 0; i < size; i++ {
+		u.slots = append(u.slots, &upstreamSlot{})
+	}
+	return u
+}
+
+// start connects every slot of the pool.
+func (u *upstream) start() {
+	for i, slot := range u.slots {
+		go u.maintain(i, slot)
+	}
+}
+
+// maintain keeps the slot connected, a failed connection is
+// dialed again with exponential backoff.
+func (u *upstream) maintain(i int, slot *upstreamSlot) {
+	backoff := upstreamMinBackoff
+	for {
+		conn, err := transport.Dial(u.target, u.opts...)
+		if err != nil {
+			log.Printf("[ERR] upstream %d dial %s: %s, retry in %s\n", i, u.target.Address, err, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > upstreamMaxBackoff {
+				backoff = upstreamMaxBackoff
+			}
+			continue
+		}
+		log.Printf("upstream %d connected %s -> %s\n", i, conn.LocalAddr(), conn.RemoteAddr())
+		backoff = upstreamMinBackoff
+		slot.set(conn)
+		stop := make(chan struct{})
+		go u.keepalive(i, conn, stop)
+
+		u.read(conn)
+
+		close(stop)
+		slot.set(nil)
+		conn.Close()
+		log.Printf("upstream %d disconnected\n", i)
+	}
+}
+
+func (s *upstreamSlot) set(conn transport.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn = conn
+}
+
+func (s *upstreamSlot) get() transport.Conn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.conn
+}
+
+// conn returns the connection of the flow, the sessions
+// always use the same slot of the pool.
+func (u *upstream) conn(flow string) (transport.Conn, error) {
+	conn := u.slots[u.slotOf(flow)].get()
+	if conn == nil {
+		return nil, errUpstreamDown
+	}
+	return conn, nil
+}
+
+func (u *upstream) slotOf(flow string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(flow))
+	return int(hash.Sum32() % uint32(len(u.slots)))
+}
+
+func (u *upstream) attach(s *session) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.sessions[s.flow] = s
+}
+
+func (u *upstream) detach(s *session) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.sessions[s.flow] == s {
+		delete(u.sessions, s.flow)
+	}
+}
+
+func (u *upstream) session(flow string) (*session, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	s, ok := u.sessions[flow]
+	return s, ok
+}
+
+// find returns the first session accepted by match.
+func (u *upstream) find(match func(s *session) bool) (*session, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	for _, s := range u.sessions {
+		if match(s) {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// read dispatches the messages of conn until the connection fails.
+func (u *upstream) read(conn transport.Conn) {
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			log.Printf("[ERR] upstream read: %s\n", err)
+			return
+		}
+		if msg.IsRequest() {
+			err = u.dispatchRequest(conn, msg)
+		} else {
+			err = u.dispatchResponse(msg)
+		}
+		if err != nil {
+			log.Printf("[ERR] SIP -> WS: %s\n", err)
+		}
+	}
+}
+
+// dispatchResponse routes a response by the flow token in the branch of wueco.
+func (u *upstream) dispatchResponse(msg *sipproto.Message) error {
+	if u.layer.Response(msg) {
+		return nil
+	}
+	via, err := msg.Header.TopVia()
+	if err != nil {
+		return err
+	}
+	flow, ok := branchFlow(via.Branch())
+	if !ok {
+		return errors.New("response without via of wueco")
+	}
+	s, ok := u.session(flow)
+	if !ok {
+		// the websocket is gone
+		return nil
+	}
+	return s.handleSIPResponse(msg)
+}
+
+// dispatchRequest routes a request by the flow token of the routes of
+// wueco, then by dialog and then the initial requests are forked to the
+// sessions of the location service.
+func (u *upstream) dispatchRequest(conn transport.Conn, msg *sipproto.Message) error {
+	sipMsg, _ := newSIPMessage(msg)
+	if flow, ok := sipMsg.flow(); ok {
+		s, ok := u.session(flow)
+		if !ok {
+			return rejectSIP(conn, sipMsg, 430, "Flow Failed")
+		}
+		return s.handleSIPRequest(conn, msg)
+	}
+
+	// retransmissions and ACK of the forked requests
+	if key, err := transaction.ServerKey(msg); err == nil {
+		if _, ok := u.layer.Server(key); ok {
+			_, _, err := u.layer.Receive(msg, func(rsp *sipproto.Message) error { return writeSIP(conn, rsp) }, conn.Reliable())
+			return err
+		}
+	}
+	if sipMsg.IsMethod("CANCEL") {
+		if ok, err := u.cancelFork(conn, msg); ok {
+			return err
+		}
+	}
+
+	id := sipMsg.dialogID(false)
+	if s, ok := u.find(func(s *session) bool { _, ok := s.dialogs.get(id); return ok }); ok {
+		return s.handleSIPRequest(conn, msg)
+	}
+
+	if to, err := sipMsg.address("to"); err == nil && to.Tag() != "" {
+		return rejectSIP(conn, sipMsg, 481, "Call/Transaction Does Not Exist")
+	}
+	if sipMsg.IsMethod("ACK") || sipMsg.IsMethod("CANCEL") {
+		return rejectSIP(conn, sipMsg, 481, "Call/Transaction Does Not Exist")
+	}
+	if targets := u.location.lookup(sipMsg.request.RequestURI.String()); len(targets) > 0 {
+		return u.forkRequest(conn, msg, targets)
+	}
+	return rejectSIP(conn, sipMsg, 404, "Not Found")
+}
+
+// rejectSIP responds statelessly a request without session.
+func rejectSIP(conn transport.Conn, req *sipMessage, code int, reason string) error {
+	if req.IsMethod("ACK") {
+		return nil
+	}
+	return writeSIP(conn, newResponse(req, code, reason).message())
+}